@@ -1,4 +1,5 @@
 document.addEventListener('DOMContentLoaded', async () => {
+  await finishSSOLogin();
   const token = localStorage.getItem('token');
 
   if (token) {
@@ -36,7 +37,7 @@ async function createVideoDraft() {
     });
     const data = await res.json();
     if (!res.ok) {
-      throw new Error(`Failed to create video draft: ${data.error}`);
+      throw new Error(`Failed to create video draft: ${data.detail}`);
     }
 
     const videoID = data.id;
@@ -63,11 +64,10 @@ async function login() {
     });
     const data = await res.json();
     if (!res.ok) {
-      throw new Error(`Failed to login: ${data.error}`);
+      throw new Error(`Failed to login: ${data.detail}`);
     }
 
-    if (data.token) {
-      localStorage.setItem('token', data.token);
+    if (await completeLogin(data)) {
       document.getElementById('auth-section').style.display = 'none';
       document.getElementById('video-section').style.display = 'block';
       await getVideos();
@@ -79,6 +79,92 @@ async function login() {
   }
 }
 
+// completeLogin asks for the second factor if the account has one, then
+// stores the access token. It reports whether the user is logged in.
+async function completeLogin(data) {
+  if (data.mfa_required) {
+    const code = prompt('Enter the code from your authenticator app, or a recovery code');
+    if (!code) {
+      return false;
+    }
+    const isTOTP = /^\d{6}$/.test(code.trim());
+    const res = await fetch('/api/login/mfa', {
+      method: 'POST',
+      headers: {
+        'Content-Type': 'application/json',
+      },
+      body: JSON.stringify(
+        isTOTP ? { mfa_token: data.mfa_token, code: code.trim() } : { mfa_token: data.mfa_token, recovery_code: code }
+      ),
+    });
+    data = await res.json();
+    if (!res.ok) {
+      throw new Error(`Failed to login: ${data.detail}`);
+    }
+  }
+  if (!data.token) {
+    return false;
+  }
+  localStorage.setItem('token', data.token);
+  return true;
+}
+
+function loginWithSSO() {
+  window.location.href = '/api/oidc/login';
+}
+
+// finishSSOLogin picks up where the single sign-on callback left off: it
+// redirects here with a one-time code, or an error, in the URL fragment.
+async function finishSSOLogin() {
+  const fragment = new URLSearchParams(window.location.hash.slice(1));
+  const code = fragment.get('oidc_code');
+  const ssoError = fragment.get('oidc_error');
+  if (!code && !ssoError) {
+    return;
+  }
+  // Keep the code out of the history, it can only be used once anyway.
+  history.replaceState(null, '', window.location.pathname + window.location.search);
+  if (ssoError) {
+    alert(`Single sign-on failed: ${ssoError}`);
+    return;
+  }
+
+  try {
+    const res = await fetch('/api/oidc/exchange', {
+      method: 'POST',
+      headers: {
+        'Content-Type': 'application/json',
+      },
+      body: JSON.stringify({ code }),
+    });
+    const data = await res.json();
+    if (!res.ok) {
+      throw new Error(`Failed to login: ${data.detail}`);
+    }
+    await completeLogin(data);
+  } catch (error) {
+    alert(`Error: ${error.message}`);
+  }
+}
+
+async function linkSSO() {
+  try {
+    const res = await fetch('/api/oidc/link', {
+      method: 'POST',
+      headers: {
+        Authorization: `Bearer ${localStorage.getItem('token')}`,
+      },
+    });
+    const data = await res.json();
+    if (!res.ok) {
+      throw new Error(`Failed to link single sign-on: ${data.detail}`);
+    }
+    window.location.href = data.url;
+  } catch (error) {
+    alert(`Error: ${error.message}`);
+  }
+}
+
 async function signup() {
   const email = document.getElementById('email').value;
   const password = document.getElementById('password').value;
@@ -93,7 +179,7 @@ async function signup() {
     });
     if (!res.ok) {
       const data = await res.json();
-      throw new Error(`Failed to create user: ${data.error}`);
+      throw new Error(`Failed to create user: ${data.detail}`);
     }
     console.log('User created!');
     await login();
@@ -139,7 +225,7 @@ async function uploadThumbnail(videoID) {
     });
     if (!res.ok) {
       const data = await res.json();
-      throw new Error(`Failed to upload thumbnail. Error: ${data.error}`);
+      throw new Error(`Failed to upload thumbnail. Error: ${data.detail}`);
     }
 
     await res.json();
@@ -172,7 +258,7 @@ async function uploadVideoFile(videoID) {
     });
     if (!res.ok) {
       const data = await res.json();
-      throw new Error(`Failed to upload video file. Error: ${data.error}`);
+      throw new Error(`Failed to upload video file. Error: ${data.detail}`);
     }
 
     console.log('Video uploaded!');
@@ -196,7 +282,7 @@ async function getVideos() {
     });
     if (!res.ok) {
       const data = await res.json();
-      throw new Error(`Failed to get videos. Error: ${data.error}`);
+      throw new Error(`Failed to get videos. Error: ${data.detail}`);
     }
 
     const videos = await res.json();
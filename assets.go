@@ -1,11 +1,17 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"os"
+	"path"
 	"path/filepath"
 	"strings"
 
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/storage"
 )
 
 func (cfg apiConfig) ensureAssetsDir() error {
@@ -31,6 +37,39 @@ func (cfg apiConfig) getAssetDiskPath(assetPath string) string {
 	return filepath.Join(cfg.assetsRoot, assetPath)
 }
 
-func (cfg apiConfig) getAssetURL(assetPath string) string {
-	return fmt.Sprintf("http://localhost:%s/assets/%s", cfg.port, assetPath)
-}
\ No newline at end of file
+// assetURL is the public URL of a stored asset, under PUBLIC_ASSETS_URL.
+func (cfg apiConfig) assetURL(key string) string {
+	return strings.TrimSuffix(cfg.publicAssetsURL, "/") + "/" + key
+}
+
+// thumbnailKeyPrefix is where thumbnails live in the storage backend. Only
+// this prefix is public, videos need signed URLs or stream tokens.
+const thumbnailKeyPrefix = "thumbnails/"
+
+// saveThumbnail stores an image under a name derived from its SHA-256, so an
+// object never changes once written and can be cached forever. It returns
+// the storage key.
+func (cfg apiConfig) saveThumbnail(ctx context.Context, content []byte, mediaType string) (string, error) {
+	hash := sha256.Sum256(content)
+	key := thumbnailKeyPrefix + createAssetPath(hex.EncodeToString(hash[:]), mediaType, cfg.assetsRoot)
+	_, err := cfg.mediaStorage.Put(ctx, key, bytes.NewReader(content), storage.PutOptions{
+		ContentType:  mediaType,
+		CacheControl: immutableCacheControl,
+	})
+	if err != nil {
+		return "", err
+	}
+	return key, nil
+}
+
+// isContentAddressed reports whether an asset name is a hex SHA-256 written
+// by saveThumbnail. Older assets used random names.
+func isContentAddressed(assetPath string) bool {
+	name := path.Base(assetPath)
+	name = strings.TrimSuffix(name, path.Ext(name))
+	if len(name) != sha256.Size*2 {
+		return false
+	}
+	_, err := hex.DecodeString(name)
+	return err == nil
+}
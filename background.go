@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+)
+
+// backgroundTasks runs work that shouldn't hold up a response, like
+// deleting files nothing references any more, and lets shutdown wait for it.
+type backgroundTasks struct {
+	ctx     context.Context
+	cancel  context.CancelFunc
+	wg      sync.WaitGroup
+	running atomic.Int64
+}
+
+func newBackgroundTasks() *backgroundTasks {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &backgroundTasks{ctx: ctx, cancel: cancel}
+}
+
+// Go runs fn in a goroutine. Its context keeps the values of ctx, so logs
+// and spans still belong to the request, but isn't cancelled when the
+// request ends, only when Drain gives up. It mustn't be called once Drain
+// has started, i.e. outside request handlers after the server has shut down.
+func (b *backgroundTasks) Go(ctx context.Context, fn func(ctx context.Context)) {
+	b.wg.Add(1)
+	b.running.Add(1)
+	go func() {
+		defer b.wg.Done()
+		defer b.running.Add(-1)
+		ctx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+		defer cancel()
+		stop := context.AfterFunc(b.ctx, cancel)
+		defer stop()
+		fn(ctx)
+	}()
+}
+
+// Drain waits for running tasks to finish. If ctx ends first, the tasks are
+// cancelled and Drain returns without waiting for them, see Wait.
+func (b *backgroundTasks) Drain(ctx context.Context) error {
+	if b.running.Load() == 0 {
+		return nil
+	}
+	err := waitGroupContext(ctx, &b.wg)
+	if err != nil {
+		b.cancel()
+	}
+	return err
+}
+
+// Wait waits for the tasks to return, e.g. after Drain cancelled them.
+func (b *backgroundTasks) Wait(ctx context.Context) error {
+	return waitGroupContext(ctx, &b.wg)
+}
+
+// waitGroupContext waits for wg, giving up when ctx ends.
+func waitGroupContext(ctx context.Context, wg *sync.WaitGroup) error {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -1,6 +1,14 @@
 package main
 
-import "net/http"
+import (
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+const immutableCacheControl = "public, max-age=31536000, immutable"
 
 func noCacheMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -8,3 +16,32 @@ func noCacheMiddleware(next http.Handler) http.Handler {
 		next.ServeHTTP(w, r)
 	})
 }
+
+// assetCacheMiddleware lets browsers keep the assets served from root.
+// Content-addressed files never change, so they get an immutable max-age
+// and their hash as a strong ETag, which http.FileServer checks against
+// If-None-Match. Everything else falls back to Last-Modified and
+// revalidation. In dev mode nothing is cached.
+func (cfg apiConfig) assetCacheMiddleware(root string, next http.Handler) http.Handler {
+	if cfg.platform == "dev" {
+		return noCacheMiddleware(next)
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assetPath := strings.TrimPrefix(path.Clean("/"+r.URL.Path), "/")
+		// Only cache real files, not 404s or directory listings.
+		info, err := os.Stat(filepath.Join(root, filepath.FromSlash(assetPath)))
+		if err != nil || !info.Mode().IsRegular() {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if isContentAddressed(assetPath) {
+			name := strings.TrimSuffix(assetPath, path.Ext(assetPath))
+			w.Header().Set("Cache-Control", immutableCacheControl)
+			w.Header().Set("ETag", `"`+name+`"`)
+		} else {
+			w.Header().Set("Cache-Control", "public, no-cache")
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/apierror"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/config"
+)
+
+// corsPolicy says which other origins may call the API from a browser, such
+// as a frontend deployed separately from the bundled /app/.
+type corsPolicy struct {
+	anyOrigin        bool
+	origins          map[string]bool
+	methods          []string
+	headers          map[string]bool
+	exposedHeaders   []string
+	allowCredentials bool
+	maxAge           time.Duration
+}
+
+// newCORSPolicy builds the policy from the configuration, or returns nil if
+// no origin is allowed. Config.Validate has checked the settings.
+func newCORSPolicy(conf config.Config) *corsPolicy {
+	origins := config.SplitList(conf.CORSAllowedOrigins)
+	if len(origins) == 0 {
+		return nil
+	}
+	p := &corsPolicy{
+		origins:          map[string]bool{},
+		methods:          config.SplitList(conf.CORSAllowedMethods),
+		headers:          map[string]bool{},
+		exposedHeaders:   config.SplitList(conf.CORSExposedHeaders),
+		allowCredentials: conf.CORSAllowCredentials,
+		maxAge:           conf.CORSMaxAge,
+	}
+	for _, origin := range origins {
+		if origin == "*" {
+			p.anyOrigin = true
+		}
+		p.origins[strings.ToLower(origin)] = true
+	}
+	for _, header := range config.SplitList(conf.CORSAllowedHeaders) {
+		p.headers[http.CanonicalHeaderKey(header)] = true
+	}
+	return p
+}
+
+func (p *corsPolicy) allowsOrigin(origin string) bool {
+	return p.anyOrigin || p.origins[strings.ToLower(origin)]
+}
+
+// corsMiddleware adds CORS headers to responses under /api/ and answers
+// preflight requests itself: the routes only register the methods they
+// serve, so the mux would refuse an OPTIONS request with a 405. It sits
+// outside the body limits and handlers, so their errors, such as a 413 for
+// an upload that's too large, are readable by the frontend too.
+func corsMiddleware(policy *corsPolicy) middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			origin := r.Header.Get("Origin")
+			if !strings.HasPrefix(r.URL.Path, "/api/") || origin == "" {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			header := w.Header()
+			if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+				header.Add("Vary", "Origin")
+				header.Add("Vary", "Access-Control-Request-Method")
+				header.Add("Vary", "Access-Control-Request-Headers")
+				handlePreflight(w, r, policy, origin)
+				return
+			}
+
+			header.Add("Vary", "Origin")
+			if policy.allowsOrigin(origin) {
+				policy.setAllowOrigin(header, origin)
+				if len(policy.exposedHeaders) > 0 {
+					header.Set("Access-Control-Expose-Headers", strings.Join(policy.exposedHeaders, ", "))
+				}
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// handlePreflight answers a browser asking whether it may send a request.
+// Uploads are always preflighted, since they carry an Authorization header;
+// their multipart/form-data content type needs no permission of its own.
+// A refusal is a 403 without CORS headers, which the browser reports as a
+// CORS error, with a body saying why for whoever opens the network tab.
+func handlePreflight(w http.ResponseWriter, r *http.Request, policy *corsPolicy, origin string) {
+	method := r.Header.Get("Access-Control-Request-Method")
+	requested := config.SplitList(r.Header.Get("Access-Control-Request-Headers"))
+	switch {
+	case !policy.allowsOrigin(origin):
+		respondWithErrorCode(w, http.StatusForbidden, apierror.CodeForbidden, "Origin "+origin+" isn't allowed", nil)
+		return
+	case !slices.Contains(policy.methods, method):
+		respondWithErrorCode(w, http.StatusForbidden, apierror.CodeForbidden, "Method "+method+" isn't allowed cross-origin", nil)
+		return
+	}
+	for _, name := range requested {
+		if !policy.headers[http.CanonicalHeaderKey(name)] {
+			respondWithErrorCode(w, http.StatusForbidden, apierror.CodeForbidden, "Header "+name+" isn't allowed cross-origin", nil)
+			return
+		}
+	}
+
+	header := w.Header()
+	policy.setAllowOrigin(header, origin)
+	header.Set("Access-Control-Allow-Methods", strings.Join(policy.methods, ", "))
+	if len(requested) > 0 {
+		header.Set("Access-Control-Allow-Headers", strings.Join(requested, ", "))
+	}
+	if policy.maxAge > 0 {
+		header.Set("Access-Control-Max-Age", strconv.Itoa(int(policy.maxAge.Seconds())))
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// setAllowOrigin echoes the origin back, unless any origin is allowed.
+// Credentials are never allowed with any origin, see Config.Validate.
+func (p *corsPolicy) setAllowOrigin(header http.Header, origin string) {
+	if p.anyOrigin {
+		header.Set("Access-Control-Allow-Origin", "*")
+	} else {
+		header.Set("Access-Control-Allow-Origin", origin)
+	}
+	if p.allowCredentials {
+		header.Set("Access-Control-Allow-Credentials", "true")
+	}
+}
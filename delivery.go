@@ -0,0 +1,280 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"mime"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/feature/cloudfront/sign"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/cloudfront"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/config"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/imaging"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/metrics"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/storage"
+	"github.com/google/uuid"
+)
+
+// urlSigningPolicy decides how long signed URLs live and what they're bound
+// to. The per-video url_ttl_seconds field overrides the default TTL.
+type urlSigningPolicy struct {
+	defaultTTL   time.Duration
+	downloadTTL  time.Duration
+	bindClientIP bool
+}
+
+type signOptions struct {
+	ttl      time.Duration
+	clientIP string
+	// disposition sets response-content-disposition, turning the URL into a
+	// download link.
+	disposition string
+}
+
+func (cfg *apiConfig) playbackSignOptions(r *http.Request, video database.Video) signOptions {
+	opts := signOptions{
+		ttl: cfg.urlPolicy.defaultTTL,
+	}
+	if video.URLTTLSeconds != nil {
+		opts.ttl = time.Duration(*video.URLTTLSeconds) * time.Second
+	}
+	// IPv6 clients get a URL that isn't bound rather than no URL at all.
+	if ip := clientIP(r); cfg.urlPolicy.bindClientIP && cloudfront.CanBindIP(ip) {
+		opts.clientIP = ip
+	}
+	return opts
+}
+
+func (cfg *apiConfig) dbVideoToSignedVideo(r *http.Request, video database.Video) (database.Video, error) {
+	// Thumbnail URLs are worked out from storage keys on every response, so
+	// changing PUBLIC_ASSETS_URL doesn't leave stale URLs behind.
+	if len(video.ThumbnailVariants) > 0 {
+		video.ThumbnailURL = cfg.largestThumbnailURL(video.ThumbnailVariants, imaging.FormatJPEG)
+		video.ThumbnailSrcset = cfg.thumbnailSrcset(video.ThumbnailVariants)
+	}
+
+	object := video.VideoObject
+	if object == nil {
+		return video, nil
+	}
+
+	signedURL, err := cfg.signVideoURL(r.Context(), video.ID, *object, cfg.playbackSignOptions(r, video))
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Couldn't sign video URL", "video_id", video.ID, "error", err)
+		return video, err
+	}
+
+	video.VideoURL = &signedURL
+
+	return video, nil
+}
+
+func (cfg *apiConfig) signVideoURL(ctx context.Context, videoID uuid.UUID, object database.StorageObject, opts signOptions) (string, error) {
+	if object.Backend == storage.BackendLocal {
+		return cfg.streamURL(videoID, opts)
+	}
+
+	if cfg.s3Client == nil {
+		return "", errors.New("video is stored in S3, which isn't configured")
+	}
+
+	bucket, key := object.Bucket, object.Key
+	// CloudFront can't override response headers, so download links always
+	// come straight from S3.
+	if cfg.videoDelivery != config.DeliveryCloudFront || opts.disposition != "" {
+		return generatePresignedURL(ctx, cfg.s3Client, bucket, key, opts.ttl, opts.disposition)
+	}
+
+	expires := time.Now().Add(opts.ttl)
+	if opts.clientIP == "" {
+		return cfg.cfSigner.SignURL(key, expires)
+	}
+	return cfg.cfSigner.SignURLWithPolicy(key, cloudfront.PolicyOptions{
+		Expires:  expires,
+		ClientIP: opts.clientIP,
+	})
+}
+
+func (cfg *apiConfig) handlerVideoDownload(w http.ResponseWriter, r *http.Request) {
+	type response struct {
+		URL       string    `json:"url"`
+		ExpiresAt time.Time `json:"expires_at"`
+	}
+
+	videoID, err := uuid.Parse(r.PathValue("videoID"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid ID", err)
+		return
+	}
+
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return
+	}
+	userID, err := auth.ValidateJWT(token, cfg.jwtSecret)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		return
+	}
+
+	video, err := cfg.db.GetVideo(r.Context(), videoID)
+	if errors.Is(err, database.ErrNotFound) {
+		respondWithError(w, http.StatusNotFound, "Video not found", err)
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get video", err)
+		return
+	}
+	if video.UserID != userID {
+		respondWithError(w, http.StatusForbidden, "You can't download this video", nil)
+		return
+	}
+	object := video.VideoObject
+	if object == nil {
+		respondWithError(w, http.StatusNotFound, "Video has no uploaded file", nil)
+		return
+	}
+
+	ttl := cfg.urlPolicy.downloadTTL
+	downloadURL, err := cfg.signVideoURL(r.Context(), video.ID, *object, signOptions{
+		ttl:         ttl,
+		disposition: attachmentDisposition(video.Title, path.Ext(object.Key)),
+	})
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't sign download URL", err)
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, response{
+		URL:       downloadURL,
+		ExpiresAt: time.Now().UTC().Add(ttl),
+	})
+}
+
+// attachmentDisposition builds a Content-Disposition header that saves the
+// file under the video's title.
+func attachmentDisposition(title, ext string) string {
+	name := strings.Map(func(r rune) rune {
+		if r < 0x20 || strings.ContainsRune(`/\:*?"<>|`, r) {
+			return '_'
+		}
+		return r
+	}, strings.TrimSpace(title))
+	if name == "" {
+		name = "video"
+	}
+	return mime.FormatMediaType("attachment", map[string]string{"filename": name + ext})
+}
+
+// handlerVideoPlaybackCookies sets CloudFront signed cookies covering every
+// object stored under the video's key, so players can fetch HLS playlists
+// and segments without each one being signed. Public videos, and unlisted
+// ones with a share token, need no login.
+func (cfg *apiConfig) handlerVideoPlaybackCookies(w http.ResponseWriter, r *http.Request) {
+	if cfg.videoDelivery != config.DeliveryCloudFront {
+		respondWithError(w, http.StatusNotFound, "Signed cookies are only available with CloudFront delivery", nil)
+		return
+	}
+
+	videoID, err := uuid.Parse(r.PathValue("videoID"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid ID", err)
+		return
+	}
+
+	video, err := cfg.db.GetVideo(r.Context(), videoID)
+	if errors.Is(err, database.ErrNotFound) {
+		respondWithError(w, http.StatusNotFound, "Video not found", err)
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get video", err)
+		return
+	}
+	// Anyone who can see the video can play it, like in handlerVideoGet.
+	allowed, err := cfg.canViewVideo(r, video)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't validate credentials", err)
+		return
+	}
+	if !allowed {
+		respondWithError(w, http.StatusNotFound, "Video not found", nil)
+		return
+	}
+	if video.VideoObject == nil {
+		respondWithError(w, http.StatusNotFound, "Video has no uploaded file", nil)
+		return
+	}
+	key := video.VideoObject.Key
+
+	// "landscape/abc.mp4" covers both the file itself and an HLS directory
+	// like "landscape/abc/".
+	prefix := strings.TrimSuffix(key, path.Ext(key))
+	cookies, err := cfg.cfSigner.SignCookies(prefix, cloudfront.PolicyOptions{
+		Expires: time.Now().Add(cfg.playbackSignOptions(r, video).ttl),
+	}, sign.CookieOptions{
+		Domain:   cfg.cfCookieDomain,
+		SameSite: http.SameSiteNoneMode,
+	})
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't sign cookies", err)
+		return
+	}
+
+	for _, cookie := range cookies {
+		http.SetCookie(w, cookie)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// deleteStoredObject removes a file that's no longer referenced, in the
+// background so the response doesn't wait and a client hanging up doesn't
+// cancel it. Failures are only logged, the database row is already gone.
+func (cfg *apiConfig) deleteStoredObject(ctx context.Context, object database.StorageObject) {
+	if object.Backend != cfg.mediaStorage.Name() || object.Bucket != cfg.mediaStorage.Bucket() {
+		slog.WarnContext(ctx, "Not deleting object from another storage backend", "backend", object.Backend, "bucket", object.Bucket, "key", object.Key)
+		return
+	}
+	cfg.background.Go(ctx, func(ctx context.Context) {
+		err := cfg.mediaStorage.Delete(ctx, object.Key)
+		if err != nil {
+			slog.ErrorContext(ctx, "Couldn't delete stored object", "bucket", object.Bucket, "key", object.Key, "error", err)
+		}
+	})
+}
+
+// Helper function to convert a string to a string pointer
+func ptr(s string) *string {
+	return &s
+}
+
+func generatePresignedURL(ctx context.Context, s3Client *s3.Client, bucket, key string, expireTime time.Duration, contentDisposition string) (string, error) {
+
+	presignClient := s3.NewPresignClient(s3Client)
+	input := &s3.GetObjectInput{
+		Bucket: ptr(bucket),
+		Key:    ptr(key),
+	}
+	if contentDisposition != "" {
+		input.ResponseContentDisposition = ptr(contentDisposition)
+	}
+	start := time.Now()
+	presignRequest, err := presignClient.PresignGetObject(ctx, input, s3.WithPresignExpires(expireTime))
+	metrics.ObserveS3("PresignGetObject", start, err)
+	if err != nil {
+		slog.ErrorContext(ctx, "Couldn't presign URL", "bucket", bucket, "key", key, "error", err)
+		return "", err
+	}
+
+	return presignRequest.URL, nil
+
+}
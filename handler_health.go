@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"runtime/debug"
+	"sync"
+	"time"
+)
+
+// version is set at build time with -ldflags "-X main.version=v1.2.3".
+var version = "dev"
+
+// readinessCheck is one dependency the server needs to handle requests.
+type readinessCheck struct {
+	name    string
+	timeout time.Duration
+	check   func(ctx context.Context) error
+}
+
+func (cfg *apiConfig) readinessChecks() []readinessCheck {
+	return []readinessCheck{
+		{"database", 2 * time.Second, cfg.db.Ping},
+		{"assets", 2 * time.Second, cfg.checkAssetsWritable},
+		{"storage", 3 * time.Second, cfg.mediaStorage.Check},
+		{"ffmpeg", time.Second, checkBinary("ffmpeg")},
+		{"ffprobe", time.Second, checkBinary("ffprobe")},
+	}
+}
+
+// checkAssetsWritable creates and removes a file in assetsRoot, where
+// thumbnails are written before they're stored.
+func (cfg *apiConfig) checkAssetsWritable(ctx context.Context) error {
+	file, err := os.CreateTemp(cfg.assetsRoot, ".readyz-*")
+	if err != nil {
+		return err
+	}
+	file.Close()
+	return os.Remove(file.Name())
+}
+
+func checkBinary(name string) func(ctx context.Context) error {
+	return func(ctx context.Context) error {
+		_, err := exec.LookPath(name)
+		return err
+	}
+}
+
+// run calls the check with its timeout. Checks that ignore their context
+// are abandoned when the timeout passes.
+func (c readinessCheck) run(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+
+	done := make(chan error, 1)
+	go func() {
+		done <- c.check(ctx)
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return fmt.Errorf("timed out after %s", c.timeout)
+	}
+}
+
+// handlerHealthz tells the orchestrator the process is alive. It checks
+// nothing else, a broken dependency shouldn't get the server restarted.
+func handlerHealthz(w http.ResponseWriter, r *http.Request) {
+	respondWithJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+// handlerReadyz runs every readiness check in parallel and answers 503 if
+// any fails, so traffic is routed elsewhere until it recovers.
+func (cfg *apiConfig) handlerReadyz(w http.ResponseWriter, r *http.Request) {
+	type checkResult struct {
+		Status     string `json:"status"`
+		Error      string `json:"error,omitempty"`
+		DurationMS int64  `json:"duration_ms"`
+	}
+	type response struct {
+		Status string                 `json:"status"`
+		Checks map[string]checkResult `json:"checks"`
+	}
+
+	checks := cfg.readinessChecks()
+	results := make([]checkResult, len(checks))
+	var wg sync.WaitGroup
+	for i, check := range checks {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			start := time.Now()
+			err := check.run(r.Context())
+			results[i] = checkResult{Status: "ok", DurationMS: time.Since(start).Milliseconds()}
+			if err != nil {
+				results[i].Status = "failed"
+				results[i].Error = err.Error()
+			}
+		}()
+	}
+	wg.Wait()
+
+	resp := response{Status: "ok", Checks: map[string]checkResult{}}
+	code := http.StatusOK
+	for i, check := range checks {
+		resp.Checks[check.name] = results[i]
+		if results[i].Status != "ok" {
+			resp.Status = "unavailable"
+			code = http.StatusServiceUnavailable
+		}
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	respondWithJSON(w, code, resp)
+}
+
+// handlerVersion reports what's running, from the version set at build time
+// and the build info the Go toolchain embeds.
+func handlerVersion(w http.ResponseWriter, r *http.Request) {
+	type response struct {
+		Version   string `json:"version"`
+		GoVersion string `json:"go_version"`
+		Revision  string `json:"revision,omitempty"`
+		BuildTime string `json:"build_time,omitempty"`
+		Modified  bool   `json:"modified,omitempty"`
+	}
+
+	resp := response{Version: version}
+	if info, ok := debug.ReadBuildInfo(); ok {
+		resp.GoVersion = info.GoVersion
+		if resp.Version == "dev" && info.Main.Version != "" && info.Main.Version != "(devel)" {
+			resp.Version = info.Main.Version
+		}
+		for _, setting := range info.Settings {
+			switch setting.Key {
+			case "vcs.revision":
+				resp.Revision = setting.Value
+			case "vcs.time":
+				resp.BuildTime = setting.Value
+			case "vcs.modified":
+				resp.Modified = setting.Value == "true"
+			}
+		}
+	}
+	respondWithJSON(w, http.StatusOK, resp)
+}
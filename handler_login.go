@@ -2,43 +2,124 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
+	"log/slog"
 	"net/http"
 	"time"
 
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/apierror"
 	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
 	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
 )
 
+// unknownUserPasswordHash is a bcrypt hash at the default cost of a random
+// password, checked for logins with an email nobody signed up with.
+const unknownUserPasswordHash = "$2a$10$N7zcJeWGMK5BTi8LOxwX0uotThNurImA5vlW49qdRP7OnfOxcfaVS"
+
 func (cfg *apiConfig) handlerLogin(w http.ResponseWriter, r *http.Request) {
 	type parameters struct {
 		Password string `json:"password"`
 		Email    string `json:"email"`
 	}
-	type response struct {
-		database.User
-		Token        string `json:"token"`
-		RefreshToken string `json:"refresh_token"`
-	}
 
 	decoder := json.NewDecoder(r.Body)
 	params := parameters{}
 	err := decoder.Decode(&params)
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Couldn't decode parameters", err)
+		respondWithErrorCode(w, http.StatusBadRequest, apierror.CodeInvalidJSON, "Couldn't decode parameters", err)
 		return
 	}
 
-	user, err := cfg.db.GetUserByEmail(params.Email)
+	ip := clientIP(r)
+	throttle, err := cfg.checkLoginThrottle(r.Context(), params.Email, ip)
 	if err != nil {
-		respondWithError(w, http.StatusUnauthorized, "Incorrect email or password", err)
+		respondWithError(w, http.StatusInternalServerError, "Couldn't check login attempts", err)
+		return
+	}
+	if throttle.wait > 0 {
+		setRetryAfter(w, throttle.wait)
+		respondWithError(w, http.StatusTooManyRequests, throttle.reason, nil)
+		return
+	}
+
+	attempt := database.CreateLoginAttemptParams{
+		Email:     normalizeEmail(params.Email),
+		IPAddress: ip,
+		UserAgent: r.UserAgent(),
+	}
+
+	// An unknown email fails the password check below just like a wrong
+	// password, so it's throttled the same way and answered the same. It's
+	// checked against a dummy hash so it takes as long as a real check.
+	user, err := cfg.db.GetUserByEmail(r.Context(), params.Email)
+	if err != nil && !errors.Is(err, database.ErrNotFound) {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get user", err)
 		return
 	}
+	passwordHash := user.Password
+	if errors.Is(err, database.ErrNotFound) {
+		passwordHash = unknownUserPasswordHash
+	}
 
-	err = auth.CheckPasswordHash(params.Password, user.Password)
+	err = auth.CheckPasswordHash(params.Password, passwordHash)
 	if err != nil {
-		respondWithError(w, http.StatusUnauthorized, "Incorrect email or password", err)
+		if recordErr := cfg.recordLoginAttempt(r.Context(), attempt); recordErr != nil {
+			slog.ErrorContext(r.Context(), "Couldn't record login attempt", "error", recordErr)
+		}
+		respondWithErrorCode(w, http.StatusUnauthorized, apierror.CodeInvalidCredentials, "Incorrect email or password", err)
+		return
+	}
+
+	totp, err := cfg.db.GetUserTOTP(r.Context(), user.ID)
+	if err != nil && !errors.Is(err, database.ErrNotFound) {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get two-factor settings", err)
 		return
 	}
+	if err == nil && totp.Enabled() {
+		// The password was right, but the login only counts as successful
+		// once the second factor is checked in handlerLoginMFA.
+		cfg.respondWithMFAChallenge(w, user.ID)
+		return
+	}
+
+	attempt.Succeeded = true
+	err = cfg.recordLoginAttempt(r.Context(), attempt)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't record login attempt", err)
+		return
+	}
+
+	cfg.respondWithSession(w, r, user)
+}
+
+type mfaChallengeResponse struct {
+	MFARequired bool   `json:"mfa_required"`
+	MFAToken    string `json:"mfa_token"`
+}
+
+// respondWithMFAChallenge answers a login whose first factor checked out
+// with a token for handlerLoginMFA.
+func (cfg *apiConfig) respondWithMFAChallenge(w http.ResponseWriter, userID uuid.UUID) {
+	mfaToken, err := auth.MakeMFAToken(userID, cfg.jwtSecret, mfaTokenTTL)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't create MFA token", err)
+		return
+	}
+	respondWithJSON(w, http.StatusOK, mfaChallengeResponse{
+		MFARequired: true,
+		MFAToken:    mfaToken,
+	})
+}
+
+// respondWithSession issues a new access and refresh token pair for a user
+// who has fully authenticated.
+func (cfg *apiConfig) respondWithSession(w http.ResponseWriter, r *http.Request, user database.User) {
+	type response struct {
+		database.User
+		Token        string `json:"token"`
+		RefreshToken string `json:"refresh_token"`
+	}
 
 	accessToken, err := auth.MakeJWT(
 		user.ID,
@@ -56,7 +137,7 @@ func (cfg *apiConfig) handlerLogin(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	_, err = cfg.db.CreateRefreshToken(database.CreateRefreshTokenParams{
+	_, err = cfg.db.CreateRefreshToken(r.Context(), database.CreateRefreshTokenParams{
 		UserID:    user.ID,
 		Token:     refreshToken,
 		ExpiresAt: time.Now().UTC().Add(time.Hour * 24 * 60),
@@ -0,0 +1,383 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/apierror"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/oidc"
+	"github.com/google/uuid"
+)
+
+const (
+	oidcStateCookie = "tubely_oidc_state"
+	oidcStateTTL    = 10 * time.Minute
+
+	// oidcLoginCodeTTL only has to cover the app loading after the
+	// callback redirects to it.
+	oidcLoginCodeTTL = time.Minute
+)
+
+// errOIDCNotConfigured is reported when single sign-on is used without
+// OIDC_ISSUER. The routes are always registered so the app can tell.
+var errOIDCNotConfigured = errors.New("single sign-on isn't configured")
+
+// handlerOIDCLogin starts a single sign-on login. It's a browser navigation,
+// so failures go back to the app like the callback's do.
+func (cfg *apiConfig) handlerOIDCLogin(w http.ResponseWriter, r *http.Request) {
+	if cfg.oidcProvider == nil {
+		redirectWithOIDCError(w, r, http.StatusNotFound, "Single sign-on isn't configured", errOIDCNotConfigured)
+		return
+	}
+	authURL, err := cfg.startOIDCLogin(w, r, nil)
+	if err != nil {
+		redirectWithOIDCError(w, r, http.StatusInternalServerError, "Couldn't start single sign-on", err)
+		return
+	}
+	http.Redirect(w, r, authURL, http.StatusFound)
+}
+
+// handlerOIDCLink starts linking an external identity to the logged-in
+// user. It answers with the URL to send the browser to, since a navigation
+// can't carry the access token.
+func (cfg *apiConfig) handlerOIDCLink(w http.ResponseWriter, r *http.Request) {
+	if cfg.oidcProvider == nil {
+		respondWithError(w, http.StatusNotFound, "Single sign-on isn't configured", errOIDCNotConfigured)
+		return
+	}
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return
+	}
+	userID, err := auth.ValidateJWT(token, cfg.jwtSecret)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		return
+	}
+
+	authURL, err := cfg.startOIDCLogin(w, r, &userID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't start single sign-on", err)
+		return
+	}
+	respondWithJSON(w, http.StatusOK, struct {
+		URL string `json:"url"`
+	}{URL: authURL})
+}
+
+// startOIDCLogin saves a pending login and ties it to the browser with a
+// cookie. It returns the identity provider URL to send the browser to.
+func (cfg *apiConfig) startOIDCLogin(w http.ResponseWriter, r *http.Request, linkUserID *uuid.UUID) (string, error) {
+	state, err := oidc.RandomString()
+	if err != nil {
+		return "", err
+	}
+	nonce, err := oidc.RandomString()
+	if err != nil {
+		return "", err
+	}
+	verifier, err := oidc.NewPKCEVerifier()
+	if err != nil {
+		return "", err
+	}
+
+	authURL, err := cfg.oidcProvider.AuthCodeURL(r.Context(), state, nonce, oidc.PKCEChallenge(verifier))
+	if err != nil {
+		return "", apierror.New(http.StatusBadGateway, apierror.CodeUpstream, "Couldn't reach identity provider", err)
+	}
+
+	err = cfg.db.CreateOIDCLoginState(r.Context(), database.OIDCLoginState{
+		State:        state,
+		Nonce:        nonce,
+		CodeVerifier: verifier,
+		LinkUserID:   linkUserID,
+		ExpiresAt:    time.Now().UTC().Add(oidcStateTTL),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	// Tie the state to this browser so a callback URL can't be replayed in
+	// someone else's session.
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidcStateCookie,
+		Value:    state,
+		Path:     "/api/oidc",
+		MaxAge:   int(oidcStateTTL.Seconds()),
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+	return authURL, nil
+}
+
+// handlerOIDCCallback finishes a single sign-on login. The browser lands
+// here, so rather than showing tokens in a tab it goes back to the app with
+// a one-time code in the URL fragment, which the app exchanges for a
+// session at handlerOIDCExchange. Fragments aren't sent to servers or in
+// Referer headers.
+func (cfg *apiConfig) handlerOIDCCallback(w http.ResponseWriter, r *http.Request) {
+	if cfg.oidcProvider == nil {
+		redirectWithOIDCError(w, r, http.StatusNotFound, "Single sign-on isn't configured", errOIDCNotConfigured)
+		return
+	}
+	query := r.URL.Query()
+	if errCode := query.Get("error"); errCode != "" {
+		redirectWithOIDCError(w, r, http.StatusUnauthorized, "Identity provider refused login: "+errCode, nil)
+		return
+	}
+
+	state := query.Get("state")
+	code := query.Get("code")
+	if state == "" || code == "" {
+		redirectWithOIDCError(w, r, http.StatusBadRequest, "Missing state or code", nil)
+		return
+	}
+
+	cookie, err := r.Cookie(oidcStateCookie)
+	if err != nil || cookie.Value != state {
+		redirectWithOIDCError(w, r, http.StatusUnauthorized, "Login state doesn't match this browser", err)
+		return
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:   oidcStateCookie,
+		Path:   "/api/oidc",
+		MaxAge: -1,
+	})
+
+	loginState, err := cfg.db.ConsumeOIDCLoginState(r.Context(), state)
+	if errors.Is(err, database.ErrNotFound) {
+		redirectWithOIDCError(w, r, http.StatusUnauthorized, "Login state expired, please try again", err)
+		return
+	}
+	if err != nil {
+		redirectWithOIDCError(w, r, http.StatusInternalServerError, "Couldn't load login state", err)
+		return
+	}
+
+	tokens, err := cfg.oidcProvider.Exchange(r.Context(), code, loginState.CodeVerifier)
+	if err != nil {
+		redirectWithOIDCError(w, r, http.StatusBadGateway, "Couldn't exchange authorization code", err)
+		return
+	}
+
+	claims, err := cfg.oidcProvider.VerifyIDToken(r.Context(), tokens.IDToken, loginState.Nonce)
+	if err != nil {
+		redirectWithOIDCError(w, r, http.StatusUnauthorized, "Invalid ID token", err)
+		return
+	}
+	if claims.Email == "" || !bool(claims.EmailVerified) {
+		redirectWithOIDCError(w, r, http.StatusForbidden, "Identity provider didn't supply a verified email", nil)
+		return
+	}
+
+	var user database.User
+	if loginState.LinkUserID != nil {
+		user, err = cfg.linkOIDCIdentity(r.Context(), *loginState.LinkUserID, claims)
+	} else {
+		user, err = cfg.userForOIDCIdentity(r.Context(), claims)
+	}
+	if err != nil {
+		redirectWithOIDCError(w, r, http.StatusInternalServerError, "Couldn't link account", err)
+		return
+	}
+
+	loginCode, err := auth.MakeRefreshToken()
+	if err != nil {
+		redirectWithOIDCError(w, r, http.StatusInternalServerError, "Couldn't create login code", err)
+		return
+	}
+	err = cfg.db.CreateOIDCLoginCode(r.Context(), auth.HashToken(loginCode), user.ID, time.Now().UTC().Add(oidcLoginCodeTTL))
+	if err != nil {
+		redirectWithOIDCError(w, r, http.StatusInternalServerError, "Couldn't save login code", err)
+		return
+	}
+	redirectToApp(w, r, url.Values{"oidc_code": {loginCode}})
+}
+
+// handlerOIDCExchange trades the one-time code from the callback for a
+// session. Users with two-factor authentication get an MFA challenge like
+// a password login: the identity provider vouches for the email, not for
+// Tubely's second factor.
+func (cfg *apiConfig) handlerOIDCExchange(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		Code string `json:"code"`
+	}
+	if cfg.oidcProvider == nil {
+		respondWithError(w, http.StatusNotFound, "Single sign-on isn't configured", errOIDCNotConfigured)
+		return
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	params := parameters{}
+	err := decoder.Decode(&params)
+	if err != nil {
+		respondWithErrorCode(w, http.StatusBadRequest, apierror.CodeInvalidJSON, "Couldn't decode parameters", err)
+		return
+	}
+
+	userID, err := cfg.db.ConsumeOIDCLoginCode(r.Context(), auth.HashToken(params.Code))
+	if errors.Is(err, database.ErrNotFound) {
+		respondWithError(w, http.StatusUnauthorized, "Login code is invalid or expired", err)
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't check login code", err)
+		return
+	}
+
+	user, err := cfg.db.GetUser(r.Context(), userID)
+	if errors.Is(err, database.ErrNotFound) {
+		respondWithError(w, http.StatusUnauthorized, "User not found", err)
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get user", err)
+		return
+	}
+
+	totp, err := cfg.db.GetUserTOTP(r.Context(), user.ID)
+	if err != nil && !errors.Is(err, database.ErrNotFound) {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get two-factor settings", err)
+		return
+	}
+	if err == nil && totp.Enabled() {
+		cfg.respondWithMFAChallenge(w, user.ID)
+		return
+	}
+	cfg.respondWithSession(w, r, *user)
+}
+
+// userForOIDCIdentity finds the user linked to an external identity, or
+// provisions a new one. An existing account with the same email isn't
+// linked automatically: whoever controls that email at the identity
+// provider would take the account over. Its owner links it while logged
+// in instead, see handlerOIDCLink.
+func (cfg *apiConfig) userForOIDCIdentity(ctx context.Context, claims oidc.IDTokenClaims) (database.User, error) {
+	issuer := cfg.oidcProvider.Issuer()
+
+	identity, err := cfg.db.GetUserIdentity(ctx, issuer, claims.Subject)
+	switch {
+	case err == nil:
+		user, err := cfg.db.GetUser(ctx, identity.UserID)
+		if err == nil {
+			return *user, nil
+		}
+		// A deleted user's identity is taken over by the new account below.
+		if !errors.Is(err, database.ErrNotFound) {
+			return database.User{}, err
+		}
+	case !errors.Is(err, database.ErrNotFound):
+		return database.User{}, err
+	}
+
+	email := normalizeEmail(claims.Email)
+	_, err = cfg.db.GetUserByEmail(ctx, email)
+	if err == nil {
+		return database.User{}, apierror.New(http.StatusConflict, apierror.CodeConflict,
+			"An account with this email already exists. Log in with your password and link single sign-on from there", nil)
+	}
+	if !errors.Is(err, database.ErrNotFound) {
+		return database.User{}, err
+	}
+
+	// SSO users don't get a usable password. They can still set one
+	// through the password reset flow.
+	randomPassword, err := auth.MakeRefreshToken()
+	if err != nil {
+		return database.User{}, err
+	}
+	hashedPassword, err := auth.HashPassword(randomPassword)
+	if err != nil {
+		return database.User{}, err
+	}
+	user, err := cfg.db.CreateOIDCUser(ctx, database.CreateUserParams{
+		Email:    email,
+		Password: hashedPassword,
+	}, database.UserIdentity{
+		Issuer:  issuer,
+		Subject: claims.Subject,
+		Email:   email,
+	})
+	if errors.Is(err, database.ErrIdentityLinked) {
+		// Another login for the same identity got there first.
+		return database.User{}, apierror.New(http.StatusConflict, apierror.CodeConflict,
+			"This identity is already linked to another account", err)
+	}
+	if err != nil {
+		return database.User{}, err
+	}
+	return *user, nil
+}
+
+// linkOIDCIdentity links an external identity to a user who asked for it
+// while logged in. The identity's email may differ from the account's.
+func (cfg *apiConfig) linkOIDCIdentity(ctx context.Context, userID uuid.UUID, claims oidc.IDTokenClaims) (database.User, error) {
+	issuer := cfg.oidcProvider.Issuer()
+	user, err := cfg.db.GetUser(ctx, userID)
+	if err != nil {
+		return database.User{}, err
+	}
+
+	identity, err := cfg.db.GetUserIdentity(ctx, issuer, claims.Subject)
+	if err == nil && identity.UserID == userID {
+		return *user, nil
+	}
+	if err != nil && !errors.Is(err, database.ErrNotFound) {
+		return database.User{}, err
+	}
+
+	// An identity left behind by a deleted user is taken over.
+	email := normalizeEmail(claims.Email)
+	err = cfg.db.CreateUserIdentity(ctx, database.UserIdentity{
+		Issuer:  issuer,
+		Subject: claims.Subject,
+		UserID:  user.ID,
+		Email:   email,
+	})
+	if errors.Is(err, database.ErrIdentityLinked) {
+		return database.User{}, apierror.New(http.StatusConflict, apierror.CodeConflict,
+			"This identity is already linked to another account", err)
+	}
+	if err != nil {
+		return database.User{}, err
+	}
+
+	if user.VerifiedAt == nil && strings.EqualFold(user.Email, email) {
+		err = cfg.db.MarkUserEmailVerified(ctx, user.ID)
+		if err != nil {
+			return database.User{}, err
+		}
+		user, err = cfg.db.GetUser(ctx, user.ID)
+		if err != nil {
+			return database.User{}, err
+		}
+	}
+	return *user, nil
+}
+
+// redirectWithOIDCError sends the browser back to the app with the error in
+// the URL fragment, since the single sign-on endpoints are navigations
+// rather than API calls. The error still goes on the access log.
+func redirectWithOIDCError(w http.ResponseWriter, r *http.Request, code int, msg string, err error) {
+	apiErr := apierror.From(code, msg, err)
+	if rec, ok := w.(errorRecorder); ok {
+		rec.recordError(apiErr)
+	} else {
+		slog.ErrorContext(r.Context(), "Single sign-on failed", "status", apiErr.Status, "error_code", apiErr.Code, "error_message", apiErr.Detail, "error", apiErr.Err)
+	}
+	redirectToApp(w, r, url.Values{"oidc_error": {apiErr.Detail}})
+}
+
+func redirectToApp(w http.ResponseWriter, r *http.Request, fragment url.Values) {
+	http.Redirect(w, r, "/app/#"+fragment.Encode(), http.StatusFound)
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/apierror"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/mailer"
+	"github.com/google/uuid"
+)
+
+const passwordResetTokenTTL = time.Hour
+
+func (cfg *apiConfig) handlerPasswordChange(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		OldPassword string `json:"old_password"`
+		NewPassword string `json:"new_password"`
+	}
+
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return
+	}
+	userID, err := auth.ValidateJWT(token, cfg.jwtSecret)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		return
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	params := parameters{}
+	err = decoder.Decode(&params)
+	if err != nil {
+		respondWithErrorCode(w, http.StatusBadRequest, apierror.CodeInvalidJSON, "Couldn't decode parameters", err)
+		return
+	}
+	if params.NewPassword == "" {
+		respondWithError(w, http.StatusBadRequest, "New password is required", nil)
+		return
+	}
+
+	user, err := cfg.db.GetUser(r.Context(), userID)
+	if errors.Is(err, database.ErrNotFound) {
+		respondWithError(w, http.StatusUnauthorized, "User not found", err)
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get user", err)
+		return
+	}
+
+	err = auth.CheckPasswordHash(params.OldPassword, user.Password)
+	if err != nil {
+		respondWithErrorCode(w, http.StatusUnauthorized, apierror.CodeInvalidCredentials, "Incorrect password", err)
+		return
+	}
+
+	err = cfg.setUserPassword(r.Context(), userID, params.NewPassword)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't update password", err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (cfg *apiConfig) handlerPasswordResetRequest(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		Email string `json:"email"`
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	params := parameters{}
+	err := decoder.Decode(&params)
+	if err != nil {
+		respondWithErrorCode(w, http.StatusBadRequest, apierror.CodeInvalidJSON, "Couldn't decode parameters", err)
+		return
+	}
+	if params.Email == "" {
+		respondWithError(w, http.StatusBadRequest, "Email is required", nil)
+		return
+	}
+
+	// Always answer the same way so the endpoint can't be used to find out
+	// which emails have accounts.
+	user, err := cfg.db.GetUserByEmail(r.Context(), params.Email)
+	if errors.Is(err, database.ErrNotFound) {
+		w.WriteHeader(http.StatusAccepted)
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get user", err)
+		return
+	}
+
+	resetToken, err := auth.MakeRefreshToken()
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't create reset token", err)
+		return
+	}
+
+	err = cfg.db.CreatePasswordResetToken(r.Context(), database.CreatePasswordResetTokenParams{
+		TokenHash: auth.HashToken(resetToken),
+		UserID:    user.ID,
+		ExpiresAt: time.Now().UTC().Add(passwordResetTokenTTL),
+	})
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't save reset token", err)
+		return
+	}
+
+	err = cfg.mailer.Send(r.Context(), mailer.Message{
+		To:      user.Email,
+		Subject: "Reset your Tubely password",
+		Body: fmt.Sprintf(
+			"Someone asked to reset the password for your Tubely account.\n\n"+
+				"Use this token to choose a new password within %v:\n\n%s\n\n"+
+				"If this wasn't you, you can ignore this email.\n",
+			passwordResetTokenTTL, resetToken,
+		),
+	})
+	// Failing here would tell the caller the address has an account, which
+	// the 202 for unknown ones is meant to hide.
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Couldn't send password reset email", "email", user.Email, "error", err)
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func (cfg *apiConfig) handlerPasswordReset(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		Token       string `json:"token"`
+		NewPassword string `json:"new_password"`
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	params := parameters{}
+	err := decoder.Decode(&params)
+	if err != nil {
+		respondWithErrorCode(w, http.StatusBadRequest, apierror.CodeInvalidJSON, "Couldn't decode parameters", err)
+		return
+	}
+	if params.Token == "" || params.NewPassword == "" {
+		respondWithError(w, http.StatusBadRequest, "Token and new password are required", nil)
+		return
+	}
+
+	userID, err := cfg.db.ConsumePasswordResetToken(r.Context(), auth.HashToken(params.Token))
+	if errors.Is(err, database.ErrNotFound) {
+		respondWithError(w, http.StatusUnauthorized, "Invalid or expired reset token", err)
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't check reset token", err)
+		return
+	}
+
+	err = cfg.setUserPassword(r.Context(), userID, params.NewPassword)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't update password", err)
+		return
+	}
+
+	err = cfg.db.DeletePasswordResetTokensForUser(r.Context(), userID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't clear reset tokens", err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// setUserPassword stores a new password and logs the user out everywhere.
+func (cfg *apiConfig) setUserPassword(ctx context.Context, userID uuid.UUID, password string) error {
+	hashedPassword, err := auth.HashPassword(password)
+	if err != nil {
+		return err
+	}
+	err = cfg.db.UpdateUserPassword(ctx, userID, hashedPassword)
+	if err != nil {
+		return err
+	}
+	return cfg.db.RevokeRefreshTokensForUser(ctx, userID)
+}
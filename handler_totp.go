@@ -0,0 +1,313 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/apierror"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+const (
+	totpIssuer        = "Tubely"
+	mfaTokenTTL       = 5 * time.Minute
+	recoveryCodeCount = 10
+)
+
+func (cfg *apiConfig) handlerTOTPEnroll(w http.ResponseWriter, r *http.Request) {
+	type response struct {
+		Secret     string `json:"secret"`
+		OTPAuthURI string `json:"otpauth_uri"`
+	}
+
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return
+	}
+	userID, err := auth.ValidateJWT(token, cfg.jwtSecret)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		return
+	}
+
+	user, err := cfg.db.GetUser(r.Context(), userID)
+	if errors.Is(err, database.ErrNotFound) {
+		respondWithError(w, http.StatusUnauthorized, "User not found", err)
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get user", err)
+		return
+	}
+
+	existing, err := cfg.db.GetUserTOTP(r.Context(), userID)
+	if err != nil && !errors.Is(err, database.ErrNotFound) {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get two-factor settings", err)
+		return
+	}
+	if err == nil && existing.Enabled() {
+		respondWithError(w, http.StatusConflict, "Two-factor authentication is already enabled", nil)
+		return
+	}
+
+	secret, err := auth.GenerateTOTPSecret()
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't generate TOTP secret", err)
+		return
+	}
+
+	sealed, err := auth.SealTOTPSecret(secret, cfg.totpKey, userID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't encrypt TOTP secret", err)
+		return
+	}
+	err = cfg.db.SaveUserTOTP(r.Context(), userID, sealed)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't save TOTP secret", err)
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, response{
+		Secret:     secret,
+		OTPAuthURI: auth.TOTPURI(totpIssuer, user.Email, secret),
+	})
+}
+
+func (cfg *apiConfig) handlerTOTPConfirm(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		Code string `json:"code"`
+	}
+	type response struct {
+		RecoveryCodes []string `json:"recovery_codes"`
+	}
+
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return
+	}
+	userID, err := auth.ValidateJWT(token, cfg.jwtSecret)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		return
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	params := parameters{}
+	err = decoder.Decode(&params)
+	if err != nil {
+		respondWithErrorCode(w, http.StatusBadRequest, apierror.CodeInvalidJSON, "Couldn't decode parameters", err)
+		return
+	}
+
+	totp, err := cfg.db.GetUserTOTP(r.Context(), userID)
+	if errors.Is(err, database.ErrNotFound) {
+		respondWithError(w, http.StatusNotFound, "Start two-factor enrollment first", err)
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get two-factor settings", err)
+		return
+	}
+	if totp.Enabled() {
+		respondWithError(w, http.StatusConflict, "Two-factor authentication is already enabled", nil)
+		return
+	}
+
+	ok, err := cfg.checkTOTPCode(r.Context(), *totp, params.Code)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't check code", err)
+		return
+	}
+	if !ok {
+		respondWithError(w, http.StatusUnauthorized, "Invalid code", nil)
+		return
+	}
+
+	recoveryCodes, err := auth.GenerateRecoveryCodes(recoveryCodeCount)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't generate recovery codes", err)
+		return
+	}
+	hashes := make([]string, 0, len(recoveryCodes))
+	for _, code := range recoveryCodes {
+		hashes = append(hashes, auth.HashToken(auth.NormalizeRecoveryCode(code)))
+	}
+
+	err = cfg.db.ConfirmUserTOTP(r.Context(), userID, hashes)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't enable two-factor authentication", err)
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, response{
+		RecoveryCodes: recoveryCodes,
+	})
+}
+
+func (cfg *apiConfig) handlerTOTPDisable(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		Password string `json:"password"`
+	}
+
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return
+	}
+	userID, err := auth.ValidateJWT(token, cfg.jwtSecret)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		return
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	params := parameters{}
+	err = decoder.Decode(&params)
+	if err != nil {
+		respondWithErrorCode(w, http.StatusBadRequest, apierror.CodeInvalidJSON, "Couldn't decode parameters", err)
+		return
+	}
+
+	user, err := cfg.db.GetUser(r.Context(), userID)
+	if errors.Is(err, database.ErrNotFound) {
+		respondWithError(w, http.StatusUnauthorized, "User not found", err)
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get user", err)
+		return
+	}
+
+	err = auth.CheckPasswordHash(params.Password, user.Password)
+	if err != nil {
+		respondWithErrorCode(w, http.StatusUnauthorized, apierror.CodeInvalidCredentials, "Incorrect password", err)
+		return
+	}
+
+	err = cfg.db.DeleteUserTOTP(r.Context(), userID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't disable two-factor authentication", err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handlerLoginMFA finishes a login started by handlerLogin for users with
+// two-factor authentication, using either a TOTP code or a recovery code.
+func (cfg *apiConfig) handlerLoginMFA(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		MFAToken     string `json:"mfa_token"`
+		Code         string `json:"code"`
+		RecoveryCode string `json:"recovery_code"`
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	params := parameters{}
+	err := decoder.Decode(&params)
+	if err != nil {
+		respondWithErrorCode(w, http.StatusBadRequest, apierror.CodeInvalidJSON, "Couldn't decode parameters", err)
+		return
+	}
+	if params.Code == "" && params.RecoveryCode == "" {
+		respondWithError(w, http.StatusBadRequest, "A code or recovery code is required", nil)
+		return
+	}
+
+	userID, err := auth.ValidateMFAToken(params.MFAToken, cfg.jwtSecret)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Invalid or expired MFA token", err)
+		return
+	}
+
+	user, err := cfg.db.GetUser(r.Context(), userID)
+	if errors.Is(err, database.ErrNotFound) {
+		respondWithError(w, http.StatusUnauthorized, "User not found", err)
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get user", err)
+		return
+	}
+
+	ip := clientIP(r)
+	throttle, err := cfg.checkLoginThrottle(r.Context(), user.Email, ip)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't check login attempts", err)
+		return
+	}
+	if throttle.wait > 0 {
+		setRetryAfter(w, throttle.wait)
+		respondWithError(w, http.StatusTooManyRequests, throttle.reason, nil)
+		return
+	}
+
+	totp, err := cfg.db.GetUserTOTP(r.Context(), userID)
+	if err != nil && !errors.Is(err, database.ErrNotFound) {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get two-factor settings", err)
+		return
+	}
+	if err != nil || !totp.Enabled() {
+		respondWithError(w, http.StatusUnauthorized, "Two-factor authentication is not enabled", nil)
+		return
+	}
+
+	var ok bool
+	if params.Code != "" {
+		ok, err = cfg.checkTOTPCode(r.Context(), *totp, params.Code)
+	} else {
+		ok, err = cfg.useRecoveryCode(r.Context(), userID, params.RecoveryCode)
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't check code", err)
+		return
+	}
+
+	attempt := database.CreateLoginAttemptParams{
+		Email:     normalizeEmail(user.Email),
+		IPAddress: ip,
+		UserAgent: r.UserAgent(),
+		Succeeded: ok,
+	}
+	if !ok {
+		if recordErr := cfg.recordLoginAttempt(r.Context(), attempt); recordErr != nil {
+			slog.ErrorContext(r.Context(), "Couldn't record login attempt", "error", recordErr)
+		}
+		respondWithError(w, http.StatusUnauthorized, "Invalid code", nil)
+		return
+	}
+
+	err = cfg.recordLoginAttempt(r.Context(), attempt)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't record login attempt", err)
+		return
+	}
+
+	cfg.respondWithSession(w, r, *user)
+}
+
+func (cfg *apiConfig) checkTOTPCode(ctx context.Context, totp database.UserTOTP, code string) (bool, error) {
+	secret, err := auth.OpenTOTPSecret(totp.Secret, cfg.totpKey, totp.UserID)
+	if err != nil {
+		return false, err
+	}
+	step, ok := auth.ValidateTOTP(secret, code, time.Now())
+	if !ok {
+		return false, nil
+	}
+	return cfg.db.UseTOTPStep(ctx, totp.UserID, step)
+}
+
+// useRecoveryCode spends one of the user's recovery codes. They're hashed
+// normalized, so the hyphen and case don't matter.
+func (cfg *apiConfig) useRecoveryCode(ctx context.Context, userID uuid.UUID, code string) (bool, error) {
+	return cfg.db.UseRecoveryCode(ctx, userID, auth.HashToken(auth.NormalizeRecoveryCode(code)))
+}
@@ -1,18 +1,23 @@
 package main
 
 import (
-	"crypto/rand"
-	"encoding/base64"
+	"errors"
 	"fmt"
-	"io"
-	"mime"
+	"log/slog"
 	"net/http"
-	"os"
 
 	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/imaging"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/media"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/metrics"
 	"github.com/google/uuid"
 )
 
+// maxThumbnailUploadBytes caps the request body of thumbnail uploads, see
+// routeLimitsMiddleware.
+const maxThumbnailUploadBytes = 20 << 20
+
 func (cfg *apiConfig) handlerUploadThumbnail(w http.ResponseWriter, r *http.Request) {
 	videoIDString := r.PathValue("videoID")
 	videoID, err := uuid.Parse(videoIDString)
@@ -33,7 +38,7 @@ func (cfg *apiConfig) handlerUploadThumbnail(w http.ResponseWriter, r *http.Requ
 		return
 	}
 
-	fmt.Println("uploading thumbnail for video", videoID, "by user", userID)
+	slog.InfoContext(r.Context(), "Uploading thumbnail", "video_id", videoID)
 
 	const maxMemory = 10 << 20 // bit shift 10 to the left 20 times. Same as 10 * 1024 * 1024 -> 10 MB
 
@@ -45,74 +50,68 @@ func (cfg *apiConfig) handlerUploadThumbnail(w http.ResponseWriter, r *http.Requ
 		return
 	}
 	defer file.Close()
+	metrics.UploadBytes.WithLabelValues("thumbnail").Add(float64(header.Size))
 
-	mediaType, _, _ := mime.ParseMediaType(header.Header.Get("Content-Type"))
-
-	if mediaType != "image/jpeg" && mediaType != "image/png" {
-		respondWithError(w, http.StatusInternalServerError, "Incorrect media type. Should be jpeg or png", err)
+	// Look at the bytes, not the Content-Type the client picked.
+	head, err := media.Head(file)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't read uploaded file", err)
+		return
+	}
+	if media.SniffImage(head) == "" {
+		respondWithError(w, http.StatusUnsupportedMediaType, fmt.Sprintf("Upload labelled %q isn't a JPEG, PNG or WebP image", header.Header.Get("Content-Type")), nil)
 		return
 	}
 
-	// imageBytes, err := io.ReadAll(file)
-	// if err != nil {
-	// 	respondWithError(w, http.StatusInternalServerError, "Could't parse file to bytes", err)
-	// 	return
-	// }
-
-	video, err := cfg.db.GetVideo(videoID)
+	video, err := cfg.db.GetVideo(r.Context(), videoID)
+	if errors.Is(err, database.ErrNotFound) {
+		respondWithError(w, http.StatusNotFound, "Video not found", err)
+		return
+	}
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Error getting video from db", err)
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get video", err)
 		return
 	}
 	if video.UserID != userID {
-		respondWithError(w, http.StatusUnauthorized, "Logged user does not own video", err)
+		respondWithError(w, http.StatusForbidden, "Logged user does not own video", nil)
 		return
 	}
 
-	// videoThumbnails[videoID] = thumbnail{
-	// 	data: imageBytes,
-	// 	mediaType: mediaType,
-	// }
-
-	// thumbnailURL := fmt.Sprintf("http://localhost:%s/api/thumbnails/%s", cfg.port, videoIDString)
-	// video.ThumbnailURL = &thumbnailURL
-
-	// Encode image to base64 string to store in db - temporary
-	// endodedImageData := base64.StdEncoding.EncodeToString(imageBytes)
-	// dataURL := fmt.Sprintf("data:%s;base64,%s", mediaType, endodedImageData)
-	// video.ThumbnailURL = &dataURL
-
-	// Store file on filesystem
-	// Generate random name for file
-	random_key := make([]byte, 32)
-	rand.Read(random_key)
-	fileName := base64.RawURLEncoding.EncodeToString(random_key)
-
-	fileWebPath := createAssetPath(fileName, mediaType, cfg.assetsRoot)
-	fileDiskPath := cfg.getAssetDiskPath(fileWebPath)
-	newThumbnailFile, createErr := os.Create(fileDiskPath)
-
-	if createErr != nil {
-		respondWithError(w, http.StatusInternalServerError, "error creating thumbnail file", createErr)
+	// Decoding checks the upload really is an image, whatever its
+	// Content-Type says.
+	img, err := imaging.Decode(file)
+	if errors.Is(err, imaging.ErrUnsupportedFormat) {
+		respondWithError(w, http.StatusUnsupportedMediaType, "Thumbnail must be a JPEG, PNG or WebP image", err)
 		return
 	}
-
-	_, copyErr := io.Copy(newThumbnailFile, file)
-	if copyErr != nil {
-		respondWithError(w, http.StatusInternalServerError, "error coping thumbnail file", copyErr)
+	if errors.Is(err, imaging.ErrTooLarge) {
+		respondWithError(w, http.StatusBadRequest, "Thumbnail dimensions are too large", err)
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode thumbnail", err)
 		return
 	}
 
-	defer newThumbnailFile.Close()
-
-	thumbnailURL := cfg.getAssetURL(fileWebPath)
-	video.ThumbnailURL = &thumbnailURL
+	variants, err := cfg.saveThumbnailVariants(r.Context(), img)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "error saving thumbnail files", err)
+		return
+	}
+	video.ThumbnailVariants = variants
+	video.ThumbnailURL = cfg.largestThumbnailURL(variants, imaging.FormatJPEG)
 
-	updateErr := cfg.db.UpdateVideo(video)
+	updateErr := cfg.db.UpdateVideo(r.Context(), video)
 	if updateErr != nil {
 		respondWithError(w, http.StatusInternalServerError, "Error updating video", updateErr)
 		return
 	}
 
-	respondWithJSON(w, http.StatusOK, video)
+	signedVideo, err := cfg.dbVideoToSignedVideo(r, video)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't generate presigned URL", err)
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, signedVideo)
 }
@@ -9,82 +9,224 @@ import (
 	"errors"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"math"
-	"mime"
 	"net/http"
 	"os"
 	"os/exec"
-	"strings"
+	"path/filepath"
 	"time"
 
-	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/apierror"
 	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
 	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/media"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/metrics"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/storage"
 	"github.com/google/uuid"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
-func getVideoAspectRatio(filePath string) (string, error) {
+// uploadTempPrefix starts the names of temp files holding uploads while
+// they're processed, see cleanupStaleUploads.
+const uploadTempPrefix = "tubely-upload"
 
-	cmd := exec.Command("ffprobe", "-v", "error", "-print_format", "json", "-show_streams", filePath)
+// staleUploadAge is how long an upload temp file has to be left untouched
+// before cleanupStaleUploads takes it for a leftover.
+const staleUploadAge = time.Hour
+
+// cleanupStaleUploads removes upload temp files (and their .processing
+// outputs) that a killed server left behind. Files modified recently are
+// kept, they may belong to another server sharing the temp directory.
+func cleanupStaleUploads() {
+	paths, err := filepath.Glob(filepath.Join(os.TempDir(), uploadTempPrefix+"*"))
+	if err != nil {
+		slog.Error("Couldn't list upload temp files", "error", err)
+		return
+	}
+	removed := 0
+	for _, path := range paths {
+		info, err := os.Lstat(path)
+		if err != nil || !info.Mode().IsRegular() || time.Since(info.ModTime()) < staleUploadAge {
+			continue
+		}
+		err = os.Remove(path)
+		if err != nil {
+			slog.Warn("Couldn't remove stale upload temp file", "path", path, "error", err)
+			continue
+		}
+		removed++
+	}
+	if removed > 0 {
+		slog.Info("Removed stale upload temp files", "count", removed)
+	}
+}
+
+// errNoVideoStream means ffprobe could read the file but found no video in
+// it, e.g. an audio-only file.
+var errNoVideoStream = errors.New("file has no video stream")
+
+var errBadProbeOutput = errors.New("couldn't parse ffprobe output")
+
+// videoProbe is what ffprobe tells us about an upload's first video and
+// audio streams.
+type videoProbe struct {
+	VideoCodec string
+	AudioCodec string
+	Width      int
+	Height     int
+}
+
+func probeVideo(ctx context.Context, filePath string) (probe videoProbe, err error) {
+	ctx, span := tracer.Start(ctx, "ffprobe")
+	defer func() { endSpan(span, err) }()
+
+	cmd := exec.CommandContext(ctx, "ffprobe", "-v", "error", "-print_format", "json", "-show_streams", filePath)
 	var commandBuffer bytes.Buffer
 	cmd.Stdout = &commandBuffer
-	err := cmd.Run()
+	start := time.Now()
+	err = cmd.Run()
+	metrics.ObserveMediaTool("ffprobe", "probe", start, err)
 	if err != nil {
-		log.Print("error while running ffprobe")
-		return "", err
+		slog.WarnContext(ctx, "ffprobe failed", "path", filePath, "error", err)
+		return videoProbe{}, err
 	}
 
 	type VideoData struct {
 		Streams []struct {
-			Width  int `json:"width,omitempty"`
-			Height int `json:"height,omitempty"`
+			CodecType string `json:"codec_type"`
+			CodecName string `json:"codec_name"`
+			Width     int    `json:"width,omitempty"`
+			Height    int    `json:"height,omitempty"`
 		}
 	}
 
-	// fmt.Printf("%s\n", commandBuffer.Bytes())
-
 	videoData := VideoData{}
-	json.Unmarshal(commandBuffer.Bytes(), &videoData)
-
-	fmt.Printf("Video data %v \n", videoData)
+	err = json.Unmarshal(commandBuffer.Bytes(), &videoData)
+	if err != nil {
+		return videoProbe{}, fmt.Errorf("%w: %v", errBadProbeOutput, err)
+	}
 
-	if len(videoData.Streams) == 0 {
-		return "", errors.New("missing video data")
+	// Streams come in container order, which needn't put video first.
+	for _, stream := range videoData.Streams {
+		switch {
+		case stream.CodecType == "video" && probe.VideoCodec == "":
+			probe.VideoCodec = stream.CodecName
+			probe.Width = stream.Width
+			probe.Height = stream.Height
+		case stream.CodecType == "audio" && probe.AudioCodec == "":
+			probe.AudioCodec = stream.CodecName
+		}
 	}
+	if probe.VideoCodec == "" || probe.Width <= 0 || probe.Height <= 0 {
+		return videoProbe{}, errNoVideoStream
+	}
+	span.SetAttributes(
+		attribute.String("video.codec", probe.VideoCodec),
+		attribute.String("audio.codec", probe.AudioCodec),
+		attribute.Int("video.width", probe.Width),
+		attribute.Int("video.height", probe.Height),
+	)
+	return probe, nil
+}
 
-	aspectRatio := float64(videoData.Streams[0].Width) / float64(videoData.Streams[0].Height)
+func (p videoProbe) aspectRatio() string {
+	aspectRatio := float64(p.Width) / float64(p.Height)
 
-	fmt.Printf("aspect ration %f \n", aspectRatio)
 	if math.Abs(aspectRatio-1.78) < 0.05 {
-		return "16:9", nil
+		return "16:9"
 	} else if math.Abs(aspectRatio-0.5625) < 0.05 {
-		return "9:16", nil
+		return "9:16"
 	}
-	return "other", nil
+	return "other"
+}
+
+// mp4Compatible reports whether the streams can be copied into an MP4 that
+// browsers play, without re-encoding.
+func (p videoProbe) mp4Compatible() bool {
+	switch p.VideoCodec {
+	case "h264", "hevc":
+	default:
+		return false
+	}
+	switch p.AudioCodec {
+	case "", "aac", "mp3":
+		return true
+	}
+	return false
+}
 
+// rejectedByTool tells a file ffprobe or ffmpeg refused (a non-zero exit or
+// unparseable output) apart from failing to run the tool at all.
+func rejectedByTool(err error) bool {
+	var exitErr *exec.ExitError
+	return errors.As(err, &exitErr) || errors.Is(err, errNoVideoStream) || errors.Is(err, errBadProbeOutput)
 }
 
-func processVideoForFastStart(filePath string) (string, error) {
+// checkVideoDecodes decodes the first frame, catching files whose headers
+// look fine but whose video data is garbage.
+func checkVideoDecodes(ctx context.Context, filePath string) (err error) {
+	ctx, span := tracer.Start(ctx, "ffmpeg decode check")
+	defer func() { endSpan(span, err) }()
+
+	cmd := exec.CommandContext(ctx, "ffmpeg", "-v", "error", "-i", filePath, "-map", "0:v:0", "-frames:v", "1", "-f", "null", "-")
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	start := time.Now()
+	err = cmd.Run()
+	metrics.ObserveMediaTool("ffmpeg", "decode_check", start, err)
+	if err != nil {
+		return fmt.Errorf("%w: %s", err, bytes.TrimSpace(stderr.Bytes()))
+	}
+	return nil
+}
+
+// processVideoForFastStart converts the upload to an MP4 with the moov atom
+// first, so playback can start before the whole file has downloaded. MP4 and
+// MOV files with browser friendly codecs are remuxed, anything else (WebM,
+// MKV, VP9, Opus...) is transcoded to H.264 and AAC.
+func processVideoForFastStart(ctx context.Context, filePath string, probe videoProbe) (_ string, err error) {
+	ctx, span := tracer.Start(ctx, "ffmpeg faststart", trace.WithAttributes(attribute.Bool("transcode", !probe.mp4Compatible())))
+	defer func() { endSpan(span, err) }()
+
 	processedVideoPath := fmt.Sprintf("%s.processing", filePath)
 
-	cmd := exec.Command("ffmpeg", "-i", filePath, "-c", "copy", "-movflags", "faststart", "-f", "mp4", processedVideoPath)
+	args := []string{"-i", filePath, "-map", "0:v:0", "-map", "0:a:0?"}
+	if probe.mp4Compatible() {
+		args = append(args, "-c", "copy")
+		if probe.VideoCodec == "hevc" {
+			// Safari only plays HEVC tagged as hvc1.
+			args = append(args, "-tag:v", "hvc1")
+		}
+	} else {
+		args = append(args, "-c:v", "libx264", "-preset", "veryfast", "-crf", "23", "-pix_fmt", "yuv420p", "-c:a", "aac")
+	}
+	args = append(args, "-movflags", "faststart", "-f", "mp4", processedVideoPath)
+
+	cmd := exec.CommandContext(ctx, "ffmpeg", args...)
 
-	err := cmd.Run()
+	step := "remux"
+	if !probe.mp4Compatible() {
+		step = "transcode"
+	}
+	start := time.Now()
+	err = cmd.Run()
+	metrics.ObserveMediaTool("ffmpeg", step, start, err)
 	if err != nil {
-		log.Print("error while running ffmpeg for faststart")
+		slog.ErrorContext(ctx, "ffmpeg failed to process video", "path", filePath, "transcode", !probe.mp4Compatible(), "error", err)
+		os.Remove(processedVideoPath)
 		return "", err
 	}
 
 	return processedVideoPath, nil
 }
 
-func (cfg *apiConfig) handlerUploadVideo(w http.ResponseWriter, r *http.Request) {
-
-	const uploadLimit = 1 << 30 // bit shift 1 to the left 30 times.1 * 1024* 1024*1024 -> 1 GB
-
-	http.MaxBytesReader(w, r.Body, uploadLimit)
+// maxVideoUploadBytes caps the request body of video uploads, see
+// routeLimitsMiddleware.
+const maxVideoUploadBytes = 1 << 30 // bit shift 1 to the left 30 times.1 * 1024* 1024*1024 -> 1 GB
 
+func (cfg *apiConfig) handlerUploadVideo(w http.ResponseWriter, r *http.Request) {
 	videoIDString := r.PathValue("videoID")
 	videoID, err := uuid.Parse(videoIDString)
 	if err != nil {
@@ -104,19 +246,36 @@ func (cfg *apiConfig) handlerUploadVideo(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	fmt.Println("uploading video", videoID, "by user", userID)
+	if cfg.requireVerifiedEmail {
+		user, err := cfg.db.GetUser(r.Context(), userID)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Couldn't get user", err)
+			return
+		}
+		if user.VerifiedAt == nil {
+			respondWithErrorCode(w, http.StatusForbidden, apierror.CodeEmailNotVerified, "Verify your email address before uploading videos", nil)
+			return
+		}
+	}
 
-	video, err := cfg.db.GetVideo(videoID)
-	if err != nil {
+	slog.InfoContext(r.Context(), "Uploading video", "video_id", videoID)
+
+	video, err := cfg.db.GetVideo(r.Context(), videoID)
+	if errors.Is(err, database.ErrNotFound) {
 		respondWithError(w, http.StatusNotFound, "Video not found", err)
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get video", err)
+		return
 	}
-
 	if video.UserID != userID {
-		respondWithError(w, http.StatusUnauthorized, "Video not owned by user", err)
-
+		respondWithError(w, http.StatusForbidden, "Video not owned by user", nil)
+		return
 	}
 
-	r.ParseMultipartForm(uploadLimit) // divide media file into parts
+	// Parts over 32 MB are spooled to disk rather than held in memory.
+	r.ParseMultipartForm(32 << 20) // divide media file into parts
 
 	videoFile, header, err := r.FormFile("video") // get data from form by field id
 	if err != nil {
@@ -126,14 +285,45 @@ func (cfg *apiConfig) handlerUploadVideo(w http.ResponseWriter, r *http.Request)
 
 	defer videoFile.Close()
 
-	mediaType, _, _ := mime.ParseMediaType(header.Header.Get("Content-Type"))
+	metrics.ProcessingQueueDepth.Inc()
+	defer metrics.ProcessingQueueDepth.Dec()
 
-	if mediaType != "video/mp4" {
-		respondWithError(w, http.StatusInternalServerError, "Incorrect media type. Should be video/mp4", err)
+	// Refuse uploads that can't fit before spending time on ffmpeg. The
+	// final size is only known after processing, SetVideoObject checks again.
+	quota, err := cfg.db.GetQuota(r.Context(), userID, cfg.defaultQuota)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get quota", err)
+		return
+	}
+	if quota.MaxBytes > 0 {
+		usage, err := cfg.db.GetUsage(r.Context(), userID)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Couldn't get usage", err)
+			return
+		}
+		used := usage.Bytes
+		if video.VideoObject != nil {
+			used -= video.VideoObject.Size
+		}
+		if used+header.Size > quota.MaxBytes {
+			respondWithError(w, http.StatusRequestEntityTooLarge, "Storage quota exceeded", &database.QuotaError{Resource: "bytes", Limit: quota.MaxBytes, Used: used, Requested: header.Size})
+			return
+		}
+	}
+
+	// Look at the bytes, not the Content-Type the client picked.
+	head, err := media.Head(videoFile)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't read uploaded file", err)
+		return
+	}
+	container := media.SniffVideo(head)
+	if container == "" {
+		respondWithError(w, http.StatusUnsupportedMediaType, fmt.Sprintf("Upload labelled %q isn't an MP4, MOV, WebM or MKV video", header.Header.Get("Content-Type")), nil)
 		return
 	}
 
-	tempFile, err := os.CreateTemp("", "tubely-upload.mp4")
+	tempFile, err := os.CreateTemp("", uploadTempPrefix+"-*.mp4")
 	if err != nil {
 		respondWithError(w, http.StatusInternalServerError, "Error creating temp file for upload", err)
 		return
@@ -142,24 +332,56 @@ func (cfg *apiConfig) handlerUploadVideo(w http.ResponseWriter, r *http.Request)
 	defer os.Remove(tempFile.Name())
 	defer tempFile.Close()
 
-	io.Copy(tempFile, videoFile)
+	_, receiveSpan := tracer.Start(r.Context(), "receive upload")
+	written, err := io.Copy(tempFile, videoFile)
+	receiveSpan.SetAttributes(attribute.Int64("upload.bytes", written))
+	endSpan(receiveSpan, err)
+	metrics.UploadBytes.WithLabelValues("video").Add(float64(written))
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Error saving upload", err)
+		return
+	}
 
 	tempFile.Seek(0, io.SeekStart)
 
-	ratio, err := getVideoAspectRatio(tempFile.Name())
+	probe, err := probeVideo(r.Context(), tempFile.Name())
+	if errors.Is(err, errNoVideoStream) {
+		respondWithError(w, http.StatusUnsupportedMediaType, fmt.Sprintf("The %s file has no video stream", container), err)
+		return
+	}
+	if err != nil && !rejectedByTool(err) {
+		respondWithError(w, http.StatusInternalServerError, "Error running ffprobe", err)
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusUnsupportedMediaType, fmt.Sprintf("Couldn't read the %s file, it may be damaged", container), err)
+		return
+	}
+	err = checkVideoDecodes(r.Context(), tempFile.Name())
+	if err != nil && !rejectedByTool(err) {
+		respondWithError(w, http.StatusInternalServerError, "Error running ffmpeg", err)
+		return
+	}
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Error calculating aspect ratio for video", err)
+		respondWithError(w, http.StatusUnsupportedMediaType, fmt.Sprintf("The %s video stream can't be decoded", probe.VideoCodec), err)
 		return
 	}
+	ratio := probe.aspectRatio()
 
 	// Process video for fast start
-	fileName, err := processVideoForFastStart(tempFile.Name())
-	processedVideoFile, nil := os.Open(fileName)
-
+	fileName, err := processVideoForFastStart(r.Context(), tempFile.Name(), probe)
 	if err != nil {
 		respondWithError(w, http.StatusInternalServerError, "Error encoding video for faststart", err)
 		return
 	}
+	defer os.Remove(fileName)
+
+	processedVideoFile, err := os.Open(fileName)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Error opening processed video", err)
+		return
+	}
+	defer processedVideoFile.Close()
 
 	// Generate random name for file
 	random_key := make([]byte, 32)
@@ -175,76 +397,64 @@ func (cfg *apiConfig) handlerUploadVideo(w http.ResponseWriter, r *http.Request)
 		fileName = fmt.Sprintf("other/%s.%s", fileName, "mp4")
 	}
 
-	_, putError := cfg.s3Client.PutObject(r.Context(), &s3.PutObjectInput{
-		Bucket:      &cfg.s3Bucket,
-		Key:         &fileName,
-		Body:        processedVideoFile, // The io.Reader (your *os.File)
-		ContentType: &mediaType,
+	storeCtx, storeSpan := tracer.Start(r.Context(), "store video", trace.WithAttributes(
+		attribute.String("storage.backend", cfg.mediaStorage.Name()),
+		attribute.String("storage.key", fileName),
+	))
+	object, err := cfg.mediaStorage.Put(storeCtx, fileName, processedVideoFile, storage.PutOptions{
+		ContentType: "video/mp4",
 	})
-
-	if putError != nil {
-		fmt.Printf("%v\n", putError)
-		respondWithError(w, http.StatusInternalServerError, "Error putting object to s3", err)
+	endSpan(storeSpan, err)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Error uploading video to storage", err)
 		return
 	}
 
-	// s3VideoUrl := fmt.Sprintf("https://%s.s3.%s.amazonaws.com/%s", cfg.s3Bucket, cfg.s3Region, fileName)
-	s3VideoUrl := fmt.Sprintf("%s,%s", cfg.s3Bucket, fileName)
-	video.VideoURL = &s3VideoUrl
-
-	cfg.db.UpdateVideo(video)
-
-	// After updating the video in the database, convert to signed URL format
-	signedVideo, err := cfg.dbVideoToSignedVideo(video)
+	_, previous, err := cfg.db.SetVideoObject(r.Context(), videoID, database.CreateStorageObjectParams{
+		Backend:     cfg.mediaStorage.Name(),
+		Bucket:      cfg.mediaStorage.Bucket(),
+		Key:         object.Key,
+		Size:        object.Size,
+		Checksum:    object.Checksum,
+		ContentType: object.ContentType,
+	}, quota)
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, fmt.Sprintf("Couldn't generate presigned URL: %v", err), err)
+		// The file isn't referenced by anything now.
+		cfg.deleteStoredObject(r.Context(), database.StorageObject{
+			CreateStorageObjectParams: database.CreateStorageObjectParams{
+				Backend: cfg.mediaStorage.Name(),
+				Bucket:  cfg.mediaStorage.Bucket(),
+				Key:     object.Key,
+			},
+		})
+		if errors.Is(err, database.ErrNotFound) {
+			respondWithError(w, http.StatusNotFound, "Video not found", err)
+			return
+		}
+		respondWithError(w, http.StatusInternalServerError, "Couldn't save video location", err)
 		return
 	}
-
-	respondWithJSON(w, http.StatusOK, signedVideo)
-
-}
-
-func (cfg *apiConfig) dbVideoToSignedVideo(video database.Video) (database.Video, error) {
-
-	if video.VideoURL == nil {
-		return video, nil
+	if previous != nil {
+		cfg.deleteStoredObject(r.Context(), *previous)
 	}
-	videoUrlParts := strings.Split(*video.VideoURL, ",")
-
-	bucket := videoUrlParts[0]
-	key := videoUrlParts[1]
 
-	presignedURL, err := generatePresignedURL(cfg.s3Client, bucket, key, time.Hour)
+	video, err = cfg.db.GetVideo(r.Context(), videoID)
+	if errors.Is(err, database.ErrNotFound) {
+		respondWithError(w, http.StatusNotFound, "Video not found", err)
+		return
+	}
 	if err != nil {
-		log.Print("error while generating presigned url: %v", err)
-		return video, err
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get video", err)
+		return
 	}
 
-	video.VideoURL = &presignedURL
-
-	return video, nil
-
-}
-
-// Helper function to convert a string to a string pointer
-func ptr(s string) *string {
-	return &s
-}
-
-func generatePresignedURL(s3Client *s3.Client, bucket, key string, expireTime time.Duration) (string, error) {
-
-	presignClient := s3.NewPresignClient(s3Client)
-	input := &s3.GetObjectInput{
-		Bucket: ptr(bucket),
-		Key:    ptr(key),
-	}
-	presignRequest, err := presignClient.PresignGetObject(context.Background(), input, s3.WithPresignExpires(expireTime))
+	// After updating the video in the database, convert to signed URL format
+	signedVideo, err := cfg.dbVideoToSignedVideo(r, video)
 	if err != nil {
-		log.Print("error while generating presigned url: %v", err)
-		return "", err
+		respondWithError(w, http.StatusInternalServerError, "Couldn't generate presigned URL", err)
+		return
 	}
 
-	return presignRequest.URL, nil
+	respondWithJSON(w, http.StatusOK, signedVideo)
 
 }
@@ -1,13 +1,24 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
 	"net/http"
+	"net/mail"
+	"strings"
+	"time"
 
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/apierror"
 	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
 	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/mailer"
 )
 
+const emailVerificationTokenTTL = 24 * time.Hour
+
 func (cfg *apiConfig) handlerUsersCreate(w http.ResponseWriter, r *http.Request) {
 	type parameters struct {
 		Password string `json:"password"`
@@ -18,29 +29,167 @@ func (cfg *apiConfig) handlerUsersCreate(w http.ResponseWriter, r *http.Request)
 	params := parameters{}
 	err := decoder.Decode(&params)
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Couldn't decode parameters", err)
+		respondWithErrorCode(w, http.StatusBadRequest, apierror.CodeInvalidJSON, "Couldn't decode parameters", err)
 		return
 	}
 
+	params.Email = normalizeEmail(params.Email)
 	if params.Password == "" || params.Email == "" {
 		respondWithError(w, http.StatusBadRequest, "Email and password are required", nil)
 		return
 	}
 
+	err = validateEmail(params.Email)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid email address", err)
+		return
+	}
+
 	hashedPassword, err := auth.HashPassword(params.Password)
 	if err != nil {
 		respondWithError(w, http.StatusInternalServerError, "Couldn't hash password", err)
 		return
 	}
 
-	user, err := cfg.db.CreateUser(database.CreateUserParams{
+	user, err := cfg.db.CreateUser(r.Context(), database.CreateUserParams{
 		Email:    params.Email,
 		Password: hashedPassword,
 	})
+	if errors.Is(err, database.ErrAlreadyExists) {
+		respondWithError(w, http.StatusConflict, "An account with this email already exists", err)
+		return
+	}
 	if err != nil {
 		respondWithError(w, http.StatusInternalServerError, "Couldn't create user", err)
 		return
 	}
 
+	// The account exists at this point, so a mail failure shouldn't fail the
+	// signup. The user can ask for a new verification email later.
+	err = cfg.sendVerificationEmail(r.Context(), *user)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Couldn't send verification email", "email", user.Email, "error", err)
+	}
+
 	respondWithJSON(w, http.StatusCreated, user)
 }
+
+func (cfg *apiConfig) handlerUsersVerifyEmail(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		Token string `json:"token"`
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	params := parameters{}
+	err := decoder.Decode(&params)
+	if err != nil {
+		respondWithErrorCode(w, http.StatusBadRequest, apierror.CodeInvalidJSON, "Couldn't decode parameters", err)
+		return
+	}
+	if params.Token == "" {
+		respondWithError(w, http.StatusBadRequest, "Token is required", nil)
+		return
+	}
+
+	userID, err := cfg.db.VerifyEmailWithToken(r.Context(), auth.HashToken(params.Token))
+	if errors.Is(err, database.ErrNotFound) {
+		respondWithError(w, http.StatusUnauthorized, "Invalid or expired verification token", err)
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't verify email", err)
+		return
+	}
+
+	user, err := cfg.db.GetUser(r.Context(), userID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get user", err)
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, user)
+}
+
+func (cfg *apiConfig) handlerUsersResendVerification(w http.ResponseWriter, r *http.Request) {
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return
+	}
+	userID, err := auth.ValidateJWT(token, cfg.jwtSecret)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		return
+	}
+
+	user, err := cfg.db.GetUser(r.Context(), userID)
+	if errors.Is(err, database.ErrNotFound) {
+		respondWithError(w, http.StatusUnauthorized, "User not found", err)
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get user", err)
+		return
+	}
+	if user.VerifiedAt != nil {
+		respondWithError(w, http.StatusConflict, "Email is already verified", nil)
+		return
+	}
+
+	err = cfg.sendVerificationEmail(r.Context(), *user)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't send verification email", err)
+		return
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func (cfg *apiConfig) sendVerificationEmail(ctx context.Context, user database.User) error {
+	verificationToken, err := auth.MakeRefreshToken()
+	if err != nil {
+		return err
+	}
+
+	err = cfg.db.CreateEmailVerificationToken(ctx, database.CreateEmailVerificationTokenParams{
+		TokenHash: auth.HashToken(verificationToken),
+		UserID:    user.ID,
+		ExpiresAt: time.Now().UTC().Add(emailVerificationTokenTTL),
+	})
+	if err != nil {
+		return err
+	}
+
+	return cfg.mailer.Send(ctx, mailer.Message{
+		To:      user.Email,
+		Subject: "Verify your Tubely email address",
+		Body: fmt.Sprintf(
+			"Welcome to Tubely!\n\n"+
+				"Use this token to verify your email address within %v:\n\n%s\n",
+			emailVerificationTokenTTL, verificationToken,
+		),
+	})
+}
+
+// normalizeEmail lowercases an address, so accounts, SSO identities and the
+// login throttle all treat B@example.com and b@example.com as one mailbox.
+func normalizeEmail(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
+
+// validateEmail only accepts a bare address like "user@example.com", without
+// a display name or angle brackets.
+func validateEmail(email string) error {
+	addr, err := mail.ParseAddress(email)
+	if err != nil {
+		return err
+	}
+	if addr.Address != email || addr.Name != "" {
+		return errors.New("email must be a plain address")
+	}
+	at := strings.LastIndex(email, "@")
+	if !strings.Contains(email[at+1:], ".") {
+		return errors.New("email domain must contain a dot")
+	}
+	return nil
+}
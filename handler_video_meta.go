@@ -2,9 +2,15 @@ package main
 
 import (
 	"encoding/json"
-	"net/http"
+	"errors"
 	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/apierror"
 	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/config"
 	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
 	"github.com/google/uuid"
 )
@@ -29,12 +35,31 @@ func (cfg *apiConfig) handlerVideoMetaCreate(w http.ResponseWriter, r *http.Requ
 	params := parameters{}
 	err = decoder.Decode(&params)
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Couldn't decode parameters", err)
+		respondWithErrorCode(w, http.StatusBadRequest, apierror.CodeInvalidJSON, "Couldn't decode parameters", err)
 		return
 	}
 	params.UserID = userID
 
-	video, err := cfg.db.CreateVideo(params.CreateVideoParams)
+	if params.Visibility != "" && !database.ValidVisibility(params.Visibility) {
+		respondWithError(w, http.StatusBadRequest, "visibility must be private, unlisted or public", nil)
+		return
+	}
+
+	if params.URLTTLSeconds != nil {
+		ttl := time.Duration(*params.URLTTLSeconds) * time.Second
+		if ttl < config.MinURLTTL || ttl > config.MaxURLTTL {
+			respondWithError(w, http.StatusBadRequest, fmt.Sprintf("url_ttl_seconds must be between %d and %d", int(config.MinURLTTL.Seconds()), int(config.MaxURLTTL.Seconds())), nil)
+			return
+		}
+	}
+
+	quota, err := cfg.db.GetQuota(r.Context(), userID, cfg.defaultQuota)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get quota", err)
+		return
+	}
+
+	video, err := cfg.db.CreateVideo(r.Context(), params.CreateVideoParams, quota)
 	if err != nil {
 		respondWithError(w, http.StatusInternalServerError, "Couldn't create video", err)
 		return
@@ -62,9 +87,13 @@ func (cfg *apiConfig) handlerVideoMetaDelete(w http.ResponseWriter, r *http.Requ
 		return
 	}
 
-	video, err := cfg.db.GetVideo(videoID)
+	video, err := cfg.db.GetVideo(r.Context(), videoID)
+	if errors.Is(err, database.ErrNotFound) {
+		respondWithError(w, http.StatusNotFound, "Video not found", err)
+		return
+	}
 	if err != nil {
-		respondWithError(w, http.StatusNotFound, "Couldn't get video", err)
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get video", err)
 		return
 	}
 	if video.UserID != userID {
@@ -72,11 +101,14 @@ func (cfg *apiConfig) handlerVideoMetaDelete(w http.ResponseWriter, r *http.Requ
 		return
 	}
 
-	err = cfg.db.DeleteVideo(videoID)
+	err = cfg.db.DeleteVideo(r.Context(), videoID)
 	if err != nil {
 		respondWithError(w, http.StatusInternalServerError, "Couldn't delete video", err)
 		return
 	}
+	if video.VideoObject != nil {
+		cfg.deleteStoredObject(r.Context(), *video.VideoObject)
+	}
 
 	w.WriteHeader(http.StatusNoContent)
 }
@@ -89,15 +121,31 @@ func (cfg *apiConfig) handlerVideoGet(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	video, err := cfg.db.GetVideo(videoID)
+	video, err := cfg.db.GetVideo(r.Context(), videoID)
+	if errors.Is(err, database.ErrNotFound) {
+		respondWithError(w, http.StatusNotFound, "Video not found", err)
+		return
+	}
 	if err != nil {
-		respondWithError(w, http.StatusNotFound, "Couldn't get video", err)
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get video", err)
 		return
 	}
-	
-	signedVideo, err := cfg.dbVideoToSignedVideo(video)
+
+	// Videos the caller can't see are reported as missing, so their IDs
+	// don't leak.
+	allowed, err := cfg.canViewVideo(r, video)
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, fmt.Sprintf("Couldn't generate presigned URL: %v", err), err)
+		respondWithError(w, http.StatusUnauthorized, "Couldn't validate credentials", err)
+		return
+	}
+	if !allowed {
+		respondWithError(w, http.StatusNotFound, "Video not found", nil)
+		return
+	}
+
+	signedVideo, err := cfg.dbVideoToSignedVideo(r, video)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't generate presigned URL", err)
 		return
 	}
 
@@ -116,7 +164,7 @@ func (cfg *apiConfig) handlerVideosRetrieve(w http.ResponseWriter, r *http.Reque
 		return
 	}
 
-	videos, err := cfg.db.GetVideos(userID)
+	videos, err := cfg.db.GetVideos(r.Context(), userID)
 	if err != nil {
 		respondWithError(w, http.StatusInternalServerError, "Couldn't retrieve videos", err)
 		return
@@ -125,14 +173,99 @@ func (cfg *apiConfig) handlerVideosRetrieve(w http.ResponseWriter, r *http.Reque
 	signedVideos := make([]database.Video, 0, len(videos))
 
 	for _, video := range videos {
-		signedVideo, err := cfg.dbVideoToSignedVideo(video)
-		if err != nil {
-			fmt.Printf("Couldn't generate presigned URL: %v", err)
-			continue
-		}
+		// A video that can't be signed is still listed, without a video_url.
+		// dbVideoToSignedVideo has already logged why.
+		signedVideo, _ := cfg.dbVideoToSignedVideo(r, video)
 		signedVideos = append(signedVideos, signedVideo)
 	}
 
 	respondWithJSON(w, http.StatusOK, signedVideos)
 
 }
+
+// handlerVideoUpdate changes a video's title, description or visibility.
+// Fields left out of the request stay as they are.
+func (cfg *apiConfig) handlerVideoUpdate(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		Title       *string `json:"title"`
+		Description *string `json:"description"`
+		Visibility  *string `json:"visibility"`
+	}
+
+	video, ok := cfg.ownedVideo(w, r)
+	if !ok {
+		return
+	}
+
+	params := parameters{}
+	err := json.NewDecoder(r.Body).Decode(&params)
+	if err != nil {
+		respondWithErrorCode(w, http.StatusBadRequest, apierror.CodeInvalidJSON, "Couldn't decode parameters", err)
+		return
+	}
+
+	if params.Title != nil {
+		video.Title = *params.Title
+	}
+	if params.Description != nil {
+		video.Description = *params.Description
+	}
+	if params.Visibility != nil {
+		if !database.ValidVisibility(*params.Visibility) {
+			respondWithError(w, http.StatusBadRequest, "visibility must be private, unlisted or public", nil)
+			return
+		}
+		video.Visibility = *params.Visibility
+	}
+
+	err = cfg.db.UpdateVideo(r.Context(), video)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't update video", err)
+		return
+	}
+
+	signedVideo, err := cfg.dbVideoToSignedVideo(r, video)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't generate presigned URL", err)
+		return
+	}
+	respondWithJSON(w, http.StatusOK, signedVideo)
+}
+
+// handlerPublicVideos is the feed of public videos, newest first. It takes
+// optional limit (default 20, at most 100) and offset query parameters.
+func (cfg *apiConfig) handlerPublicVideos(w http.ResponseWriter, r *http.Request) {
+	limit, offset := 20, 0
+	if value := r.URL.Query().Get("limit"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 || n > 100 {
+			respondWithError(w, http.StatusBadRequest, "limit must be between 1 and 100", err)
+			return
+		}
+		limit = n
+	}
+	if value := r.URL.Query().Get("offset"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			respondWithError(w, http.StatusBadRequest, "offset must be a non-negative number", err)
+			return
+		}
+		offset = n
+	}
+
+	videos, err := cfg.db.GetPublicVideos(r.Context(), limit, offset)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't retrieve videos", err)
+		return
+	}
+
+	signedVideos := make([]database.Video, 0, len(videos))
+	for _, video := range videos {
+		// A video that can't be signed is still listed, without a video_url.
+		// dbVideoToSignedVideo has already logged why.
+		signedVideo, _ := cfg.dbVideoToSignedVideo(r, video)
+		signedVideos = append(signedVideos, signedVideo)
+	}
+
+	respondWithJSON(w, http.StatusOK, signedVideos)
+}
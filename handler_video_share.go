@@ -0,0 +1,187 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/apierror"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+// shareTokenHeader can carry a share token instead of the "share" query
+// parameter.
+const shareTokenHeader = "X-Share-Token"
+
+// canViewVideo decides whether the request may see the video: public videos
+// are open to all, unlisted ones to holders of a share token, and the owner
+// sees everything. A present but invalid access token is an error rather
+// than falling back to anonymous access.
+func (cfg *apiConfig) canViewVideo(r *http.Request, video database.Video) (bool, error) {
+	if video.Visibility == database.VisibilityPublic {
+		return true, nil
+	}
+
+	if r.Header.Get("Authorization") != "" {
+		token, err := auth.GetBearerToken(r.Header)
+		if err != nil {
+			return false, err
+		}
+		userID, err := auth.ValidateJWT(token, cfg.jwtSecret)
+		if err != nil {
+			return false, err
+		}
+		if userID == video.UserID {
+			return true, nil
+		}
+	}
+
+	if video.Visibility != database.VisibilityUnlisted {
+		return false, nil
+	}
+	shareToken := r.URL.Query().Get("share")
+	if shareToken == "" {
+		shareToken = r.Header.Get(shareTokenHeader)
+	}
+	if shareToken == "" {
+		return false, nil
+	}
+	return cfg.db.ShareTokenGrantsAccess(r.Context(), video.ID, auth.HashToken(shareToken))
+}
+
+// ownedVideo loads the video named in the path and checks the caller owns
+// it. It writes the error response itself and returns false on failure.
+func (cfg *apiConfig) ownedVideo(w http.ResponseWriter, r *http.Request) (database.Video, bool) {
+	videoID, err := uuid.Parse(r.PathValue("videoID"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid ID", err)
+		return database.Video{}, false
+	}
+
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return database.Video{}, false
+	}
+	userID, err := auth.ValidateJWT(token, cfg.jwtSecret)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		return database.Video{}, false
+	}
+
+	video, err := cfg.db.GetVideo(r.Context(), videoID)
+	if errors.Is(err, database.ErrNotFound) {
+		respondWithError(w, http.StatusNotFound, "Video not found", err)
+		return database.Video{}, false
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get video", err)
+		return database.Video{}, false
+	}
+	if video.UserID != userID {
+		respondWithError(w, http.StatusForbidden, "You don't own this video", nil)
+		return database.Video{}, false
+	}
+	return video, true
+}
+
+// handlerShareTokenCreate issues a share token for the video. Tokens only
+// grant access while the video is unlisted.
+func (cfg *apiConfig) handlerShareTokenCreate(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		// ExpiresInSeconds is optional, tokens last until revoked without it.
+		ExpiresInSeconds *int `json:"expires_in_seconds"`
+	}
+	type response struct {
+		database.ShareToken
+		Token string `json:"token"`
+		URL   string `json:"url"`
+	}
+
+	video, ok := cfg.ownedVideo(w, r)
+	if !ok {
+		return
+	}
+
+	params := parameters{}
+	if r.ContentLength != 0 {
+		err := json.NewDecoder(r.Body).Decode(&params)
+		if err != nil {
+			respondWithErrorCode(w, http.StatusBadRequest, apierror.CodeInvalidJSON, "Couldn't decode parameters", err)
+			return
+		}
+	}
+
+	var expiresAt *time.Time
+	if params.ExpiresInSeconds != nil {
+		if *params.ExpiresInSeconds <= 0 {
+			respondWithError(w, http.StatusBadRequest, "expires_in_seconds must be positive", nil)
+			return
+		}
+		expires := time.Now().UTC().Add(time.Duration(*params.ExpiresInSeconds) * time.Second)
+		expiresAt = &expires
+	}
+
+	token, err := auth.MakeRefreshToken()
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't create share token", err)
+		return
+	}
+	shareToken, err := cfg.db.CreateShareToken(r.Context(), database.CreateShareTokenParams{
+		TokenHash: auth.HashToken(token),
+		VideoID:   video.ID,
+		ExpiresAt: expiresAt,
+	})
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't save share token", err)
+		return
+	}
+
+	respondWithJSON(w, http.StatusCreated, response{
+		ShareToken: shareToken,
+		Token:      token,
+		URL:        fmt.Sprintf("/api/videos/%s?share=%s", video.ID, token),
+	})
+}
+
+func (cfg *apiConfig) handlerShareTokensList(w http.ResponseWriter, r *http.Request) {
+	video, ok := cfg.ownedVideo(w, r)
+	if !ok {
+		return
+	}
+
+	tokens, err := cfg.db.GetShareTokens(r.Context(), video.ID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get share tokens", err)
+		return
+	}
+	respondWithJSON(w, http.StatusOK, tokens)
+}
+
+func (cfg *apiConfig) handlerShareTokenRevoke(w http.ResponseWriter, r *http.Request) {
+	video, ok := cfg.ownedVideo(w, r)
+	if !ok {
+		return
+	}
+
+	tokenID, err := uuid.Parse(r.PathValue("tokenID"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid token ID", err)
+		return
+	}
+
+	revoked, err := cfg.db.RevokeShareToken(r.Context(), video.ID, tokenID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't revoke share token", err)
+		return
+	}
+	if !revoked {
+		respondWithError(w, http.StatusNotFound, "Share token not found", nil)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/storage"
+	"github.com/google/uuid"
+)
+
+// streamURL points at handlerVideoStream with a token that lets a <video> tag
+// (which can't send an Authorization header) fetch the file until opts.ttl
+// runs out.
+func (cfg *apiConfig) streamURL(videoID uuid.UUID, opts signOptions) (string, error) {
+	token, err := auth.MakeStreamToken(videoID, cfg.jwtSecret, opts.ttl)
+	if err != nil {
+		return "", err
+	}
+	query := url.Values{}
+	query.Set("token", token)
+	if opts.disposition != "" {
+		query.Set("download", "1")
+	}
+	return fmt.Sprintf("/api/videos/%s/stream?%s", videoID, query.Encode()), nil
+}
+
+// handlerVideoStream serves a video file from storage. Range and If-Range
+// requests, including multi-range ones, are handled by http.ServeContent so
+// players can seek. Callers authenticate with either the owner's access token
+// or a stream token in the "token" query parameter.
+func (cfg *apiConfig) handlerVideoStream(w http.ResponseWriter, r *http.Request) {
+	videoID, err := uuid.Parse(r.PathValue("videoID"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid ID", err)
+		return
+	}
+
+	streamToken := r.URL.Query().Get("token")
+	var userID uuid.UUID
+	if streamToken != "" {
+		tokenVideoID, err := auth.ValidateStreamToken(streamToken, cfg.jwtSecret)
+		if err != nil {
+			respondWithError(w, http.StatusUnauthorized, "Couldn't validate stream token", err)
+			return
+		}
+		if tokenVideoID != videoID {
+			respondWithError(w, http.StatusForbidden, "Stream token is for another video", nil)
+			return
+		}
+	} else {
+		token, err := auth.GetBearerToken(r.Header)
+		if err != nil {
+			respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+			return
+		}
+		userID, err = auth.ValidateJWT(token, cfg.jwtSecret)
+		if err != nil {
+			respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+			return
+		}
+	}
+
+	video, err := cfg.db.GetVideo(r.Context(), videoID)
+	if errors.Is(err, database.ErrNotFound) {
+		respondWithError(w, http.StatusNotFound, "Video not found", err)
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get video", err)
+		return
+	}
+	if streamToken == "" && video.UserID != userID {
+		respondWithError(w, http.StatusForbidden, "You can't watch this video", nil)
+		return
+	}
+	object := video.VideoObject
+	if object == nil {
+		respondWithError(w, http.StatusNotFound, "Video has no uploaded file", nil)
+		return
+	}
+
+	opener, ok := cfg.mediaStorage.(storage.Opener)
+	ok = ok && object.Backend == cfg.mediaStorage.Name() && object.Bucket == cfg.mediaStorage.Bucket()
+	if !ok && object.Backend == storage.BackendLocal {
+		respondWithError(w, http.StatusNotFound, "Video file isn't available from this server", nil)
+		return
+	}
+	if !ok {
+		// S3 and CloudFront handle ranges themselves, send the player there.
+		opts := cfg.playbackSignOptions(r, video)
+		opts.ttl = min(opts.ttl, cfg.urlPolicy.downloadTTL)
+		signedURL, err := cfg.signVideoURL(r.Context(), video.ID, *object, opts)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Couldn't sign video URL", err)
+			return
+		}
+		http.Redirect(w, r, signedURL, http.StatusFound)
+		return
+	}
+
+	file, err := opener.Open(r.Context(), object.Key)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't open video file", err)
+		return
+	}
+	defer file.Close()
+
+	// ServeContent keeps a Content-Type that's already set, and uses the
+	// ETag for If-Range and conditional requests.
+	w.Header().Set("Content-Type", object.ContentType)
+	if object.Checksum != "" {
+		w.Header().Set("ETag", `"`+object.Checksum+`"`)
+	}
+	w.Header().Set("Cache-Control", "private, no-transform")
+	// The token is in the URL, don't leak it through Referer.
+	w.Header().Set("Referrer-Policy", "no-referrer")
+	if r.URL.Query().Get("download") == "1" {
+		w.Header().Set("Content-Disposition", attachmentDisposition(video.Title, path.Ext(object.Key)))
+	}
+
+	http.ServeContent(w, r, path.Base(object.Key), object.CreatedAt, file)
+}
@@ -0,0 +1,206 @@
+// Package apierror describes errors the way the API reports them: as RFC
+// 7807 problem details with a stable, machine-readable code, so clients can
+// tell failures apart without matching on messages. It also knows which
+// errors from the other internal packages mean something to a client, like
+// database.ErrNotFound or a *database.QuotaError.
+package apierror
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/imaging"
+)
+
+// Code identifies the kind of error. Codes are part of the API: clients
+// branch on them, so they're never renamed, only added.
+type Code string
+
+const (
+	CodeBadRequest           Code = "bad_request"
+	CodeInvalidJSON          Code = "invalid_json"
+	CodeInvalidRequest       Code = "invalid_request"
+	CodeUnauthorized         Code = "unauthorized"
+	CodeInvalidCredentials   Code = "invalid_credentials"
+	CodeForbidden            Code = "forbidden"
+	CodeEmailNotVerified     Code = "email_not_verified"
+	CodeNotFound             Code = "not_found"
+	CodeConflict             Code = "conflict"
+	CodeBodyTooLarge         Code = "body_too_large"
+	CodeQuotaExceeded        Code = "quota_exceeded"
+	CodeUnsupportedMediaType Code = "unsupported_media_type"
+	CodeImageTooLarge        Code = "image_too_large"
+	CodeRateLimited          Code = "rate_limited"
+	CodeInternal             Code = "internal_error"
+	CodeSpecViolation        Code = "spec_violation"
+	CodeUpstream             Code = "upstream_error"
+	CodeUnavailable          Code = "unavailable"
+)
+
+// codesByStatus are the codes used when nothing more specific is known.
+var codesByStatus = map[int]Code{
+	http.StatusBadRequest:            CodeBadRequest,
+	http.StatusUnauthorized:          CodeUnauthorized,
+	http.StatusForbidden:             CodeForbidden,
+	http.StatusNotFound:              CodeNotFound,
+	http.StatusConflict:              CodeConflict,
+	http.StatusRequestEntityTooLarge: CodeBodyTooLarge,
+	http.StatusUnsupportedMediaType:  CodeUnsupportedMediaType,
+	http.StatusTooManyRequests:       CodeRateLimited,
+	http.StatusInternalServerError:   CodeInternal,
+	http.StatusBadGateway:            CodeUpstream,
+	http.StatusServiceUnavailable:    CodeUnavailable,
+}
+
+// CodeForStatus returns the generic code for an HTTP status.
+func CodeForStatus(status int) Code {
+	if code, ok := codesByStatus[status]; ok {
+		return code
+	}
+	if status >= 500 {
+		return CodeInternal
+	}
+	return CodeBadRequest
+}
+
+// Error is a failure as the client sees it. Detail is sent to the client,
+// Err is the cause and is only logged.
+type Error struct {
+	Status int
+	Code   Code
+	Detail string
+	Err    error
+}
+
+// New is for helpers that decide the response themselves. From passes the
+// result through untouched, even wrapped.
+func New(status int, code Code, detail string, err error) *Error {
+	return &Error{Status: status, Code: code, Detail: detail, Err: err}
+}
+
+func (e *Error) Error() string {
+	if e.Err != nil {
+		return e.Detail + ": " + e.Err.Error()
+	}
+	return e.Detail
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// Problem is the RFC 7807 body for e. The type is about:blank since the
+// code already says what went wrong; the title is then the status text, as
+// the RFC asks.
+func (e *Error) Problem() Problem {
+	return Problem{
+		Type:   "about:blank",
+		Title:  http.StatusText(e.Status),
+		Status: e.Status,
+		Detail: e.Detail,
+		Code:   e.Code,
+	}
+}
+
+// Problem is an application/problem+json response body.
+type Problem struct {
+	Type   string `json:"type"`
+	Title  string `json:"title"`
+	Status int    `json:"status"`
+	Detail string `json:"detail,omitempty"`
+	Code   Code   `json:"code"`
+}
+
+// From decides what to tell the client when a handler fails with err and
+// would answer status and detail. An *Error anywhere in err's chain is used
+// as is. A body over its limit or a quota error always wins, whatever the
+// handler was doing. Other domain errors replace a 5xx, which only means the
+// handler didn't expect them, so a lookup failing with database.ErrNotFound
+// is a 404 rather than "Couldn't get video"; a 4xx the handler chose stands.
+func From(status int, detail string, err error) *Error {
+	return FromCode(status, CodeForStatus(status), detail, err)
+}
+
+// FromCode is From with a code more specific than the status implies. The
+// code is kept unless a domain error takes over the response.
+func FromCode(status int, code Code, detail string, err error) *Error {
+	var apiErr *Error
+	if errors.As(err, &apiErr) {
+		return apiErr
+	}
+
+	e := &Error{Status: status, Code: code, Detail: detail, Err: err}
+	mapped, overrides := fromDomain(err)
+	switch {
+	case mapped == nil:
+	case overrides || status >= 500:
+		mapped.Err = err
+		return mapped
+	case mapped.Status == status && code == CodeForStatus(status):
+		e.Code = mapped.Code
+	}
+	return e
+}
+
+// fromDomain maps errors from the internal packages, or returns nil.
+// overrides is set for errors whose detail is more useful than anything the
+// handler could say.
+func fromDomain(err error) (mapped *Error, overrides bool) {
+	var tooLarge *http.MaxBytesError
+	var quotaErr *database.QuotaError
+	switch {
+	case err == nil:
+		return nil, false
+	case errors.As(err, &tooLarge):
+		return &Error{
+			Status: http.StatusRequestEntityTooLarge,
+			Code:   CodeBodyTooLarge,
+			Detail: fmt.Sprintf("Request body is larger than the %s limit", formatBytes(tooLarge.Limit)),
+		}, true
+	case errors.As(err, &quotaErr):
+		return &Error{
+			Status: http.StatusRequestEntityTooLarge,
+			Code:   CodeQuotaExceeded,
+			Detail: quotaDetail(quotaErr),
+		}, true
+	case errors.Is(err, database.ErrNotFound):
+		return &Error{Status: http.StatusNotFound, Code: CodeNotFound, Detail: "Not found"}, false
+	case errors.Is(err, database.ErrAlreadyExists):
+		return &Error{Status: http.StatusConflict, Code: CodeConflict, Detail: "Already exists"}, false
+	case errors.Is(err, imaging.ErrUnsupportedFormat):
+		return &Error{
+			Status: http.StatusUnsupportedMediaType,
+			Code:   CodeUnsupportedMediaType,
+			Detail: "Image must be a JPEG, PNG or WebP",
+		}, false
+	case errors.Is(err, imaging.ErrTooLarge):
+		return &Error{Status: http.StatusBadRequest, Code: CodeImageTooLarge, Detail: "Image dimensions are too large"}, false
+	}
+	return nil, false
+}
+
+func quotaDetail(err *database.QuotaError) string {
+	switch err.Resource {
+	case "bytes":
+		remaining := max(err.Limit-err.Used, 0)
+		return fmt.Sprintf("Storage quota exceeded: this upload needs %s but only %s of your %s are left", formatBytes(err.Requested), formatBytes(remaining), formatBytes(err.Limit))
+	default:
+		return fmt.Sprintf("Video limit reached: you can have at most %d videos", err.Limit)
+	}
+}
+
+// formatBytes renders n for people, e.g. 1.5 GiB.
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
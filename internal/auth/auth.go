@@ -2,6 +2,7 @@ package auth
 
 import (
 	"crypto/rand"
+	"crypto/sha256"
 	"encoding/hex"
 	"errors"
 	"fmt"
@@ -18,6 +19,8 @@ type TokenType string
 
 const (
 	TokenTypeAccess TokenType = "tubely-access"
+	TokenTypeMFA    TokenType = "tubely-mfa"
+	TokenTypeStream TokenType = "tubely-stream"
 )
 
 var ErrNoAuthHeaderIncluded = errors.New("no auth header included in request")
@@ -38,10 +41,44 @@ func MakeJWT(
 	userID uuid.UUID,
 	tokenSecret string,
 	expiresIn time.Duration,
+) (string, error) {
+	return makeToken(TokenTypeAccess, userID, tokenSecret, expiresIn)
+}
+
+func ValidateJWT(tokenString, tokenSecret string) (uuid.UUID, error) {
+	return validateToken(TokenTypeAccess, tokenString, tokenSecret)
+}
+
+// MakeMFAToken issues the short-lived token a client trades, together with a
+// second factor, for real access and refresh tokens.
+func MakeMFAToken(userID uuid.UUID, tokenSecret string, expiresIn time.Duration) (string, error) {
+	return makeToken(TokenTypeMFA, userID, tokenSecret, expiresIn)
+}
+
+func ValidateMFAToken(tokenString, tokenSecret string) (uuid.UUID, error) {
+	return validateToken(TokenTypeMFA, tokenString, tokenSecret)
+}
+
+// MakeStreamToken grants read access to one video's stream. It goes in the
+// URL, for players that can't send an Authorization header.
+func MakeStreamToken(videoID uuid.UUID, tokenSecret string, expiresIn time.Duration) (string, error) {
+	return makeToken(TokenTypeStream, videoID, tokenSecret, expiresIn)
+}
+
+// ValidateStreamToken returns the ID of the video the token grants access to.
+func ValidateStreamToken(tokenString, tokenSecret string) (uuid.UUID, error) {
+	return validateToken(TokenTypeStream, tokenString, tokenSecret)
+}
+
+func makeToken(
+	tokenType TokenType,
+	userID uuid.UUID,
+	tokenSecret string,
+	expiresIn time.Duration,
 ) (string, error) {
 	signingKey := []byte(tokenSecret)
 	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.RegisteredClaims{
-		Issuer:    string(TokenTypeAccess),
+		Issuer:    string(tokenType),
 		IssuedAt:  jwt.NewNumericDate(time.Now().UTC()),
 		ExpiresAt: jwt.NewNumericDate(time.Now().UTC().Add(expiresIn)),
 		Subject:   userID.String(),
@@ -49,12 +86,13 @@ func MakeJWT(
 	return token.SignedString(signingKey)
 }
 
-func ValidateJWT(tokenString, tokenSecret string) (uuid.UUID, error) {
+func validateToken(tokenType TokenType, tokenString, tokenSecret string) (uuid.UUID, error) {
 	claimsStruct := jwt.RegisteredClaims{}
 	token, err := jwt.ParseWithClaims(
 		tokenString,
 		&claimsStruct,
 		func(token *jwt.Token) (interface{}, error) { return []byte(tokenSecret), nil },
+		jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}),
 	)
 	if err != nil {
 		return uuid.Nil, err
@@ -69,7 +107,7 @@ func ValidateJWT(tokenString, tokenSecret string) (uuid.UUID, error) {
 	if err != nil {
 		return uuid.Nil, err
 	}
-	if issuer != string(TokenTypeAccess) {
+	if issuer != string(tokenType) {
 		return uuid.Nil, errors.New("invalid issuer")
 	}
 
@@ -102,6 +140,13 @@ func MakeRefreshToken() (string, error) {
 	return hex.EncodeToString(token), nil
 }
 
+// HashToken returns the hex SHA-256 digest of a random token so that only the
+// digest needs to be stored.
+func HashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
 func GetAPIKey(headers http.Header) (string, error) {
 	authHeader := headers.Get("Authorization")
 	if authHeader == "" {
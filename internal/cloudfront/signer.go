@@ -0,0 +1,182 @@
+package cloudfront
+
+import (
+	"bytes"
+	"crypto/rsa"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/feature/cloudfront/sign"
+)
+
+// Signer creates CloudFront signed URLs and signed cookies for objects served
+// through a single distribution. It never talks to AWS, signing happens
+// entirely with the local key pair.
+type Signer struct {
+	domain       string
+	urlSigner    *sign.URLSigner
+	cookieSigner *sign.CookieSigner
+}
+
+// PolicyOptions turn a canned policy into a custom one.
+type PolicyOptions struct {
+	Expires time.Time
+	// NotBefore is optional, the signature is invalid until then.
+	NotBefore time.Time
+	// ClientIP is optional, only requests from this address (or CIDR range)
+	// are allowed.
+	ClientIP string
+}
+
+func NewSigner(domain, keyPairID string, privateKey *rsa.PrivateKey) *Signer {
+	return &Signer{
+		domain:       strings.TrimSuffix(strings.TrimPrefix(domain, "https://"), "/"),
+		urlSigner:    sign.NewURLSigner(keyPairID, privateKey),
+		cookieSigner: sign.NewCookieSigner(keyPairID, privateKey),
+	}
+}
+
+// LoadSigner reads the CloudFront key pair's PEM private key from disk.
+func LoadSigner(domain, keyPairID, privateKeyPath string) (*Signer, error) {
+	if domain == "" || keyPairID == "" || privateKeyPath == "" {
+		return nil, errors.New("domain, key pair ID and private key path are required")
+	}
+	pemBytes, err := os.ReadFile(privateKeyPath)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't read CloudFront private key: %w", err)
+	}
+	privateKey, err := parsePrivateKey(pemBytes)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't load CloudFront private key: %w", err)
+	}
+	return NewSigner(domain, keyPairID, privateKey), nil
+}
+
+// parsePrivateKey accepts both PKCS#1 keys, which the CloudFront console
+// hands out, and the PKCS#8 keys newer openssl versions generate.
+func parsePrivateKey(pemBytes []byte) (*rsa.PrivateKey, error) {
+	privateKey, err := sign.LoadPEMPrivKey(bytes.NewReader(pemBytes))
+	if err == nil {
+		return privateKey, nil
+	}
+
+	key, pkcs8Err := sign.LoadPEMPrivKeyPKCS8(bytes.NewReader(pemBytes))
+	if pkcs8Err != nil {
+		return nil, err
+	}
+	rsaKey, ok := key.(*rsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("CloudFront private key must be an RSA key")
+	}
+	return rsaKey, nil
+}
+
+func (s *Signer) Domain() string {
+	return s.domain
+}
+
+// ObjectURL returns the unsigned distribution URL for an object key.
+func (s *Signer) ObjectURL(key string) string {
+	u := url.URL{
+		Scheme: "https",
+		Host:   s.domain,
+		Path:   "/" + strings.TrimPrefix(key, "/"),
+	}
+	return u.String()
+}
+
+// SignURL signs an object URL with a canned policy that only limits expiry.
+func (s *Signer) SignURL(key string, expires time.Time) (string, error) {
+	return s.urlSigner.Sign(s.ObjectURL(key), expires)
+}
+
+// SignURLWithPolicy signs an object URL with a custom policy, for when an IP
+// restriction or start time is needed.
+func (s *Signer) SignURLWithPolicy(key string, opts PolicyOptions) (string, error) {
+	rawURL := s.ObjectURL(key)
+	policy, err := newPolicy(rawURL, opts)
+	if err != nil {
+		return "", err
+	}
+	return s.urlSigner.SignWithPolicy(rawURL, policy)
+}
+
+// SignCookies returns the three CloudFront-* cookies granting access to every
+// object whose key starts with prefix, e.g. all segments of an HLS stream.
+func (s *Signer) SignCookies(prefix string, opts PolicyOptions, cookieOpts sign.CookieOptions) ([]*http.Cookie, error) {
+	resource := s.ObjectURL(prefix) + "*"
+	policy, err := newPolicy(resource, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	if cookieOpts.Path == "" {
+		cookieOpts.Path = "/"
+	}
+	if cookieOpts.Expires.IsZero() {
+		cookieOpts.Expires = opts.Expires
+	}
+	cookieOpts.Secure = true
+
+	return s.cookieSigner.SignWithPolicy(policy, func(o *sign.CookieOptions) {
+		*o = cookieOpts
+	})
+}
+
+func newPolicy(resource string, opts PolicyOptions) (*sign.Policy, error) {
+	if opts.Expires.IsZero() {
+		return nil, errors.New("policy expiry is required")
+	}
+
+	condition := sign.Condition{
+		DateLessThan: sign.NewAWSEpochTime(opts.Expires),
+	}
+	if !opts.NotBefore.IsZero() {
+		condition.DateGreaterThan = sign.NewAWSEpochTime(opts.NotBefore)
+	}
+	if opts.ClientIP != "" {
+		sourceIP, err := sourceIPCIDR(opts.ClientIP)
+		if err != nil {
+			return nil, err
+		}
+		condition.IPAddress = &sign.IPAddress{SourceIP: sourceIP}
+	}
+
+	policy := &sign.Policy{
+		Statements: []sign.Statement{{
+			Resource:  resource,
+			Condition: condition,
+		}},
+	}
+	return policy, policy.Validate()
+}
+
+// CanBindIP reports whether a policy can be bound to ip. CloudFront only
+// matches IPv4 source addresses, so IPv6 clients can't be bound.
+func CanBindIP(ip string) bool {
+	_, err := sourceIPCIDR(ip)
+	return err == nil
+}
+
+// sourceIPCIDR turns a bare address into the single-host CIDR CloudFront
+// expects. CloudFront policies only support IPv4.
+func sourceIPCIDR(ip string) (string, error) {
+	if strings.Contains(ip, "/") {
+		_, network, err := net.ParseCIDR(ip)
+		if err != nil {
+			return "", err
+		}
+		return network.String(), nil
+	}
+	parsed := net.ParseIP(ip)
+	if parsed == nil || parsed.To4() == nil {
+		return "", fmt.Errorf("CloudFront policies need an IPv4 address, got %q", ip)
+	}
+	return parsed.To4().String() + "/32", nil
+}
@@ -0,0 +1,239 @@
+package cloudfront
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/feature/cloudfront/sign"
+)
+
+const (
+	testDomain    = "d111111abcdef8.cloudfront.net"
+	testKeyPairID = "K2JCJMDEHXQW5F"
+)
+
+func newTestSigner(t *testing.T) (*Signer, *rsa.PublicKey) {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("generating key: %v", err)
+	}
+	return NewSigner("https://"+testDomain+"/", testKeyPairID, key), &key.PublicKey
+}
+
+// decodeAWSBase64 undoes CloudFront's URL-safe base64 variant.
+func decodeAWSBase64(t *testing.T, s string) []byte {
+	t.Helper()
+	s = strings.NewReplacer("-", "+", "_", "=", "~", "/").Replace(s)
+	b, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		t.Fatalf("decoding %q: %v", s, err)
+	}
+	return b
+}
+
+func verifySignature(t *testing.T, pub *rsa.PublicKey, policy []byte, signature string) {
+	t.Helper()
+	hash := sha1.Sum(policy)
+	if err := rsa.VerifyPKCS1v15(pub, crypto.SHA1, hash[:], decodeAWSBase64(t, signature)); err != nil {
+		t.Errorf("signature doesn't verify for policy %s: %v", policy, err)
+	}
+}
+
+func decodePolicy(t *testing.T, raw []byte) sign.Policy {
+	t.Helper()
+	var policy sign.Policy
+	if err := json.Unmarshal(raw, &policy); err != nil {
+		t.Fatalf("parsing policy %s: %v", raw, err)
+	}
+	if len(policy.Statements) != 1 {
+		t.Fatalf("policy has %d statements, want 1", len(policy.Statements))
+	}
+	return policy
+}
+
+func TestSignURLCannedPolicy(t *testing.T) {
+	signer, pub := newTestSigner(t)
+	expires := time.Unix(1767225600, 0)
+
+	signed, err := signer.SignURL("videos/abc.mp4", expires)
+	if err != nil {
+		t.Fatalf("SignURL: %v", err)
+	}
+	u, err := url.Parse(signed)
+	if err != nil {
+		t.Fatalf("parsing signed URL: %v", err)
+	}
+	if got, want := u.Scheme+"://"+u.Host+u.Path, "https://"+testDomain+"/videos/abc.mp4"; got != want {
+		t.Errorf("URL = %q, want %q", got, want)
+	}
+
+	query := u.Query()
+	if got := query.Get("Expires"); got != strconv.FormatInt(expires.Unix(), 10) {
+		t.Errorf("Expires = %q, want %d", got, expires.Unix())
+	}
+	if got := query.Get("Key-Pair-Id"); got != testKeyPairID {
+		t.Errorf("Key-Pair-Id = %q, want %q", got, testKeyPairID)
+	}
+	if query.Has("Policy") {
+		t.Errorf("canned policy URL has a Policy parameter")
+	}
+
+	// CloudFront rebuilds the canned policy from the URL and Expires.
+	policy := `{"Statement":[{"Resource":"https://` + testDomain + `/videos/abc.mp4",` +
+		`"Condition":{"DateLessThan":{"AWS:EpochTime":` + query.Get("Expires") + `}}}]}`
+	verifySignature(t, pub, []byte(policy), query.Get("Signature"))
+}
+
+func TestSignURLWithPolicy(t *testing.T) {
+	signer, pub := newTestSigner(t)
+	expires := time.Unix(1767225600, 0)
+	notBefore := expires.Add(-time.Hour)
+
+	signed, err := signer.SignURLWithPolicy("videos/abc.mp4", PolicyOptions{
+		Expires:   expires,
+		NotBefore: notBefore,
+		ClientIP:  "203.0.113.7",
+	})
+	if err != nil {
+		t.Fatalf("SignURLWithPolicy: %v", err)
+	}
+	u, err := url.Parse(signed)
+	if err != nil {
+		t.Fatalf("parsing signed URL: %v", err)
+	}
+	query := u.Query()
+	if query.Has("Expires") {
+		t.Errorf("custom policy URL has an Expires parameter")
+	}
+	if got := query.Get("Key-Pair-Id"); got != testKeyPairID {
+		t.Errorf("Key-Pair-Id = %q, want %q", got, testKeyPairID)
+	}
+
+	rawPolicy := decodeAWSBase64(t, query.Get("Policy"))
+	verifySignature(t, pub, rawPolicy, query.Get("Signature"))
+
+	statement := decodePolicy(t, rawPolicy).Statements[0]
+	if want := "https://" + testDomain + "/videos/abc.mp4"; statement.Resource != want {
+		t.Errorf("Resource = %q, want %q", statement.Resource, want)
+	}
+	condition := statement.Condition
+	if condition.IPAddress == nil || condition.IPAddress.SourceIP != "203.0.113.7/32" {
+		t.Errorf("IpAddress = %+v, want 203.0.113.7/32", condition.IPAddress)
+	}
+	if condition.DateLessThan == nil || !condition.DateLessThan.Equal(expires) {
+		t.Errorf("DateLessThan = %v, want %v", condition.DateLessThan, expires)
+	}
+	if condition.DateGreaterThan == nil || !condition.DateGreaterThan.Equal(notBefore) {
+		t.Errorf("DateGreaterThan = %v, want %v", condition.DateGreaterThan, notBefore)
+	}
+}
+
+func TestSignURLWithPolicyRejectsIPv6(t *testing.T) {
+	signer, _ := newTestSigner(t)
+	_, err := signer.SignURLWithPolicy("videos/abc.mp4", PolicyOptions{
+		Expires:  time.Now().Add(time.Hour),
+		ClientIP: "2001:db8::1",
+	})
+	if err == nil {
+		t.Errorf("SignURLWithPolicy accepted an IPv6 client address")
+	}
+}
+
+func TestCanBindIP(t *testing.T) {
+	tests := []struct {
+		ip   string
+		want bool
+	}{
+		{"203.0.113.7", true},
+		{"::ffff:203.0.113.7", true},
+		{"198.51.100.0/24", true},
+		{"2001:db8::1", false},
+		{"", false},
+		{"not-an-ip", false},
+	}
+	for _, tt := range tests {
+		if got := CanBindIP(tt.ip); got != tt.want {
+			t.Errorf("CanBindIP(%q) = %v, want %v", tt.ip, got, tt.want)
+		}
+	}
+}
+
+func TestSignCookies(t *testing.T) {
+	signer, pub := newTestSigner(t)
+	expires := time.Unix(1767225600, 0)
+
+	cookies, err := signer.SignCookies("hls/abc/", PolicyOptions{
+		Expires:  expires,
+		ClientIP: "198.51.100.0/24",
+	}, sign.CookieOptions{Domain: testDomain})
+	if err != nil {
+		t.Fatalf("SignCookies: %v", err)
+	}
+
+	values := map[string]string{}
+	for _, cookie := range cookies {
+		values[cookie.Name] = cookie.Value
+		if !cookie.Secure {
+			t.Errorf("cookie %s isn't Secure", cookie.Name)
+		}
+		if cookie.Path != "/" {
+			t.Errorf("cookie %s has path %q, want /", cookie.Name, cookie.Path)
+		}
+		if cookie.Domain != testDomain {
+			t.Errorf("cookie %s has domain %q, want %q", cookie.Name, cookie.Domain, testDomain)
+		}
+		if !cookie.Expires.Equal(expires) {
+			t.Errorf("cookie %s expires %v, want %v", cookie.Name, cookie.Expires, expires)
+		}
+	}
+	for _, name := range []string{sign.CookiePolicyName, sign.CookieSignatureName, sign.CookieKeyIDName} {
+		if values[name] == "" {
+			t.Fatalf("cookie %s is missing from %v", name, cookies)
+		}
+	}
+	if got := values[sign.CookieKeyIDName]; got != testKeyPairID {
+		t.Errorf("%s = %q, want %q", sign.CookieKeyIDName, got, testKeyPairID)
+	}
+
+	rawPolicy := decodeAWSBase64(t, values[sign.CookiePolicyName])
+	verifySignature(t, pub, rawPolicy, values[sign.CookieSignatureName])
+
+	statement := decodePolicy(t, rawPolicy).Statements[0]
+	if want := "https://" + testDomain + "/hls/abc/*"; statement.Resource != want {
+		t.Errorf("Resource = %q, want %q", statement.Resource, want)
+	}
+	if ip := statement.Condition.IPAddress; ip == nil || ip.SourceIP != "198.51.100.0/24" {
+		t.Errorf("IpAddress = %+v, want 198.51.100.0/24", ip)
+	}
+}
+
+// Make sure the helpers above would notice a bad signature.
+func TestVerifySignatureDetectsTampering(t *testing.T) {
+	signer, pub := newTestSigner(t)
+	cookies, err := signer.SignCookies("hls/abc/", PolicyOptions{Expires: time.Now().Add(time.Hour)}, sign.CookieOptions{})
+	if err != nil {
+		t.Fatalf("SignCookies: %v", err)
+	}
+	byName := map[string]*http.Cookie{}
+	for _, cookie := range cookies {
+		byName[cookie.Name] = cookie
+	}
+	policy := decodeAWSBase64(t, byName[sign.CookiePolicyName].Value)
+	policy = []byte(strings.Replace(string(policy), "hls/abc/*", "hls/*", 1))
+	hash := sha1.Sum(policy)
+	signature := decodeAWSBase64(t, byName[sign.CookieSignatureName].Value)
+	if rsa.VerifyPKCS1v15(pub, crypto.SHA1, hash[:], signature) == nil {
+		t.Errorf("signature verified for a widened policy")
+	}
+}
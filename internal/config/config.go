@@ -0,0 +1,331 @@
+// Package config loads the server settings. Each setting can come from, in
+// increasing order of precedence: its default, a YAML or TOML file, an
+// environment variable and a command line flag. A setting tagged
+// `config:"s3_bucket"` is s3_bucket in the file, S3_BUCKET in the
+// environment and -s3-bucket on the command line.
+package config
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/netip"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Storage backends and video delivery modes.
+const (
+	StorageS3    = "s3"
+	StorageLocal = "local"
+
+	DeliveryS3         = "s3"
+	DeliveryCloudFront = "cloudfront"
+)
+
+// Bounds for signed URL lifetimes, both the defaults and per-video
+// overrides. S3 refuses to presign for more than a week.
+const (
+	MinURLTTL = time.Minute
+	MaxURLTTL = 7 * 24 * time.Hour
+)
+
+type Config struct {
+	DBPath       string `config:"db_path" usage:"SQLite database file"`
+	JWTSecret    string `config:"jwt_secret" usage:"secret for signing access tokens"`
+	Platform     string `config:"platform" usage:"\"dev\" enables development behaviour"`
+	FilepathRoot string `config:"filepath_root" usage:"directory of the web app"`
+	AssetsRoot   string `config:"assets_root" usage:"directory for temporary and legacy assets"`
+	Port         string `config:"port" usage:"port to listen on"`
+
+	StorageBackend  string `config:"storage_backend" usage:"where uploads are stored: s3 or local"`
+	LocalStorageDir string `config:"local_storage_dir" usage:"root directory of the local storage backend"`
+	PublicAssetsURL string `config:"public_assets_url" usage:"base URL thumbnails are served from"`
+	S3Bucket        string `config:"s3_bucket" usage:"S3 bucket for uploads"`
+	S3Region        string `config:"s3_region" usage:"AWS region of the bucket"`
+	S3CfDistro      string `config:"s3_cf_distro" usage:"CloudFront domain in front of the bucket"`
+
+	VideoDelivery    string        `config:"video_delivery" usage:"how videos are signed: s3 or cloudfront"`
+	CFKeyPairID      string        `config:"cf_key_pair_id" usage:"CloudFront key pair ID"`
+	CFPrivateKeyPath string        `config:"cf_private_key_path" usage:"CloudFront private key file"`
+	CFCookieDomain   string        `config:"cf_cookie_domain" usage:"domain for CloudFront signed cookies"`
+	URLTTL           time.Duration `config:"url_ttl" usage:"lifetime of signed playback URLs"`
+	DownloadURLTTL   time.Duration `config:"download_url_ttl" usage:"lifetime of signed download URLs"`
+	URLBindIP        bool          `config:"url_bind_ip" usage:"bind signed URLs to the client IP (cloudfront only)"`
+
+	QuotaMaxBytes  int64  `config:"quota_max_bytes" usage:"default storage quota per user, 0 for unlimited"`
+	QuotaMaxVideos int64  `config:"quota_max_videos" usage:"default video quota per user, 0 for unlimited"`
+	AdminAPIKey    string `config:"admin_api_key" usage:"key for the /admin endpoints"`
+
+	Mailer               string `config:"mailer" usage:"log or file"`
+	MailDir              string `config:"mail_dir" usage:"directory for the file mailer"`
+	MailFrom             string `config:"mail_from" usage:"sender of outgoing email"`
+	RequireVerifiedEmail bool   `config:"require_verified_email" usage:"block uploads until email is verified"`
+
+	OIDCIssuer       string `config:"oidc_issuer" usage:"OpenID Connect issuer, empty to disable"`
+	OIDCClientID     string `config:"oidc_client_id" usage:"OpenID Connect client ID"`
+	OIDCClientSecret string `config:"oidc_client_secret" usage:"OpenID Connect client secret"`
+	OIDCRedirectURL  string `config:"oidc_redirect_url" usage:"OpenID Connect callback URL"`
+
+	LogFormat          string `config:"log_format" usage:"text or json, defaults to text for dev"`
+	LogLevel           string `config:"log_level" usage:"debug, info, warn or error"`
+	OTelTracesExporter string `config:"otel_traces_exporter" usage:"none, stdout or otlp"`
+
+	ShutdownTimeout   time.Duration `config:"shutdown_timeout" usage:"how long shutdown waits for requests in flight"`
+	ReadHeaderTimeout time.Duration `config:"read_header_timeout" usage:"time allowed to read request headers"`
+	ReadTimeout       time.Duration `config:"read_timeout" usage:"time allowed to read a request"`
+	WriteTimeout      time.Duration `config:"write_timeout" usage:"time allowed to write a response"`
+	IdleTimeout       time.Duration `config:"idle_timeout" usage:"how long idle keep-alive connections stay open"`
+	TransferTimeout   time.Duration `config:"transfer_timeout" usage:"read and write timeout of uploads and streams"`
+	MaxHeaderBytes    int64         `config:"max_header_bytes" usage:"largest request header accepted"`
+	TLSCertFile       string        `config:"tls_cert_file" usage:"certificate for serving HTTPS"`
+	TLSKeyFile        string        `config:"tls_key_file" usage:"private key for serving HTTPS"`
+	TrustedProxies    string        `config:"trusted_proxies" usage:"comma-separated proxy addresses or CIDR ranges whose X-Forwarded-For is believed"`
+
+	CORSAllowedOrigins   string        `config:"cors_allowed_origins" usage:"comma-separated origins allowed to call /api/, * for any, empty to disable CORS"`
+	CORSAllowedMethods   string        `config:"cors_allowed_methods" usage:"comma-separated methods allowed cross-origin"`
+	CORSAllowedHeaders   string        `config:"cors_allowed_headers" usage:"comma-separated request headers allowed cross-origin"`
+	CORSExposedHeaders   string        `config:"cors_exposed_headers" usage:"comma-separated response headers readable cross-origin"`
+	CORSAllowCredentials bool          `config:"cors_allow_credentials" usage:"let cross-origin requests send and receive cookies"`
+	CORSMaxAge           time.Duration `config:"cors_max_age" usage:"how long browsers may cache a preflight, 0 for their default"`
+}
+
+// Default returns the settings used when nothing overrides them.
+func Default() Config {
+	return Config{
+		StorageBackend:  StorageS3,
+		LocalStorageDir: "./storage",
+
+		VideoDelivery:  DeliveryS3,
+		URLTTL:         time.Hour,
+		DownloadURLTTL: 5 * time.Minute,
+
+		QuotaMaxBytes:  10 << 30,
+		QuotaMaxVideos: 100,
+
+		MailFrom: "Tubely <no-reply@tubely.local>",
+
+		LogLevel:           "info",
+		OTelTracesExporter: "none",
+
+		ShutdownTimeout:   30 * time.Second,
+		ReadHeaderTimeout: 10 * time.Second,
+		ReadTimeout:       30 * time.Second,
+		WriteTimeout:      time.Minute,
+		IdleTimeout:       2 * time.Minute,
+		TransferTimeout:   30 * time.Minute,
+		MaxHeaderBytes:    64 << 10,
+
+		CORSAllowedMethods: "GET, POST, PUT, PATCH, DELETE",
+		CORSAllowedHeaders: "Authorization, Content-Type, X-Request-ID, X-Share-Token",
+		CORSExposedHeaders: "Content-Disposition, Retry-After, X-Request-ID",
+		CORSMaxAge:         10 * time.Minute,
+	}
+}
+
+// fillDerived sets defaults that depend on other settings.
+func (c *Config) fillDerived() {
+	if c.LogFormat == "" {
+		c.LogFormat = "json"
+		if c.Platform == "dev" {
+			c.LogFormat = "text"
+		}
+	}
+	// Production has to pick a mailer, it can't fall back to one that
+	// doesn't deliver.
+	if c.Mailer == "" && c.Platform == "dev" {
+		c.Mailer = "log"
+	}
+	if c.PublicAssetsURL == "" {
+		if c.StorageBackend == StorageLocal {
+			c.PublicAssetsURL = "http://localhost:" + c.Port + "/media"
+		} else if c.S3CfDistro != "" {
+			c.PublicAssetsURL = "https://" + c.S3CfDistro
+		}
+	}
+	if c.OIDCRedirectURL == "" {
+		c.OIDCRedirectURL = "http://localhost:" + c.Port + "/api/oidc/callback"
+	}
+}
+
+// S3Configured reports whether there's enough to talk to S3. With local
+// storage it's optional, and only needed to sign URLs of videos uploaded
+// before the switch.
+func (c Config) S3Configured() bool {
+	return c.S3Bucket != "" && c.S3Region != ""
+}
+
+// SplitList splits a comma-separated setting, dropping blank entries.
+func SplitList(s string) []string {
+	var items []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// SlogLevel is LogLevel parsed. Validate has checked it.
+func (c Config) SlogLevel() slog.Level {
+	var level slog.Level
+	level.UnmarshalText([]byte(c.LogLevel))
+	return level
+}
+
+// Validate checks every setting and returns all the problems at once.
+func (c Config) Validate() error {
+	var problems []error
+	problem := func(format string, args ...any) {
+		problems = append(problems, fmt.Errorf(format, args...))
+	}
+	required := func(value, key string) {
+		if value == "" {
+			problem("%s is required", envName(key))
+		}
+	}
+
+	required(c.DBPath, "db_path")
+	required(c.JWTSecret, "jwt_secret")
+	required(c.Platform, "platform")
+	required(c.FilepathRoot, "filepath_root")
+	required(c.AssetsRoot, "assets_root")
+	if port, err := strconv.Atoi(c.Port); c.Port == "" {
+		required(c.Port, "port")
+	} else if err != nil || port < 1 || port > 65535 {
+		problem("PORT must be a port number, not %q", c.Port)
+	}
+
+	switch c.StorageBackend {
+	case StorageS3:
+		required(c.S3Bucket, "s3_bucket")
+		required(c.S3Region, "s3_region")
+		if c.PublicAssetsURL == "" {
+			problem("S3_CF_DISTRO or PUBLIC_ASSETS_URL is required with STORAGE_BACKEND=s3")
+		}
+	case StorageLocal:
+		required(c.LocalStorageDir, "local_storage_dir")
+		if c.VideoDelivery == DeliveryCloudFront {
+			problem("VIDEO_DELIVERY=cloudfront needs STORAGE_BACKEND=s3")
+		}
+		if (c.S3Bucket == "") != (c.S3Region == "") {
+			problem("S3_BUCKET and S3_REGION must be set together")
+		}
+	default:
+		problem("STORAGE_BACKEND must be %q or %q, not %q", StorageS3, StorageLocal, c.StorageBackend)
+	}
+
+	switch c.VideoDelivery {
+	case DeliveryS3:
+		if c.URLBindIP {
+			problem("URL_BIND_IP needs VIDEO_DELIVERY=cloudfront, S3 presigned URLs can't be bound to an IP")
+		}
+	case DeliveryCloudFront:
+		required(c.S3CfDistro, "s3_cf_distro")
+		required(c.CFKeyPairID, "cf_key_pair_id")
+		required(c.CFPrivateKeyPath, "cf_private_key_path")
+	default:
+		problem("VIDEO_DELIVERY must be %q or %q, not %q", DeliveryS3, DeliveryCloudFront, c.VideoDelivery)
+	}
+
+	switch c.Mailer {
+	case "":
+		problem("MAILER is required unless PLATFORM=dev")
+	case "log":
+		if c.Platform != "dev" {
+			problem("MAILER=log only records that mail was sent, it needs PLATFORM=dev")
+		}
+	case "file":
+		required(c.MailDir, "mail_dir")
+	default:
+		problem("MAILER must be \"log\" or \"file\", not %q", c.Mailer)
+	}
+	required(c.MailFrom, "mail_from")
+
+	if c.OIDCIssuer != "" {
+		required(c.OIDCClientID, "oidc_client_id")
+	}
+
+	if c.LogFormat != "json" && c.LogFormat != "text" {
+		problem("LOG_FORMAT must be \"json\" or \"text\", not %q", c.LogFormat)
+	}
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(c.LogLevel)); err != nil {
+		problem("LOG_LEVEL must be debug, info, warn or error, not %q", c.LogLevel)
+	}
+	switch c.OTelTracesExporter {
+	case "none", "stdout", "otlp":
+	default:
+		problem("OTEL_TRACES_EXPORTER must be none, stdout or otlp, not %q", c.OTelTracesExporter)
+	}
+
+	durations := []struct {
+		key   string
+		value time.Duration
+	}{
+		// The signed URL lifetimes come first, they're also checked below.
+		{"url_ttl", c.URLTTL},
+		{"download_url_ttl", c.DownloadURLTTL},
+		{"shutdown_timeout", c.ShutdownTimeout},
+		{"read_header_timeout", c.ReadHeaderTimeout},
+		{"read_timeout", c.ReadTimeout},
+		{"write_timeout", c.WriteTimeout},
+		{"idle_timeout", c.IdleTimeout},
+		{"transfer_timeout", c.TransferTimeout},
+	}
+	for _, d := range durations {
+		if d.value <= 0 {
+			problem("%s must be a positive duration like 30s or 1h", envName(d.key))
+		}
+	}
+	// Signing would fail on every request rather than at startup.
+	for _, d := range durations[:2] {
+		if d.value > 0 && (d.value < MinURLTTL || d.value > MaxURLTTL) {
+			problem("%s must be between %s and %s", envName(d.key), MinURLTTL, MaxURLTTL)
+		}
+	}
+	if c.QuotaMaxBytes < 0 {
+		problem("QUOTA_MAX_BYTES must be a whole number, 0 for unlimited")
+	}
+	if c.QuotaMaxVideos < 0 {
+		problem("QUOTA_MAX_VIDEOS must be a whole number, 0 for unlimited")
+	}
+	if c.MaxHeaderBytes <= 0 {
+		problem("MAX_HEADER_BYTES must be a positive number")
+	}
+	if (c.TLSCertFile == "") != (c.TLSKeyFile == "") {
+		problem("TLS_CERT_FILE and TLS_KEY_FILE must be set together")
+	}
+	for _, proxy := range SplitList(c.TrustedProxies) {
+		if _, err := netip.ParsePrefix(proxy); err != nil {
+			if _, err := netip.ParseAddr(proxy); err != nil {
+				problem("TRUSTED_PROXIES must list addresses or CIDR ranges like 10.0.0.0/8, not %q", proxy)
+			}
+		}
+	}
+
+	for _, origin := range SplitList(c.CORSAllowedOrigins) {
+		if origin == "*" {
+			if c.CORSAllowCredentials {
+				problem("CORS_ALLOW_CREDENTIALS can't be used with CORS_ALLOWED_ORIGINS=*, list the origins instead")
+			}
+			continue
+		}
+		u, err := url.Parse(origin)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || u.Path != "" || u.RawQuery != "" || u.User != nil {
+			problem("CORS_ALLOWED_ORIGINS must list origins like https://app.example.com, not %q", origin)
+		}
+	}
+	for _, method := range SplitList(c.CORSAllowedMethods) {
+		if method != strings.ToUpper(method) || strings.ContainsAny(method, " \t") {
+			problem("CORS_ALLOWED_METHODS must list methods like GET, not %q", method)
+		}
+	}
+	if c.CORSMaxAge < 0 {
+		problem("CORS_MAX_AGE can't be negative")
+	}
+
+	return errors.Join(problems...)
+}
@@ -0,0 +1,124 @@
+package config
+
+import (
+	"strings"
+	"testing"
+)
+
+// validConfig passes Validate, for tests to break one setting at a time.
+func validConfig() Config {
+	cfg := Default()
+	cfg.DBPath = "tubely.db"
+	cfg.JWTSecret = "secret"
+	cfg.Platform = "dev"
+	cfg.FilepathRoot = "./app"
+	cfg.AssetsRoot = "./assets"
+	cfg.Port = "8091"
+	cfg.StorageBackend = StorageLocal
+	cfg.fillDerived()
+	return cfg
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		modify func(*Config)
+		want   []string
+	}{
+		{
+			name:   "valid",
+			modify: func(c *Config) {},
+		},
+		{
+			name: "every missing setting",
+			modify: func(c *Config) {
+				c.DBPath = ""
+				c.JWTSecret = ""
+				c.Port = "http"
+			},
+			want: []string{
+				"DB_PATH is required",
+				"JWT_SECRET is required",
+				`PORT must be a port number, not "http"`,
+			},
+		},
+		{
+			name: "production needs a mailer",
+			modify: func(c *Config) {
+				c.Platform = "production"
+				c.Mailer = "log"
+			},
+			want: []string{"MAILER=log only records that mail was sent, it needs PLATFORM=dev"},
+		},
+		{
+			name: "cloudfront settings",
+			modify: func(c *Config) {
+				c.StorageBackend = StorageS3
+				c.S3Bucket = "bucket"
+				c.S3Region = "us-east-1"
+				c.VideoDelivery = DeliveryCloudFront
+				c.URLTTL = MaxURLTTL * 2
+			},
+			want: []string{
+				"S3_CF_DISTRO is required",
+				"CF_KEY_PAIR_ID is required",
+				"CF_PRIVATE_KEY_PATH is required",
+				"URL_TTL must be between",
+			},
+		},
+		{
+			name: "url binding needs cloudfront",
+			modify: func(c *Config) {
+				c.URLBindIP = true
+			},
+			want: []string{"URL_BIND_IP needs VIDEO_DELIVERY=cloudfront"},
+		},
+		{
+			name: "trusted proxies",
+			modify: func(c *Config) {
+				c.TrustedProxies = "10.0.0.0/8, 192.168.1.1, 2001:db8::/32, lb.internal"
+			},
+			want: []string{`not "lb.internal"`},
+		},
+		{
+			name: "durations",
+			modify: func(c *Config) {
+				c.ShutdownTimeout = 0
+				c.ReadTimeout = -1
+			},
+			want: []string{
+				"SHUTDOWN_TIMEOUT must be a positive duration",
+				"READ_TIMEOUT must be a positive duration",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := validConfig()
+			tt.modify(&cfg)
+			err := cfg.Validate()
+			if len(tt.want) == 0 {
+				if err != nil {
+					t.Fatalf("Validate: %v", err)
+				}
+				return
+			}
+			if err == nil {
+				t.Fatalf("Validate passed, want %d problems", len(tt.want))
+			}
+			// Every problem is its own error, one per line.
+			joined, ok := err.(interface{ Unwrap() []error })
+			if !ok {
+				t.Fatalf("Validate returned %T, want joined errors", err)
+			}
+			if got := len(joined.Unwrap()); got != len(tt.want) {
+				t.Errorf("Validate found %d problems, want %d:\n%v", got, len(tt.want), err)
+			}
+			for _, want := range tt.want {
+				if !strings.Contains(err.Error(), want) {
+					t.Errorf("error %q doesn't mention %q", err, want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,220 @@
+package config
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// Load builds the configuration from defaults, the file named by -config or
+// CONFIG_FILE, the environment and args, which shouldn't include the program
+// name. It returns the arguments left after the flags, e.g. a subcommand.
+// The error lists every problem found, one per line.
+func Load(args []string) (Config, []string, error) {
+	cfg := Default()
+	fields := cfg.fields()
+	var problems []error
+
+	flags := flag.NewFlagSet("tubely", flag.ContinueOnError)
+	configFile := flags.String("config", os.Getenv("CONFIG_FILE"), "YAML or TOML config file")
+	flagValues := map[string]*flagValue{}
+	for _, f := range fields {
+		value := &flagValue{isBool: f.value.Kind() == reflect.Bool}
+		if !f.value.IsZero() {
+			// Shown as the default by -h.
+			value.raw = fmt.Sprint(f.value.Interface())
+		}
+		flagValues[f.key] = value
+		flags.Var(value, flagName(f.key), f.usage)
+	}
+	err := flags.Parse(args)
+	if err != nil {
+		return Config{}, nil, err
+	}
+
+	if *configFile != "" {
+		err := loadFile(*configFile, fields)
+		if err != nil {
+			problems = append(problems, err)
+		}
+	}
+
+	// A variable that's set but empty clears the setting, so the environment
+	// can undo the config file.
+	for _, f := range fields {
+		if value, ok := os.LookupEnv(envName(f.key)); ok {
+			if err := f.set(value); err != nil {
+				problems = append(problems, fmt.Errorf("%s: %w", envName(f.key), err))
+			}
+		}
+	}
+
+	for _, f := range fields {
+		if value := flagValues[f.key]; value.set {
+			if err := f.set(value.raw); err != nil {
+				problems = append(problems, fmt.Errorf("-%s: %w", flagName(f.key), err))
+			}
+		}
+	}
+
+	cfg.fillDerived()
+	problems = append(problems, cfg.Validate())
+	if err := errors.Join(problems...); err != nil {
+		return Config{}, nil, err
+	}
+	return cfg, flags.Args(), nil
+}
+
+// loadFile reads settings from a YAML or TOML file, picked by extension.
+// Unknown keys are errors, they're most likely typos.
+func loadFile(path string, fields []field) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("couldn't read config file: %w", err)
+	}
+
+	settings := map[string]any{}
+	switch ext := strings.ToLower(filepath.Ext(path)); ext {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, &settings)
+	case ".toml":
+		err = toml.Unmarshal(data, &settings)
+	default:
+		return fmt.Errorf("config file %s must be .yaml, .yml or .toml", path)
+	}
+	if err != nil {
+		return fmt.Errorf("couldn't parse config file %s: %w", path, err)
+	}
+
+	byKey := map[string]field{}
+	for _, f := range fields {
+		byKey[f.key] = f
+	}
+	keys := make([]string, 0, len(settings))
+	for key := range settings {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var problems []error
+	for _, key := range keys {
+		value := settings[key]
+		f, ok := byKey[key]
+		if !ok {
+			problems = append(problems, fmt.Errorf("%s: unknown setting %q", path, key))
+			continue
+		}
+		switch value.(type) {
+		case string, bool, int, int64, uint64, float64:
+		default:
+			problems = append(problems, fmt.Errorf("%s: %s must be a single value", path, key))
+			continue
+		}
+		if err := f.set(fmt.Sprint(value)); err != nil {
+			problems = append(problems, fmt.Errorf("%s: %s: %w", path, key, err))
+		}
+	}
+	return errors.Join(problems...)
+}
+
+// field is one setting of a Config, found through its struct tag.
+type field struct {
+	key   string
+	usage string
+	value reflect.Value
+}
+
+func (c *Config) fields() []field {
+	v := reflect.ValueOf(c).Elem()
+	t := v.Type()
+	fields := make([]field, 0, t.NumField())
+	for i := 0; i < t.NumField(); i++ {
+		key := t.Field(i).Tag.Get("config")
+		if key == "" {
+			continue
+		}
+		fields = append(fields, field{
+			key:   key,
+			usage: t.Field(i).Tag.Get("usage"),
+			value: v.Field(i),
+		})
+	}
+	return fields
+}
+
+// set parses s into the field. Every source goes through here, so "30s" is
+// a valid duration in files, environment variables and flags alike. An empty
+// string resets the field to its zero value, which for most settings means
+// unset or derived from the others.
+func (f field) set(s string) error {
+	if s == "" {
+		f.value.SetZero()
+		return nil
+	}
+	switch f.value.Interface().(type) {
+	case string:
+		f.value.SetString(s)
+	case bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return fmt.Errorf("%q isn't true or false", s)
+		}
+		f.value.SetBool(b)
+	case time.Duration:
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return fmt.Errorf("%q isn't a duration like 30s or 1h", s)
+		}
+		f.value.SetInt(int64(d))
+	case int64:
+		n, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return fmt.Errorf("%q isn't a whole number", s)
+		}
+		f.value.SetInt(n)
+	default:
+		return fmt.Errorf("unsupported setting type %s", f.value.Type())
+	}
+	return nil
+}
+
+func envName(key string) string {
+	return strings.ToUpper(key)
+}
+
+func flagName(key string) string {
+	return strings.ReplaceAll(key, "_", "-")
+}
+
+// flagValue keeps a flag's raw value, so flags are applied after the file
+// and environment whatever order they're parsed in.
+type flagValue struct {
+	raw    string
+	set    bool
+	isBool bool
+}
+
+func (v *flagValue) String() string {
+	return v.raw
+}
+
+func (v *flagValue) Set(s string) error {
+	v.raw = s
+	v.set = true
+	return nil
+}
+
+// IsBoolFlag lets boolean settings be given as a bare -flag.
+func (v *flagValue) IsBoolFlag() bool {
+	return v.isBool
+}
@@ -0,0 +1,174 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// setEnv replaces the environment Load sees with env, so settings from the
+// machine running the tests don't leak in. It's undone when the test ends.
+func setEnv(t *testing.T, env map[string]string) {
+	t.Helper()
+	cfg := Default()
+	keys := []string{"CONFIG_FILE"}
+	for _, f := range cfg.fields() {
+		keys = append(keys, envName(f.key))
+	}
+	for _, key := range keys {
+		t.Setenv(key, "")
+		os.Unsetenv(key)
+	}
+	for key, value := range env {
+		t.Setenv(key, value)
+	}
+}
+
+// minimalEnv is enough for Validate to pass.
+func minimalEnv() map[string]string {
+	return map[string]string{
+		"DB_PATH":         "tubely.db",
+		"JWT_SECRET":      "secret",
+		"PLATFORM":        "dev",
+		"FILEPATH_ROOT":   "./app",
+		"ASSETS_ROOT":     "./assets",
+		"PORT":            "8091",
+		"STORAGE_BACKEND": "local",
+	}
+}
+
+func writeConfigFile(t *testing.T, name, contents string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(contents), 0o600); err != nil {
+		t.Fatalf("writing config file: %v", err)
+	}
+	return path
+}
+
+func TestLoadPrecedence(t *testing.T) {
+	tests := []struct {
+		name string
+		file string
+		env  map[string]string
+		args []string
+		get  func(Config) any
+		want any
+	}{
+		{
+			name: "default",
+			get:  func(c Config) any { return c.LogLevel },
+			want: "info",
+		},
+		{
+			name: "file over default",
+			file: "log_level: debug\n",
+			get:  func(c Config) any { return c.LogLevel },
+			want: "debug",
+		},
+		{
+			name: "env over file",
+			file: "log_level: debug\n",
+			env:  map[string]string{"LOG_LEVEL": "warn"},
+			get:  func(c Config) any { return c.LogLevel },
+			want: "warn",
+		},
+		{
+			name: "flag over env",
+			file: "log_level: debug\n",
+			env:  map[string]string{"LOG_LEVEL": "warn"},
+			args: []string{"-log-level", "error"},
+			get:  func(c Config) any { return c.LogLevel },
+			want: "error",
+		},
+		{
+			name: "durations parse the same everywhere",
+			file: "url_ttl: 10m\n",
+			env:  map[string]string{"URL_TTL": "20m"},
+			get:  func(c Config) any { return c.URLTTL },
+			want: 20 * time.Minute,
+		},
+		{
+			name: "empty env clears file",
+			file: "public_assets_url: https://cdn.example.com\n",
+			env:  map[string]string{"PUBLIC_ASSETS_URL": ""},
+			get:  func(c Config) any { return c.PublicAssetsURL },
+			want: "http://localhost:8091/media",
+		},
+		{
+			name: "empty env clears a bool",
+			file: "cors_allow_credentials: true\n",
+			env:  map[string]string{"CORS_ALLOW_CREDENTIALS": ""},
+			get:  func(c Config) any { return c.CORSAllowCredentials },
+			want: false,
+		},
+		{
+			name: "bare bool flag",
+			args: []string{"-cors-allow-credentials"},
+			get:  func(c Config) any { return c.CORSAllowCredentials },
+			want: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			env := minimalEnv()
+			for key, value := range tt.env {
+				env[key] = value
+			}
+			if tt.file != "" {
+				env["CONFIG_FILE"] = writeConfigFile(t, "tubely.yaml", tt.file)
+			}
+			setEnv(t, env)
+
+			cfg, _, err := Load(tt.args)
+			if err != nil {
+				t.Fatalf("Load: %v", err)
+			}
+			if got := tt.get(cfg); got != tt.want {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoadTOMLAndArgs(t *testing.T) {
+	env := minimalEnv()
+	setEnv(t, env)
+	path := writeConfigFile(t, "tubely.toml", "log_level = \"debug\"\nquota_max_videos = 5\n")
+
+	cfg, rest, err := Load([]string{"-config", path, "migrate-assets", "-dry-run"})
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if cfg.LogLevel != "debug" || cfg.QuotaMaxVideos != 5 {
+		t.Errorf("LogLevel = %q, QuotaMaxVideos = %d, want debug and 5", cfg.LogLevel, cfg.QuotaMaxVideos)
+	}
+	if strings.Join(rest, " ") != "migrate-assets -dry-run" {
+		t.Errorf("remaining args = %q, want the subcommand and its flags", rest)
+	}
+}
+
+func TestLoadReportsEveryProblem(t *testing.T) {
+	env := minimalEnv()
+	delete(env, "JWT_SECRET")
+	env["URL_TTL"] = "soon"
+	env["CONFIG_FILE"] = writeConfigFile(t, "tubely.yaml", "log_levle: debug\n")
+	setEnv(t, env)
+
+	_, _, err := Load([]string{"-quota-max-videos", "many"})
+	if err == nil {
+		t.Fatal("Load accepted a broken configuration")
+	}
+	for _, want := range []string{
+		`unknown setting "log_levle"`,
+		"URL_TTL: \"soon\" isn't a duration",
+		"-quota-max-videos: \"many\" isn't a whole number",
+		"JWT_SECRET is required",
+	} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("error %q doesn't mention %q", err, want)
+		}
+	}
+}
@@ -1,22 +1,52 @@
 package database
 
 import (
+	"context"
 	"database/sql"
+	"database/sql/driver"
+	"errors"
 	"fmt"
 
-	_ "github.com/mattn/go-sqlite3"
+	"github.com/XSAM/otelsql"
+	"github.com/mattn/go-sqlite3"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
+// ErrNotFound is returned by lookups that match no row.
+var ErrNotFound = errors.New("not found")
+
+// ErrAlreadyExists is returned by inserts that would repeat a unique value,
+// such as the email of an existing user.
+var ErrAlreadyExists = errors.New("already exists")
+
+// uniqueViolation turns a UNIQUE constraint failure into ErrAlreadyExists
+// and returns other errors as they are.
+func uniqueViolation(err error) error {
+	var sqliteErr sqlite3.Error
+	if errors.As(err, &sqliteErr) && sqliteErr.ExtendedCode == sqlite3.ErrConstraintUnique {
+		return fmt.Errorf("%w: %w", ErrAlreadyExists, err)
+	}
+	return err
+}
+
 type Client struct {
 	db *sql.DB
 }
 
 func NewClient(pathToDB string) (Client, error) {
-	db, err := sql.Open("sqlite3", pathToDB)
+	db, err := otelsql.Open("sqlite3", pathToDB,
+		otelsql.WithAttributes(attribute.String("db.system.name", "sqlite")),
+		otelsql.WithSpanOptions(otelsql.SpanOptions{
+			OmitConnResetSession: true,
+			OmitRows:             true,
+			SpanFilter:           tracedQuery,
+		}),
+	)
 	if err != nil {
 		return Client{}, err
 	}
-	c := Client{db}
+	c := Client{db: db}
 	err = c.autoMigrate()
 	if err != nil {
 		return Client{}, err
@@ -25,6 +55,22 @@ func NewClient(pathToDB string) (Client, error) {
 
 }
 
+func (c Client) Close() error {
+	return c.db.Close()
+}
+
+// Ping checks the database can still be queried.
+func (c Client) Ping(ctx context.Context) error {
+	var one int
+	return c.db.QueryRowContext(ctx, "SELECT 1").Scan(&one)
+}
+
+// tracedQuery only traces queries that are part of a trace already, so
+// migrations and command-line tasks don't make one trace per query.
+func tracedQuery(ctx context.Context, method otelsql.Method, query string, args []driver.NamedValue) bool {
+	return trace.SpanContextFromContext(ctx).IsValid()
+}
+
 func (c *Client) autoMigrate() error {
 	userTable := `
 	CREATE TABLE IF NOT EXISTS users (
@@ -39,6 +85,12 @@ func (c *Client) autoMigrate() error {
 	if err != nil {
 		return err
 	}
+	// Emails are looked up case-insensitively, addresses saved before they
+	// were lowercased still match.
+	_, err = c.db.Exec("CREATE INDEX IF NOT EXISTS users_email_nocase_idx ON users(email COLLATE NOCASE)")
+	if err != nil {
+		return err
+	}
 	refreshTokenTable := `
 	CREATE TABLE IF NOT EXISTS refresh_tokens (
 		token TEXT PRIMARY KEY,
@@ -72,18 +124,313 @@ func (c *Client) autoMigrate() error {
 	if err != nil {
 		return err
 	}
+
+	err = c.addColumnIfMissing("videos", "url_ttl_seconds", "INTEGER")
+	if err != nil {
+		return err
+	}
+
+	err = c.addColumnIfMissing("videos", "thumbnail_variants", "TEXT")
+	if err != nil {
+		return err
+	}
+
+	err = c.addColumnIfMissing("videos", "visibility", "TEXT NOT NULL DEFAULT 'private'")
+	if err != nil {
+		return err
+	}
+
+	_, err = c.db.Exec("CREATE INDEX IF NOT EXISTS videos_visibility_created_at ON videos(visibility, created_at)")
+	if err != nil {
+		return err
+	}
+
+	shareTokenTable := `
+	CREATE TABLE IF NOT EXISTS video_share_tokens (
+		id TEXT PRIMARY KEY,
+		token_hash TEXT UNIQUE NOT NULL,
+		video_id TEXT NOT NULL,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		expires_at TIMESTAMP,
+		revoked_at TIMESTAMP,
+		FOREIGN KEY(video_id) REFERENCES videos(id)
+	);
+	`
+	_, err = c.db.Exec(shareTokenTable)
+	if err != nil {
+		return err
+	}
+
+	storageObjectTable := `
+	CREATE TABLE IF NOT EXISTS storage_objects (
+		id TEXT PRIMARY KEY,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		backend TEXT NOT NULL,
+		bucket TEXT NOT NULL,
+		key TEXT NOT NULL,
+		size INTEGER NOT NULL DEFAULT 0,
+		checksum TEXT NOT NULL DEFAULT '',
+		content_type TEXT NOT NULL
+	);
+	`
+	_, err = c.db.Exec(storageObjectTable)
+	if err != nil {
+		return err
+	}
+
+	err = c.addColumnIfMissing("videos", "video_object_id", "TEXT REFERENCES storage_objects(id)")
+	if err != nil {
+		return err
+	}
+
+	err = c.migrateVideoLocations()
+	if err != nil {
+		return err
+	}
+
+	passwordResetTokenTable := `
+	CREATE TABLE IF NOT EXISTS password_reset_tokens (
+		token_hash TEXT PRIMARY KEY,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		used_at TIMESTAMP,
+		user_id TEXT NOT NULL,
+		expires_at TIMESTAMP NOT NULL,
+		FOREIGN KEY(user_id) REFERENCES users(id)
+	);
+	`
+	_, err = c.db.Exec(passwordResetTokenTable)
+	if err != nil {
+		return err
+	}
+
+	err = c.addColumnIfMissing("users", "verified_at", "TIMESTAMP")
+	if err != nil {
+		return err
+	}
+
+	emailVerificationTokenTable := `
+	CREATE TABLE IF NOT EXISTS email_verification_tokens (
+		token_hash TEXT PRIMARY KEY,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		used_at TIMESTAMP,
+		user_id TEXT NOT NULL,
+		expires_at TIMESTAMP NOT NULL,
+		FOREIGN KEY(user_id) REFERENCES users(id)
+	);
+	`
+	_, err = c.db.Exec(emailVerificationTokenTable)
+	if err != nil {
+		return err
+	}
+
+	loginAttemptTable := `
+	CREATE TABLE IF NOT EXISTS login_attempts (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		created_at TIMESTAMP NOT NULL,
+		email TEXT NOT NULL,
+		ip_address TEXT NOT NULL,
+		user_agent TEXT,
+		succeeded BOOLEAN NOT NULL
+	);
+	CREATE INDEX IF NOT EXISTS login_attempts_email_idx ON login_attempts(email, created_at);
+	CREATE INDEX IF NOT EXISTS login_attempts_ip_idx ON login_attempts(ip_address, created_at);
+	CREATE INDEX IF NOT EXISTS login_attempts_created_at_idx ON login_attempts(created_at);
+	`
+	_, err = c.db.Exec(loginAttemptTable)
+	if err != nil {
+		return err
+	}
+
+	totpTable := `
+	CREATE TABLE IF NOT EXISTS user_totp (
+		user_id TEXT PRIMARY KEY,
+		secret TEXT NOT NULL,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		confirmed_at TIMESTAMP,
+		last_used_step INTEGER NOT NULL DEFAULT 0,
+		FOREIGN KEY(user_id) REFERENCES users(id)
+	);
+	`
+	_, err = c.db.Exec(totpTable)
+	if err != nil {
+		return err
+	}
+
+	recoveryCodeTable := `
+	CREATE TABLE IF NOT EXISTS recovery_codes (
+		code_hash TEXT PRIMARY KEY,
+		user_id TEXT NOT NULL,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		used_at TIMESTAMP,
+		FOREIGN KEY(user_id) REFERENCES users(id)
+	);
+	`
+	_, err = c.db.Exec(recoveryCodeTable)
+	if err != nil {
+		return err
+	}
+
+	oidcLoginStateTable := `
+	CREATE TABLE IF NOT EXISTS oidc_login_states (
+		state TEXT PRIMARY KEY,
+		nonce TEXT NOT NULL,
+		code_verifier TEXT NOT NULL,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		expires_at TIMESTAMP NOT NULL
+	);
+	`
+	_, err = c.db.Exec(oidcLoginStateTable)
+	if err != nil {
+		return err
+	}
+
+	err = c.addColumnIfMissing("oidc_login_states", "link_user_id", "TEXT")
+	if err != nil {
+		return err
+	}
+
+	oidcLoginCodeTable := `
+	CREATE TABLE IF NOT EXISTS oidc_login_codes (
+		code_hash TEXT PRIMARY KEY,
+		user_id TEXT NOT NULL,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		expires_at TIMESTAMP NOT NULL,
+		FOREIGN KEY(user_id) REFERENCES users(id)
+	);
+	`
+	_, err = c.db.Exec(oidcLoginCodeTable)
+	if err != nil {
+		return err
+	}
+
+	userIdentityTable := `
+	CREATE TABLE IF NOT EXISTS user_identities (
+		issuer TEXT NOT NULL,
+		subject TEXT NOT NULL,
+		user_id TEXT NOT NULL,
+		email TEXT NOT NULL,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		PRIMARY KEY(issuer, subject),
+		FOREIGN KEY(user_id) REFERENCES users(id)
+	);
+	`
+	_, err = c.db.Exec(userIdentityTable)
+	if err != nil {
+		return err
+	}
+
+	userQuotaTable := `
+	CREATE TABLE IF NOT EXISTS user_quotas (
+		user_id TEXT PRIMARY KEY,
+		max_bytes INTEGER,
+		max_videos INTEGER,
+		updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		FOREIGN KEY(user_id) REFERENCES users(id)
+	);
+	`
+	_, err = c.db.Exec(userQuotaTable)
+	if err != nil {
+		return err
+	}
+
+	userUsageTable := `
+	CREATE TABLE IF NOT EXISTS user_usage (
+		user_id TEXT PRIMARY KEY,
+		bytes_used INTEGER NOT NULL DEFAULT 0,
+		video_count INTEGER NOT NULL DEFAULT 0,
+		FOREIGN KEY(user_id) REFERENCES users(id)
+	);
+	`
+	_, err = c.db.Exec(userUsageTable)
+	if err != nil {
+		return err
+	}
+
+	err = c.backfillUsage()
+	if err != nil {
+		return err
+	}
 	return nil
 }
 
-func (c Client) Reset() error {
-	if _, err := c.db.Exec("DELETE FROM refresh_tokens"); err != nil {
+// addColumnIfMissing adds a column to a table created by an older version of
+// autoMigrate, since SQLite has no ADD COLUMN IF NOT EXISTS.
+func (c *Client) addColumnIfMissing(table, column, definition string) error {
+	rows, err := c.db.Query(fmt.Sprintf("PRAGMA table_info(%s)", table))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			cid        int
+			name       string
+			columnType string
+			notNull    int
+			defaultVal sql.NullString
+			primaryKey int
+		)
+		if err := rows.Scan(&cid, &name, &columnType, &notNull, &defaultVal, &primaryKey); err != nil {
+			return err
+		}
+		if name == column {
+			return nil
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	_, err = c.db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, definition))
+	return err
+}
+
+func (c Client) Reset(ctx context.Context) error {
+	if _, err := c.db.ExecContext(ctx, "DELETE FROM video_share_tokens"); err != nil {
+		return fmt.Errorf("failed to reset table video_share_tokens: %w", err)
+	}
+	if _, err := c.db.ExecContext(ctx, "DELETE FROM user_quotas"); err != nil {
+		return fmt.Errorf("failed to reset table user_quotas: %w", err)
+	}
+	if _, err := c.db.ExecContext(ctx, "DELETE FROM user_usage"); err != nil {
+		return fmt.Errorf("failed to reset table user_usage: %w", err)
+	}
+	if _, err := c.db.ExecContext(ctx, "DELETE FROM oidc_login_states"); err != nil {
+		return fmt.Errorf("failed to reset table oidc_login_states: %w", err)
+	}
+	if _, err := c.db.ExecContext(ctx, "DELETE FROM oidc_login_codes"); err != nil {
+		return fmt.Errorf("failed to reset table oidc_login_codes: %w", err)
+	}
+	if _, err := c.db.ExecContext(ctx, "DELETE FROM user_identities"); err != nil {
+		return fmt.Errorf("failed to reset table user_identities: %w", err)
+	}
+	if _, err := c.db.ExecContext(ctx, "DELETE FROM recovery_codes"); err != nil {
+		return fmt.Errorf("failed to reset table recovery_codes: %w", err)
+	}
+	if _, err := c.db.ExecContext(ctx, "DELETE FROM user_totp"); err != nil {
+		return fmt.Errorf("failed to reset table user_totp: %w", err)
+	}
+	if _, err := c.db.ExecContext(ctx, "DELETE FROM login_attempts"); err != nil {
+		return fmt.Errorf("failed to reset table login_attempts: %w", err)
+	}
+	if _, err := c.db.ExecContext(ctx, "DELETE FROM email_verification_tokens"); err != nil {
+		return fmt.Errorf("failed to reset table email_verification_tokens: %w", err)
+	}
+	if _, err := c.db.ExecContext(ctx, "DELETE FROM password_reset_tokens"); err != nil {
+		return fmt.Errorf("failed to reset table password_reset_tokens: %w", err)
+	}
+	if _, err := c.db.ExecContext(ctx, "DELETE FROM refresh_tokens"); err != nil {
 		return fmt.Errorf("failed to reset table refresh_tokens: %w", err)
 	}
-	if _, err := c.db.Exec("DELETE FROM users"); err != nil {
+	if _, err := c.db.ExecContext(ctx, "DELETE FROM users"); err != nil {
 		return fmt.Errorf("failed to reset table users: %w", err)
 	}
-	if _, err := c.db.Exec("DELETE FROM videos"); err != nil {
+	if _, err := c.db.ExecContext(ctx, "DELETE FROM videos"); err != nil {
 		return fmt.Errorf("failed to reset table videos: %w", err)
 	}
+	if _, err := c.db.ExecContext(ctx, "DELETE FROM storage_objects"); err != nil {
+		return fmt.Errorf("failed to reset table storage_objects: %w", err)
+	}
 	return nil
 }
@@ -0,0 +1,76 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+type CreateEmailVerificationTokenParams struct {
+	TokenHash string    `json:"-"`
+	UserID    uuid.UUID `json:"user_id"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+func (c Client) CreateEmailVerificationToken(ctx context.Context, params CreateEmailVerificationTokenParams) error {
+	query := `
+		INSERT INTO email_verification_tokens (
+			token_hash,
+			created_at,
+			user_id,
+			expires_at
+		) VALUES (?, CURRENT_TIMESTAMP, ?, ?)
+	`
+	_, err := c.db.ExecContext(ctx, query, params.TokenHash, params.UserID.String(), params.ExpiresAt)
+	return err
+}
+
+// VerifyEmailWithToken consumes a verification token and marks the owning
+// user's email as verified. It returns ErrNotFound when the token is
+// unknown, expired or was already used.
+func (c Client) VerifyEmailWithToken(ctx context.Context, tokenHash string) (uuid.UUID, error) {
+	tx, err := c.db.BeginTx(ctx, nil)
+	if err != nil {
+		return uuid.Nil, err
+	}
+	defer tx.Rollback()
+
+	var userID string
+	err = tx.QueryRowContext(ctx, `
+		SELECT user_id
+		FROM email_verification_tokens
+		WHERE token_hash = ? AND used_at IS NULL AND expires_at > ?
+	`, tokenHash, time.Now().UTC()).Scan(&userID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return uuid.Nil, ErrNotFound
+		}
+		return uuid.Nil, err
+	}
+
+	_, err = tx.ExecContext(ctx, `
+		UPDATE email_verification_tokens
+		SET used_at = CURRENT_TIMESTAMP
+		WHERE user_id = ? AND used_at IS NULL
+	`, userID)
+	if err != nil {
+		return uuid.Nil, err
+	}
+
+	_, err = tx.ExecContext(ctx, `
+		UPDATE users
+		SET verified_at = COALESCE(verified_at, CURRENT_TIMESTAMP), updated_at = CURRENT_TIMESTAMP
+		WHERE id = ?
+	`, userID)
+	if err != nil {
+		return uuid.Nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return uuid.Nil, err
+	}
+	return uuid.Parse(userID)
+}
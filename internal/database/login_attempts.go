@@ -0,0 +1,84 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+)
+
+type LoginAttempt struct {
+	ID        int64     `json:"id"`
+	CreatedAt time.Time `json:"created_at"`
+	CreateLoginAttemptParams
+}
+
+type CreateLoginAttemptParams struct {
+	Email     string `json:"email"`
+	IPAddress string `json:"ip_address"`
+	UserAgent string `json:"user_agent"`
+	Succeeded bool   `json:"succeeded"`
+}
+
+// LoginFailures summarises recent failed logins for an account or address.
+type LoginFailures struct {
+	Count int
+	Last  time.Time
+}
+
+func (c Client) CreateLoginAttempt(ctx context.Context, params CreateLoginAttemptParams) error {
+	query := `
+		INSERT INTO login_attempts (
+			created_at,
+			email,
+			ip_address,
+			user_agent,
+			succeeded
+		) VALUES (?, ?, ?, ?, ?)
+	`
+	_, err := c.db.ExecContext(ctx, query, time.Now().UTC(), params.Email, params.IPAddress, params.UserAgent, params.Succeeded)
+	return err
+}
+
+// DeleteLoginAttemptsBefore deletes attempts made before t, which no
+// longer count towards any throttle.
+func (c Client) DeleteLoginAttemptsBefore(ctx context.Context, t time.Time) error {
+	_, err := c.db.ExecContext(ctx, "DELETE FROM login_attempts WHERE created_at < ?", t.UTC())
+	return err
+}
+
+// GetLoginFailuresByEmail counts failed logins for an email since the given
+// time, ignoring failures that happened before the last successful login.
+func (c Client) GetLoginFailuresByEmail(ctx context.Context, email string, since time.Time) (LoginFailures, error) {
+	return c.getLoginFailures(ctx, `
+		WHERE email = ? AND succeeded = 0 AND created_at > ?
+		AND created_at > COALESCE(
+			(SELECT MAX(created_at) FROM login_attempts WHERE email = ? AND succeeded = 1),
+			''
+		)
+	`, email, since.UTC(), email)
+}
+
+func (c Client) GetLoginFailuresByIP(ctx context.Context, ipAddress string, since time.Time) (LoginFailures, error) {
+	return c.getLoginFailures(ctx, `
+		WHERE ip_address = ? AND succeeded = 0 AND created_at > ?
+	`, ipAddress, since.UTC())
+}
+
+func (c Client) getLoginFailures(ctx context.Context, where string, args ...interface{}) (LoginFailures, error) {
+	var failures LoginFailures
+	err := c.db.QueryRowContext(ctx, "SELECT COUNT(*) FROM login_attempts "+where, args...).Scan(&failures.Count)
+	if err != nil {
+		return LoginFailures{}, err
+	}
+	if failures.Count == 0 {
+		return failures, nil
+	}
+
+	err = c.db.QueryRowContext(ctx, "SELECT created_at FROM login_attempts "+where+" ORDER BY created_at DESC LIMIT 1", args...).
+		Scan(&failures.Last)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return LoginFailures{}, err
+	}
+	return failures, nil
+}
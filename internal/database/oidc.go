@@ -0,0 +1,243 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// OIDCLoginState holds what we need to finish an authorization-code login
+// once the identity provider redirects back. LinkUserID is set when a
+// logged-in user is linking the identity to their account.
+type OIDCLoginState struct {
+	State        string     `json:"state"`
+	Nonce        string     `json:"-"`
+	CodeVerifier string     `json:"-"`
+	LinkUserID   *uuid.UUID `json:"link_user_id"`
+	ExpiresAt    time.Time  `json:"expires_at"`
+}
+
+type UserIdentity struct {
+	Issuer    string    `json:"issuer"`
+	Subject   string    `json:"subject"`
+	UserID    uuid.UUID `json:"user_id"`
+	Email     string    `json:"email"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+func (c Client) CreateOIDCLoginState(ctx context.Context, state OIDCLoginState) error {
+	query := `
+		INSERT INTO oidc_login_states (state, nonce, code_verifier, link_user_id, created_at, expires_at)
+		VALUES (?, ?, ?, ?, CURRENT_TIMESTAMP, ?)
+	`
+	var linkUserID sql.NullString
+	if state.LinkUserID != nil {
+		linkUserID = sql.NullString{String: state.LinkUserID.String(), Valid: true}
+	}
+	_, err := c.db.ExecContext(ctx, query, state.State, state.Nonce, state.CodeVerifier, linkUserID, state.ExpiresAt.UTC())
+	return err
+}
+
+// ConsumeOIDCLoginState returns and deletes a pending login so each state can
+// only be used once. It returns ErrNotFound if the state is unknown or
+// expired.
+func (c Client) ConsumeOIDCLoginState(ctx context.Context, state string) (*OIDCLoginState, error) {
+	tx, err := c.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var loginState OIDCLoginState
+	var linkUserID sql.NullString
+	err = tx.QueryRowContext(ctx, `
+		SELECT state, nonce, code_verifier, link_user_id, expires_at
+		FROM oidc_login_states
+		WHERE state = ?
+	`, state).Scan(&loginState.State, &loginState.Nonce, &loginState.CodeVerifier, &linkUserID, &loginState.ExpiresAt)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrNotFound
+		}
+		return nil, err
+	}
+	if linkUserID.Valid {
+		id, err := uuid.Parse(linkUserID.String)
+		if err != nil {
+			return nil, err
+		}
+		loginState.LinkUserID = &id
+	}
+
+	_, err = tx.ExecContext(ctx, "DELETE FROM oidc_login_states WHERE state = ? OR expires_at < ?", state, time.Now().UTC())
+	if err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	if time.Now().After(loginState.ExpiresAt) {
+		return nil, ErrNotFound
+	}
+	return &loginState, nil
+}
+
+// CreateOIDCLoginCode saves the one-time code the app exchanges for a
+// session after a single sign-on login.
+func (c Client) CreateOIDCLoginCode(ctx context.Context, codeHash string, userID uuid.UUID, expiresAt time.Time) error {
+	query := `
+		INSERT INTO oidc_login_codes (code_hash, user_id, created_at, expires_at)
+		VALUES (?, ?, CURRENT_TIMESTAMP, ?)
+	`
+	_, err := c.db.ExecContext(ctx, query, codeHash, userID.String(), expiresAt.UTC())
+	return err
+}
+
+// ConsumeOIDCLoginCode deletes a login code and returns the user it was
+// issued for. It returns ErrNotFound if the code is unknown, expired or
+// was already used.
+func (c Client) ConsumeOIDCLoginCode(ctx context.Context, codeHash string) (uuid.UUID, error) {
+	tx, err := c.db.BeginTx(ctx, nil)
+	if err != nil {
+		return uuid.Nil, err
+	}
+	defer tx.Rollback()
+
+	var userID string
+	err = tx.QueryRowContext(ctx, `
+		SELECT user_id
+		FROM oidc_login_codes
+		WHERE code_hash = ? AND expires_at > ?
+	`, codeHash, time.Now().UTC()).Scan(&userID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return uuid.Nil, ErrNotFound
+		}
+		return uuid.Nil, err
+	}
+
+	res, err := tx.ExecContext(ctx, "DELETE FROM oidc_login_codes WHERE code_hash = ?", codeHash)
+	if err != nil {
+		return uuid.Nil, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return uuid.Nil, err
+	}
+	if n != 1 {
+		return uuid.Nil, ErrNotFound
+	}
+	_, err = tx.ExecContext(ctx, "DELETE FROM oidc_login_codes WHERE expires_at < ?", time.Now().UTC())
+	if err != nil {
+		return uuid.Nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return uuid.Nil, err
+	}
+	return uuid.Parse(userID)
+}
+
+func (c Client) GetUserIdentity(ctx context.Context, issuer, subject string) (*UserIdentity, error) {
+	query := `
+		SELECT issuer, subject, user_id, email, created_at
+		FROM user_identities
+		WHERE issuer = ? AND subject = ?
+	`
+	var identity UserIdentity
+	var userID string
+	err := c.db.QueryRowContext(ctx, query, issuer, subject).
+		Scan(&identity.Issuer, &identity.Subject, &userID, &identity.Email, &identity.CreatedAt)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrNotFound
+		}
+		return nil, err
+	}
+	identity.UserID, err = uuid.Parse(userID)
+	if err != nil {
+		return nil, err
+	}
+	return &identity, nil
+}
+
+// ErrIdentityLinked is returned when linking an identity that belongs to
+// another user.
+var ErrIdentityLinked = errors.New("identity is linked to another user")
+
+// CreateUserIdentity links an identity to an existing user.
+func (c Client) CreateUserIdentity(ctx context.Context, identity UserIdentity) error {
+	tx, err := c.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	err = insertUserIdentity(ctx, tx, identity)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// CreateOIDCUser provisions a user signing up through single sign-on: the
+// account, its identity and the verified email are saved together, so a
+// failure doesn't leave a user nobody can log in as.
+func (c Client) CreateOIDCUser(ctx context.Context, params CreateUserParams, identity UserIdentity) (*User, error) {
+	tx, err := c.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	id := uuid.New()
+	_, err = tx.ExecContext(ctx, `
+		INSERT INTO users
+		    (id, created_at, updated_at, verified_at, email, password)
+		VALUES
+		    (?, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP, ?, ?)
+	`, id.String(), params.Email, params.Password)
+	if err != nil {
+		return nil, uniqueViolation(err)
+	}
+
+	identity.UserID = id
+	err = insertUserIdentity(ctx, tx, identity)
+	if err != nil {
+		return nil, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, err
+	}
+	return c.GetUser(ctx, id)
+}
+
+// insertUserIdentity saves an identity. A row left behind by a deleted user
+// is taken over, one belonging to a user who still exists is
+// ErrIdentityLinked.
+func insertUserIdentity(ctx context.Context, tx *sql.Tx, identity UserIdentity) error {
+	result, err := tx.ExecContext(ctx, `
+		INSERT INTO user_identities (issuer, subject, user_id, email, created_at)
+		VALUES (?, ?, ?, ?, CURRENT_TIMESTAMP)
+		ON CONFLICT (issuer, subject) DO UPDATE
+		SET user_id = excluded.user_id, email = excluded.email, created_at = excluded.created_at
+		WHERE NOT EXISTS (SELECT 1 FROM users WHERE users.id = user_identities.user_id)
+	`, identity.Issuer, identity.Subject, identity.UserID.String(), identity.Email)
+	if err != nil {
+		return err
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n != 1 {
+		return ErrIdentityLinked
+	}
+	return nil
+}
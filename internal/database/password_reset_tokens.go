@@ -0,0 +1,91 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+type PasswordResetToken struct {
+	CreatePasswordResetTokenParams
+	CreatedAt time.Time  `json:"created_at"`
+	UsedAt    *time.Time `json:"used_at"`
+}
+
+type CreatePasswordResetTokenParams struct {
+	TokenHash string    `json:"-"`
+	UserID    uuid.UUID `json:"user_id"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+func (c Client) CreatePasswordResetToken(ctx context.Context, params CreatePasswordResetTokenParams) error {
+	query := `
+		INSERT INTO password_reset_tokens (
+			token_hash,
+			created_at,
+			user_id,
+			expires_at
+		) VALUES (?, CURRENT_TIMESTAMP, ?, ?)
+	`
+	_, err := c.db.ExecContext(ctx, query, params.TokenHash, params.UserID.String(), params.ExpiresAt)
+	return err
+}
+
+// ConsumePasswordResetToken marks an unused, unexpired token as used and
+// returns the user it belongs to. It returns ErrNotFound when the
+// token is unknown, expired or was already used.
+func (c Client) ConsumePasswordResetToken(ctx context.Context, tokenHash string) (uuid.UUID, error) {
+	tx, err := c.db.BeginTx(ctx, nil)
+	if err != nil {
+		return uuid.Nil, err
+	}
+	defer tx.Rollback()
+
+	var userID string
+	err = tx.QueryRowContext(ctx, `
+		SELECT user_id
+		FROM password_reset_tokens
+		WHERE token_hash = ? AND used_at IS NULL AND expires_at > ?
+	`, tokenHash, time.Now().UTC()).Scan(&userID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return uuid.Nil, ErrNotFound
+		}
+		return uuid.Nil, err
+	}
+
+	// The conditions are repeated so the token stays single use even if
+	// another request consumed it since the SELECT.
+	res, err := tx.ExecContext(ctx, `
+		UPDATE password_reset_tokens
+		SET used_at = CURRENT_TIMESTAMP
+		WHERE token_hash = ? AND used_at IS NULL AND expires_at > ?
+	`, tokenHash, time.Now().UTC())
+	if err != nil {
+		return uuid.Nil, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return uuid.Nil, err
+	}
+	if n != 1 {
+		return uuid.Nil, ErrNotFound
+	}
+
+	if err := tx.Commit(); err != nil {
+		return uuid.Nil, err
+	}
+	return uuid.Parse(userID)
+}
+
+func (c Client) DeletePasswordResetTokensForUser(ctx context.Context, userID uuid.UUID) error {
+	query := `
+		DELETE FROM password_reset_tokens
+		WHERE user_id = ?
+	`
+	_, err := c.db.ExecContext(ctx, query, userID.String())
+	return err
+}
@@ -0,0 +1,163 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+
+	"github.com/google/uuid"
+)
+
+// Quota limits what a user can store. Zero means unlimited.
+type Quota struct {
+	MaxBytes  int64 `json:"max_bytes"`
+	MaxVideos int   `json:"max_videos"`
+}
+
+// QuotaOverride replaces parts of the default quota for one user. Nil fields
+// fall back to the default.
+type QuotaOverride struct {
+	MaxBytes  *int64 `json:"max_bytes"`
+	MaxVideos *int   `json:"max_videos"`
+}
+
+type Usage struct {
+	Bytes  int64 `json:"bytes_used"`
+	Videos int   `json:"video_count"`
+}
+
+// QuotaError is returned when a change would take a user over their quota.
+type QuotaError struct {
+	Resource  string // "bytes" or "videos"
+	Limit     int64
+	Used      int64
+	Requested int64
+}
+
+func (e *QuotaError) Error() string {
+	return fmt.Sprintf("%s quota exceeded: %d used of %d, %d more requested", e.Resource, e.Used, e.Limit, e.Requested)
+}
+
+// GetQuota returns the user's quota: their override where they have one,
+// defaults otherwise.
+func (c Client) GetQuota(ctx context.Context, userID uuid.UUID, defaults Quota) (Quota, error) {
+	var override QuotaOverride
+	err := c.db.QueryRowContext(ctx, `
+		SELECT max_bytes, max_videos
+		FROM user_quotas
+		WHERE user_id = ?
+	`, userID.String()).Scan(&override.MaxBytes, &override.MaxVideos)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return Quota{}, err
+	}
+
+	quota := defaults
+	if override.MaxBytes != nil {
+		quota.MaxBytes = *override.MaxBytes
+	}
+	if override.MaxVideos != nil {
+		quota.MaxVideos = *override.MaxVideos
+	}
+	return quota, nil
+}
+
+// SetQuotaOverride stores a user's quota override. An override with both
+// fields nil puts the user back on the defaults.
+func (c Client) SetQuotaOverride(ctx context.Context, userID uuid.UUID, override QuotaOverride) error {
+	if override.MaxBytes == nil && override.MaxVideos == nil {
+		_, err := c.db.ExecContext(ctx, "DELETE FROM user_quotas WHERE user_id = ?", userID.String())
+		return err
+	}
+	_, err := c.db.ExecContext(ctx, `
+		INSERT INTO user_quotas (user_id, max_bytes, max_videos, updated_at)
+		VALUES (?, ?, ?, CURRENT_TIMESTAMP)
+		ON CONFLICT(user_id) DO UPDATE SET
+			max_bytes = excluded.max_bytes,
+			max_videos = excluded.max_videos,
+			updated_at = CURRENT_TIMESTAMP
+	`, userID.String(), override.MaxBytes, override.MaxVideos)
+	return err
+}
+
+func (c Client) GetUsage(ctx context.Context, userID uuid.UUID) (Usage, error) {
+	var usage Usage
+	err := c.db.QueryRowContext(ctx, `
+		SELECT bytes_used, video_count
+		FROM user_usage
+		WHERE user_id = ?
+	`, userID.String()).Scan(&usage.Bytes, &usage.Videos)
+	if errors.Is(err, sql.ErrNoRows) {
+		return Usage{}, nil
+	}
+	return usage, err
+}
+
+// addUsage changes a user's usage inside tx. Increases are refused with a
+// *QuotaError if they'd exceed quota; the check and the update are a single
+// statement, so concurrent uploads can't both squeeze under the limit.
+func addUsage(ctx context.Context, tx *sql.Tx, userID uuid.UUID, bytes int64, videos int, quota Quota) error {
+	_, err := tx.ExecContext(ctx, `
+		INSERT INTO user_usage (user_id, bytes_used, video_count)
+		VALUES (?, 0, 0)
+		ON CONFLICT(user_id) DO NOTHING
+	`, userID.String())
+	if err != nil {
+		return err
+	}
+
+	result, err := tx.ExecContext(ctx, `
+		UPDATE user_usage
+		SET
+			bytes_used = MAX(bytes_used + ?, 0),
+			video_count = MAX(video_count + ?, 0)
+		WHERE user_id = ?
+			AND (? <= 0 OR ? = 0 OR bytes_used + ? <= ?)
+			AND (? <= 0 OR ? = 0 OR video_count + ? <= ?)
+	`,
+		bytes, videos, userID.String(),
+		bytes, quota.MaxBytes, bytes, quota.MaxBytes,
+		videos, quota.MaxVideos, videos, quota.MaxVideos,
+	)
+	if err != nil {
+		return err
+	}
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected == 1 {
+		return nil
+	}
+
+	var usage Usage
+	err = tx.QueryRowContext(ctx, "SELECT bytes_used, video_count FROM user_usage WHERE user_id = ?", userID.String()).Scan(&usage.Bytes, &usage.Videos)
+	if err != nil {
+		return err
+	}
+	if bytes > 0 && quota.MaxBytes > 0 && usage.Bytes+bytes > quota.MaxBytes {
+		return &QuotaError{Resource: "bytes", Limit: quota.MaxBytes, Used: usage.Bytes, Requested: bytes}
+	}
+	return &QuotaError{Resource: "videos", Limit: int64(quota.MaxVideos), Used: int64(usage.Videos), Requested: int64(videos)}
+}
+
+// backfillUsage creates usage rows for users who don't have one yet, counting
+// what they already store. It runs at startup so databases from before
+// quotas existed start out with correct numbers.
+func (c *Client) backfillUsage() error {
+	_, err := c.db.Exec(`
+		INSERT INTO user_usage (user_id, bytes_used, video_count)
+		SELECT
+			u.id,
+			COALESCE((
+				SELECT SUM(o.size)
+				FROM videos v
+				JOIN storage_objects o ON o.id = v.video_object_id
+				WHERE v.user_id = u.id
+			), 0),
+			(SELECT COUNT(*) FROM videos v WHERE v.user_id = u.id)
+		FROM users u
+		WHERE u.id NOT IN (SELECT user_id FROM user_usage)
+	`)
+	return err
+}
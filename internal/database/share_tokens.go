@@ -0,0 +1,111 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// ShareToken lets someone without an account watch an unlisted video. Only
+// the token's hash is stored.
+type ShareToken struct {
+	ID        uuid.UUID  `json:"id"`
+	CreatedAt time.Time  `json:"created_at"`
+	RevokedAt *time.Time `json:"revoked_at"`
+	CreateShareTokenParams
+}
+
+type CreateShareTokenParams struct {
+	TokenHash string    `json:"-"`
+	VideoID   uuid.UUID `json:"video_id"`
+	// ExpiresAt is nil for tokens that last until revoked.
+	ExpiresAt *time.Time `json:"expires_at"`
+}
+
+func (c Client) CreateShareToken(ctx context.Context, params CreateShareTokenParams) (ShareToken, error) {
+	id := uuid.New()
+	_, err := c.db.ExecContext(ctx, `
+		INSERT INTO video_share_tokens (id, token_hash, video_id, created_at, expires_at)
+		VALUES (?, ?, ?, CURRENT_TIMESTAMP, ?)
+	`, id, params.TokenHash, params.VideoID, params.ExpiresAt)
+	if err != nil {
+		return ShareToken{}, err
+	}
+
+	tokens, err := c.queryShareTokens(ctx, "WHERE id = ?", id)
+	if err != nil {
+		return ShareToken{}, err
+	}
+	if len(tokens) == 0 {
+		return ShareToken{}, errors.New("share token vanished after insert")
+	}
+	return tokens[0], nil
+}
+
+func (c Client) GetShareTokens(ctx context.Context, videoID uuid.UUID) ([]ShareToken, error) {
+	return c.queryShareTokens(ctx, "WHERE video_id = ? ORDER BY created_at", videoID)
+}
+
+// ShareTokenGrantsAccess reports whether tokenHash belongs to an unexpired,
+// unrevoked token for the video.
+func (c Client) ShareTokenGrantsAccess(ctx context.Context, videoID uuid.UUID, tokenHash string) (bool, error) {
+	var id uuid.UUID
+	err := c.db.QueryRowContext(ctx, `
+		SELECT id
+		FROM video_share_tokens
+		WHERE token_hash = ?
+			AND video_id = ?
+			AND revoked_at IS NULL
+			AND (expires_at IS NULL OR expires_at > ?)
+	`, tokenHash, videoID, time.Now().UTC()).Scan(&id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// RevokeShareToken revokes one of the video's tokens. It returns false if
+// the video has no such token.
+func (c Client) RevokeShareToken(ctx context.Context, videoID, id uuid.UUID) (bool, error) {
+	result, err := c.db.ExecContext(ctx, `
+		UPDATE video_share_tokens
+		SET revoked_at = ?
+		WHERE id = ? AND video_id = ? AND revoked_at IS NULL
+	`, time.Now().UTC(), id, videoID)
+	if err != nil {
+		return false, err
+	}
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return affected > 0, nil
+}
+
+func (c Client) queryShareTokens(ctx context.Context, where string, args ...interface{}) ([]ShareToken, error) {
+	rows, err := c.db.QueryContext(ctx, `
+		SELECT id, created_at, revoked_at, token_hash, video_id, expires_at
+		FROM video_share_tokens
+		`+where, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	tokens := []ShareToken{}
+	for rows.Next() {
+		var token ShareToken
+		err := rows.Scan(&token.ID, &token.CreatedAt, &token.RevokedAt, &token.TokenHash, &token.VideoID, &token.ExpiresAt)
+		if err != nil {
+			return nil, err
+		}
+		tokens = append(tokens, token)
+	}
+	return tokens, rows.Err()
+}
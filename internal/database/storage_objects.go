@@ -0,0 +1,246 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// StorageObject records where a media file lives. It's never exposed through
+// the API, handlers turn it into playback URLs instead.
+type StorageObject struct {
+	ID        uuid.UUID `json:"id"`
+	CreatedAt time.Time `json:"created_at"`
+	CreateStorageObjectParams
+}
+
+type CreateStorageObjectParams struct {
+	Backend     string `json:"backend"`
+	Bucket      string `json:"bucket"`
+	Key         string `json:"key"`
+	Size        int64  `json:"size"`
+	Checksum    string `json:"checksum"`
+	ContentType string `json:"content_type"`
+}
+
+func (c Client) GetStorageObject(ctx context.Context, id uuid.UUID) (*StorageObject, error) {
+	query := `
+		SELECT id, created_at, backend, bucket, key, size, checksum, content_type
+		FROM storage_objects
+		WHERE id = ?
+	`
+	var object StorageObject
+	err := c.db.QueryRowContext(ctx, query, id.String()).Scan(
+		&object.ID,
+		&object.CreatedAt,
+		&object.Backend,
+		&object.Bucket,
+		&object.Key,
+		&object.Size,
+		&object.Checksum,
+		&object.ContentType,
+	)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrNotFound
+		}
+		return nil, err
+	}
+	return &object, nil
+}
+
+// SetVideoObject stores a new file location and points the video at it,
+// charging the size difference to the owner's quota. It fails with a
+// *QuotaError if the new file doesn't fit. The object the video used before,
+// if any, is returned so the caller can remove the file from storage.
+func (c Client) SetVideoObject(ctx context.Context, videoID uuid.UUID, params CreateStorageObjectParams, quota Quota) (StorageObject, *StorageObject, error) {
+	tx, err := c.db.BeginTx(ctx, nil)
+	if err != nil {
+		return StorageObject{}, nil, err
+	}
+	defer tx.Rollback()
+
+	var userID uuid.UUID
+	var previousID *uuid.UUID
+	err = tx.QueryRowContext(ctx, "SELECT user_id, video_object_id FROM videos WHERE id = ?", videoID.String()).Scan(&userID, &previousID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return StorageObject{}, nil, ErrNotFound
+	}
+	if err != nil {
+		return StorageObject{}, nil, err
+	}
+
+	var previous *StorageObject
+	if previousID != nil {
+		previous = &StorageObject{}
+		err = tx.QueryRowContext(ctx, `
+			SELECT id, created_at, backend, bucket, key, size, checksum, content_type
+			FROM storage_objects
+			WHERE id = ?
+		`, previousID.String()).Scan(
+			&previous.ID,
+			&previous.CreatedAt,
+			&previous.Backend,
+			&previous.Bucket,
+			&previous.Key,
+			&previous.Size,
+			&previous.Checksum,
+			&previous.ContentType,
+		)
+		if err != nil {
+			return StorageObject{}, nil, err
+		}
+	}
+
+	id := uuid.New()
+	err = insertStorageObject(ctx, tx, id, params)
+	if err != nil {
+		return StorageObject{}, nil, err
+	}
+
+	_, err = tx.ExecContext(ctx, `
+		UPDATE videos
+		SET video_object_id = ?, updated_at = CURRENT_TIMESTAMP
+		WHERE id = ?
+	`, id.String(), videoID.String())
+	if err != nil {
+		return StorageObject{}, nil, err
+	}
+
+	delta := params.Size
+	if previous != nil {
+		_, err = tx.ExecContext(ctx, "DELETE FROM storage_objects WHERE id = ?", previous.ID.String())
+		if err != nil {
+			return StorageObject{}, nil, err
+		}
+		delta -= previous.Size
+	}
+
+	err = addUsage(ctx, tx, userID, delta, 0, quota)
+	if err != nil {
+		return StorageObject{}, nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return StorageObject{}, nil, err
+	}
+
+	object, err := c.GetStorageObject(ctx, id)
+	if err != nil {
+		return StorageObject{}, nil, err
+	}
+	return *object, previous, nil
+}
+
+func (c Client) DeleteStorageObject(ctx context.Context, id uuid.UUID) error {
+	_, err := c.db.ExecContext(ctx, "DELETE FROM storage_objects WHERE id = ?", id.String())
+	return err
+}
+
+func insertStorageObject(ctx context.Context, tx *sql.Tx, id uuid.UUID, params CreateStorageObjectParams) error {
+	_, err := tx.ExecContext(ctx, `
+		INSERT INTO storage_objects (id, created_at, backend, bucket, key, size, checksum, content_type)
+		VALUES (?, CURRENT_TIMESTAMP, ?, ?, ?, ?, ?, ?)
+	`, id.String(), params.Backend, params.Bucket, params.Key, params.Size, params.Checksum, params.ContentType)
+	return err
+}
+
+// migrateVideoLocations moves videos that still keep their location in the
+// video_url column ("bucket,key" or an S3 URL) into storage_objects.
+func (c *Client) migrateVideoLocations() error {
+	rows, err := c.db.Query(`
+		SELECT id, video_url
+		FROM videos
+		WHERE video_url IS NOT NULL AND video_object_id IS NULL
+	`)
+	if err != nil {
+		return err
+	}
+
+	type legacyVideo struct {
+		id       uuid.UUID
+		location string
+	}
+	var legacy []legacyVideo
+	for rows.Next() {
+		var video legacyVideo
+		if err := rows.Scan(&video.id, &video.location); err != nil {
+			rows.Close()
+			return err
+		}
+		legacy = append(legacy, video)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, video := range legacy {
+		bucket, key, ok := parseLegacyVideoLocation(video.location)
+		if !ok {
+			slog.Warn("Leaving video with unrecognised video_url", "video_id", video.id, "video_url", video.location)
+			continue
+		}
+
+		err := c.migrateVideoLocation(video.id, CreateStorageObjectParams{
+			Backend:     "s3",
+			Bucket:      bucket,
+			Key:         key,
+			ContentType: "video/mp4",
+		})
+		if err != nil {
+			return fmt.Errorf("couldn't migrate video %s: %w", video.id, err)
+		}
+	}
+	return nil
+}
+
+func (c *Client) migrateVideoLocation(videoID uuid.UUID, params CreateStorageObjectParams) error {
+	tx, err := c.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	id := uuid.New()
+	err = insertStorageObject(context.Background(), tx, id, params)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(`
+		UPDATE videos
+		SET video_object_id = ?, video_url = NULL
+		WHERE id = ?
+	`, id, videoID)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// parseLegacyVideoLocation understands the "bucket,key" strings and the
+// https://bucket.s3.region.amazonaws.com/key URLs older versions stored.
+func parseLegacyVideoLocation(location string) (bucket, key string, ok bool) {
+	if !strings.Contains(location, "://") {
+		bucket, key, ok = strings.Cut(location, ",")
+		return bucket, key, ok && bucket != "" && key != ""
+	}
+
+	u, err := url.Parse(location)
+	if err != nil || u.Path == "" || u.Path == "/" {
+		return "", "", false
+	}
+	host := u.Hostname()
+	i := strings.Index(host, ".s3.")
+	if i <= 0 || !strings.HasSuffix(host, ".amazonaws.com") {
+		return "", "", false
+	}
+	return host[:i], strings.TrimPrefix(u.Path, "/"), true
+}
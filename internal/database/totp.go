@@ -0,0 +1,153 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+type UserTOTP struct {
+	UserID       uuid.UUID  `json:"user_id"`
+	Secret       string     `json:"-"`
+	CreatedAt    time.Time  `json:"created_at"`
+	ConfirmedAt  *time.Time `json:"confirmed_at"`
+	LastUsedStep int64      `json:"-"`
+}
+
+func (t UserTOTP) Enabled() bool {
+	return t.ConfirmedAt != nil
+}
+
+// SaveUserTOTP starts a new enrollment, replacing any earlier one that was
+// never confirmed.
+func (c Client) SaveUserTOTP(ctx context.Context, userID uuid.UUID, secret string) error {
+	query := `
+		INSERT INTO user_totp (user_id, secret, created_at, confirmed_at, last_used_step)
+		VALUES (?, ?, CURRENT_TIMESTAMP, NULL, 0)
+		ON CONFLICT(user_id) DO UPDATE SET
+			secret = excluded.secret,
+			created_at = excluded.created_at,
+			confirmed_at = NULL,
+			last_used_step = 0
+	`
+	_, err := c.db.ExecContext(ctx, query, userID.String(), secret)
+	return err
+}
+
+func (c Client) GetUserTOTP(ctx context.Context, userID uuid.UUID) (*UserTOTP, error) {
+	query := `
+		SELECT user_id, secret, created_at, confirmed_at, last_used_step
+		FROM user_totp
+		WHERE user_id = ?
+	`
+	var totp UserTOTP
+	var id string
+	err := c.db.QueryRowContext(ctx, query, userID.String()).
+		Scan(&id, &totp.Secret, &totp.CreatedAt, &totp.ConfirmedAt, &totp.LastUsedStep)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrNotFound
+		}
+		return nil, err
+	}
+	totp.UserID, err = uuid.Parse(id)
+	if err != nil {
+		return nil, err
+	}
+	return &totp, nil
+}
+
+// UseTOTPStep records that the code for a time step was accepted. It returns
+// false if that step (or a later one) was already used, so a code can't be
+// replayed.
+func (c Client) UseTOTPStep(ctx context.Context, userID uuid.UUID, step int64) (bool, error) {
+	query := `
+		UPDATE user_totp
+		SET last_used_step = ?
+		WHERE user_id = ? AND last_used_step < ?
+	`
+	result, err := c.db.ExecContext(ctx, query, step, userID.String(), step)
+	if err != nil {
+		return false, err
+	}
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return rows == 1, nil
+}
+
+// ConfirmUserTOTP enables two-factor authentication and replaces the user's
+// recovery codes in one transaction.
+func (c Client) ConfirmUserTOTP(ctx context.Context, userID uuid.UUID, recoveryCodeHashes []string) error {
+	tx, err := c.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, `
+		UPDATE user_totp
+		SET confirmed_at = CURRENT_TIMESTAMP
+		WHERE user_id = ?
+	`, userID.String())
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, "DELETE FROM recovery_codes WHERE user_id = ?", userID.String())
+	if err != nil {
+		return err
+	}
+	for _, hash := range recoveryCodeHashes {
+		_, err = tx.ExecContext(ctx, `
+			INSERT INTO recovery_codes (code_hash, user_id, created_at)
+			VALUES (?, ?, CURRENT_TIMESTAMP)
+		`, hash, userID.String())
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+func (c Client) DeleteUserTOTP(ctx context.Context, userID uuid.UUID) error {
+	tx, err := c.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, "DELETE FROM recovery_codes WHERE user_id = ?", userID.String())
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, "DELETE FROM user_totp WHERE user_id = ?", userID.String())
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// UseRecoveryCode marks an unused recovery code as used. It returns false if
+// the code doesn't belong to the user or was already used.
+func (c Client) UseRecoveryCode(ctx context.Context, userID uuid.UUID, codeHash string) (bool, error) {
+	query := `
+		UPDATE recovery_codes
+		SET used_at = CURRENT_TIMESTAMP
+		WHERE user_id = ? AND code_hash = ? AND used_at IS NULL
+	`
+	result, err := c.db.ExecContext(ctx, query, userID.String(), codeHash)
+	if err != nil {
+		return false, err
+	}
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return rows == 1, nil
+}
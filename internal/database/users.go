@@ -1,6 +1,7 @@
 package database
 
 import (
+	"context"
 	"database/sql"
 	"errors"
 	"time"
@@ -9,18 +10,20 @@ import (
 )
 
 type User struct {
-	ID        uuid.UUID `json:"id"`
-	CreatedAt time.Time `json:"created_at"`
-	UpdatedAt time.Time `json:"updated_at"`
+	ID         uuid.UUID  `json:"id"`
+	CreatedAt  time.Time  `json:"created_at"`
+	UpdatedAt  time.Time  `json:"updated_at"`
+	VerifiedAt *time.Time `json:"verified_at"`
 	CreateUserParams
 }
 
 type CreateUserParams struct {
-	Email    string `json:"email"`
-	Password string `json:"password"`
+	Email string `json:"email"`
+	// Password is the bcrypt hash, which never leaves the server.
+	Password string `json:"-"`
 }
 
-func (c Client) GetUsers() ([]User, error) {
+func (c Client) GetUsers(ctx context.Context) ([]User, error) {
 	query := `
 		SELECT
 			id,
@@ -28,7 +31,7 @@ func (c Client) GetUsers() ([]User, error) {
 		FROM users
 	`
 
-	rows, err := c.db.Query(query)
+	rows, err := c.db.QueryContext(ctx, query)
 	if err != nil {
 		return nil, err
 	}
@@ -51,18 +54,18 @@ func (c Client) GetUsers() ([]User, error) {
 	return users, nil
 }
 
-func (c Client) GetUserByEmail(email string) (User, error) {
+func (c Client) GetUserByEmail(ctx context.Context, email string) (User, error) {
 	query := `
-		SELECT id, created_at, updated_at, email, password
+		SELECT id, created_at, updated_at, verified_at, email, password
 		FROM users
-		WHERE email = ?
+		WHERE email = ? COLLATE NOCASE
 	`
 	var user User
 	var id string
-	err := c.db.QueryRow(query, email).Scan(&id, &user.CreatedAt, &user.UpdatedAt, &user.Email, &user.Password)
+	err := c.db.QueryRowContext(ctx, query, email).Scan(&id, &user.CreatedAt, &user.UpdatedAt, &user.VerifiedAt, &user.Email, &user.Password)
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
-			return User{}, nil
+			return User{}, ErrNotFound
 		}
 		return User{}, err
 	}
@@ -73,20 +76,20 @@ func (c Client) GetUserByEmail(email string) (User, error) {
 	return user, nil
 }
 
-func (c Client) GetUserByRefreshToken(token string) (*User, error) {
+func (c Client) GetUserByRefreshToken(ctx context.Context, token string) (*User, error) {
 	query := `
-		SELECT u.id, u.email, u.created_at, u.updated_at, u.password
+		SELECT u.id, u.email, u.created_at, u.updated_at, u.verified_at, u.password
 		FROM users u
 		JOIN refresh_tokens rt ON u.id = rt.user_id
-		WHERE rt.token = ?
+		WHERE rt.token = ? AND rt.revoked_at IS NULL AND rt.expires_at > ?
 	`
 
 	var user User
 	var id string
-	err := c.db.QueryRow(query, token).Scan(&id, &user.Email, &user.CreatedAt, &user.UpdatedAt, &user.Password)
+	err := c.db.QueryRowContext(ctx, query, token, time.Now().UTC()).Scan(&id, &user.Email, &user.CreatedAt, &user.UpdatedAt, &user.VerifiedAt, &user.Password)
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
-			return nil, nil
+			return nil, ErrNotFound
 		}
 		return nil, err
 	}
@@ -98,7 +101,7 @@ func (c Client) GetUserByRefreshToken(token string) (*User, error) {
 	return &user, nil
 }
 
-func (c Client) CreateUser(params CreateUserParams) (*User, error) {
+func (c Client) CreateUser(ctx context.Context, params CreateUserParams) (*User, error) {
 	id := uuid.New()
 
 	query := `
@@ -107,26 +110,26 @@ func (c Client) CreateUser(params CreateUserParams) (*User, error) {
 		VALUES
 		    (?, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP, ?, ?)
 	`
-	_, err := c.db.Exec(query, id.String(), params.Email, params.Password)
+	_, err := c.db.ExecContext(ctx, query, id.String(), params.Email, params.Password)
 	if err != nil {
-		return nil, err
+		return nil, uniqueViolation(err)
 	}
 
-	return c.GetUser(id)
+	return c.GetUser(ctx, id)
 }
 
-func (c Client) GetUser(id uuid.UUID) (*User, error) {
+func (c Client) GetUser(ctx context.Context, id uuid.UUID) (*User, error) {
 	query := `
-		SELECT id, created_at, updated_at, email, password
+		SELECT id, created_at, updated_at, verified_at, email, password
 		FROM users
 		WHERE id = ?
 	`
 	var user User
 	var idStr string
-	err := c.db.QueryRow(query, id.String()).Scan(&idStr, &user.CreatedAt, &user.UpdatedAt, &user.Email, &user.Password)
+	err := c.db.QueryRowContext(ctx, query, id.String()).Scan(&idStr, &user.CreatedAt, &user.UpdatedAt, &user.VerifiedAt, &user.Email, &user.Password)
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
-			return nil, nil
+			return nil, ErrNotFound
 		}
 		return nil, err
 	}
@@ -137,11 +140,31 @@ func (c Client) GetUser(id uuid.UUID) (*User, error) {
 	return &user, nil
 }
 
-func (c Client) DeleteUser(id uuid.UUID) error {
+func (c Client) UpdateUserPassword(ctx context.Context, id uuid.UUID, hashedPassword string) error {
+	query := `
+		UPDATE users
+		SET password = ?, updated_at = CURRENT_TIMESTAMP
+		WHERE id = ?
+	`
+	_, err := c.db.ExecContext(ctx, query, hashedPassword, id.String())
+	return err
+}
+
+func (c Client) MarkUserEmailVerified(ctx context.Context, id uuid.UUID) error {
+	query := `
+		UPDATE users
+		SET verified_at = COALESCE(verified_at, CURRENT_TIMESTAMP), updated_at = CURRENT_TIMESTAMP
+		WHERE id = ?
+	`
+	_, err := c.db.ExecContext(ctx, query, id.String())
+	return err
+}
+
+func (c Client) DeleteUser(ctx context.Context, id uuid.UUID) error {
 	query := `
 		DELETE FROM users
 		WHERE id = ?
 	`
-	_, err := c.db.Exec(query, id.String())
+	_, err := c.db.ExecContext(ctx, query, id.String())
 	return err
 }
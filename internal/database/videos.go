@@ -1,8 +1,11 @@
 package database
 
 import (
+	"context"
 	"database/sql"
+	"encoding/json"
 	"errors"
+	"fmt"
 	"time"
 
 	"github.com/google/uuid"
@@ -13,33 +16,156 @@ type Video struct {
 	CreatedAt    time.Time `json:"created_at"`
 	UpdatedAt    time.Time `json:"updated_at"`
 	ThumbnailURL *string   `json:"thumbnail_url"`
-	VideoURL     *string   `json:"video_url"`
+	// ThumbnailVariants are the resized copies of the thumbnail. The API
+	// exposes them as ThumbnailSrcset.
+	ThumbnailVariants []ThumbnailVariant `json:"-"`
+	// ThumbnailSrcset maps an image type to a srcset attribute value listing
+	// its variants, e.g. {"image/webp": "/assets/a.webp 320w, ..."}.
+	ThumbnailSrcset map[string]string `json:"thumbnail_srcset,omitempty"`
+	// VideoURL is filled in by the API with a playback URL computed from
+	// VideoObject. Only videos whose legacy location couldn't be migrated
+	// still carry a stored value.
+	VideoURL *string `json:"video_url"`
+	// VideoObject is where the uploaded file is stored, nil until upload.
+	VideoObject *StorageObject `json:"-"`
 	CreateVideoParams
 }
 
+type ThumbnailVariant struct {
+	Format string `json:"format"`
+	Width  int    `json:"width"`
+	Height int    `json:"height"`
+	// Key locates the image in the storage backend.
+	Key string `json:"key,omitempty"`
+	// URL is only set on variants written to the local assets directory,
+	// before thumbnails moved to the storage backend.
+	URL string `json:"url,omitempty"`
+}
+
+// Video visibility levels.
+const (
+	// VisibilityPrivate videos are only visible to their owner.
+	VisibilityPrivate = "private"
+	// VisibilityUnlisted videos are also visible with a share token.
+	VisibilityUnlisted = "unlisted"
+	// VisibilityPublic videos are visible to everyone and listed in the
+	// public feed.
+	VisibilityPublic = "public"
+)
+
+func ValidVisibility(visibility string) bool {
+	switch visibility {
+	case VisibilityPrivate, VisibilityUnlisted, VisibilityPublic:
+		return true
+	}
+	return false
+}
+
 type CreateVideoParams struct {
 	Title       string    `json:"title"`
 	Description string    `json:"description"`
 	UserID      uuid.UUID `json:"user_id"`
+	Visibility  string    `json:"visibility"`
+	// URLTTLSeconds overrides how long signed playback URLs stay valid.
+	URLTTLSeconds *int `json:"url_ttl_seconds"`
+}
+
+const videoColumns = `
+		v.id,
+		v.created_at,
+		v.updated_at,
+		v.title,
+		v.description,
+		v.thumbnail_url,
+		v.thumbnail_variants,
+		v.video_url,
+		v.user_id,
+		v.visibility,
+		v.url_ttl_seconds,
+		o.id,
+		o.created_at,
+		o.backend,
+		o.bucket,
+		o.key,
+		o.size,
+		o.checksum,
+		o.content_type
+	FROM videos v
+	LEFT JOIN storage_objects o ON o.id = v.video_object_id
+`
+
+func scanVideo(row interface{ Scan(...interface{}) error }) (Video, error) {
+	var video Video
+	var thumbnailVariants sql.NullString
+	var (
+		objectID          *uuid.UUID
+		objectCreatedAt   *time.Time
+		objectBackend     sql.NullString
+		objectBucket      sql.NullString
+		objectKey         sql.NullString
+		objectSize        sql.NullInt64
+		objectChecksum    sql.NullString
+		objectContentType sql.NullString
+	)
+	err := row.Scan(
+		&video.ID,
+		&video.CreatedAt,
+		&video.UpdatedAt,
+		&video.Title,
+		&video.Description,
+		&video.ThumbnailURL,
+		&thumbnailVariants,
+		&video.VideoURL,
+		&video.UserID,
+		&video.Visibility,
+		&video.URLTTLSeconds,
+		&objectID,
+		&objectCreatedAt,
+		&objectBackend,
+		&objectBucket,
+		&objectKey,
+		&objectSize,
+		&objectChecksum,
+		&objectContentType,
+	)
+	if err != nil {
+		return Video{}, err
+	}
+
+	if thumbnailVariants.Valid {
+		err = json.Unmarshal([]byte(thumbnailVariants.String), &video.ThumbnailVariants)
+		if err != nil {
+			return Video{}, fmt.Errorf("couldn't parse thumbnail variants of video %s: %w", video.ID, err)
+		}
+	}
+
+	if objectID != nil {
+		video.VideoObject = &StorageObject{
+			ID: *objectID,
+			CreateStorageObjectParams: CreateStorageObjectParams{
+				Backend:     objectBackend.String,
+				Bucket:      objectBucket.String,
+				Key:         objectKey.String,
+				Size:        objectSize.Int64,
+				Checksum:    objectChecksum.String,
+				ContentType: objectContentType.String,
+			},
+		}
+		if objectCreatedAt != nil {
+			video.VideoObject.CreatedAt = *objectCreatedAt
+		}
+	}
+	return video, nil
 }
 
-func (c Client) GetVideos(userID uuid.UUID) ([]Video, error) {
+func (c Client) GetVideos(ctx context.Context, userID uuid.UUID) ([]Video, error) {
 	query := `
-	SELECT
-		id,
-		created_at,
-		updated_at,
-		title,
-		description,
-		thumbnail_url,
-		video_url,
-		user_id
-	FROM videos
-	WHERE user_id = ?
-	ORDER BY created_at DESC
+	SELECT` + videoColumns + `
+	WHERE v.user_id = ?
+	ORDER BY v.created_at DESC
 	`
 
-	rows, err := c.db.Query(query, userID)
+	rows, err := c.db.QueryContext(ctx, query, userID)
 	if err != nil {
 		return nil, err
 	}
@@ -47,17 +173,8 @@ func (c Client) GetVideos(userID uuid.UUID) ([]Video, error) {
 
 	videos := []Video{}
 	for rows.Next() {
-		var video Video
-		if err := rows.Scan(
-			&video.ID,
-			&video.CreatedAt,
-			&video.UpdatedAt,
-			&video.Title,
-			&video.Description,
-			&video.ThumbnailURL,
-			&video.VideoURL,
-			&video.UserID,
-		); err != nil {
+		video, err := scanVideo(rows)
+		if err != nil {
 			return nil, err
 		}
 		videos = append(videos, video)
@@ -66,7 +183,68 @@ func (c Client) GetVideos(userID uuid.UUID) ([]Video, error) {
 	return videos, nil
 }
 
-func (c Client) CreateVideo(params CreateVideoParams) (Video, error) {
+// GetPublicVideos returns a page of public videos, newest first.
+func (c Client) GetPublicVideos(ctx context.Context, limit, offset int) ([]Video, error) {
+	query := `
+	SELECT` + videoColumns + `
+	WHERE v.visibility = ?
+	ORDER BY v.created_at DESC, v.id
+	LIMIT ? OFFSET ?
+	`
+
+	rows, err := c.db.QueryContext(ctx, query, VisibilityPublic, limit, offset)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	videos := []Video{}
+	for rows.Next() {
+		video, err := scanVideo(rows)
+		if err != nil {
+			return nil, err
+		}
+		videos = append(videos, video)
+	}
+
+	return videos, rows.Err()
+}
+
+// ListVideos returns every video, oldest first. It's meant for maintenance
+// commands, not request handlers.
+func (c Client) ListVideos(ctx context.Context) ([]Video, error) {
+	query := `
+	SELECT` + videoColumns + `
+	ORDER BY v.created_at
+	`
+
+	rows, err := c.db.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	videos := []Video{}
+	for rows.Next() {
+		video, err := scanVideo(rows)
+		if err != nil {
+			return nil, err
+		}
+		videos = append(videos, video)
+	}
+
+	return videos, rows.Err()
+}
+
+// CreateVideo adds a video and counts it against the owner's quota, failing
+// with a *QuotaError if they already have quota.MaxVideos videos.
+func (c Client) CreateVideo(ctx context.Context, params CreateVideoParams, quota Quota) (Video, error) {
+	tx, err := c.db.BeginTx(ctx, nil)
+	if err != nil {
+		return Video{}, err
+	}
+	defer tx.Rollback()
+
 	id := uuid.New()
 	query := `
 	INSERT INTO videos (
@@ -75,45 +253,40 @@ func (c Client) CreateVideo(params CreateVideoParams) (Video, error) {
 		updated_at,
 		title,
 		description,
-		user_id
-	) VALUES (?, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP, ?, ?, ?)
+		user_id,
+		visibility,
+		url_ttl_seconds
+	) VALUES (?, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP, ?, ?, ?, ?, ?)
 	`
-	_, err := c.db.Exec(query, id, params.Title, params.Description, params.UserID)
+	if params.Visibility == "" {
+		params.Visibility = VisibilityPrivate
+	}
+	_, err = tx.ExecContext(ctx, query, id, params.Title, params.Description, params.UserID, params.Visibility, params.URLTTLSeconds)
 	if err != nil {
 		return Video{}, err
 	}
 
-	return c.GetVideo(id)
+	err = addUsage(ctx, tx, params.UserID, 0, 1, quota)
+	if err != nil {
+		return Video{}, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return Video{}, err
+	}
+	return c.GetVideo(ctx, id)
 }
 
-func (c Client) GetVideo(id uuid.UUID) (Video, error) {
+func (c Client) GetVideo(ctx context.Context, id uuid.UUID) (Video, error) {
 	query := `
-	SELECT
-		id,
-		created_at,
-		updated_at,
-		title,
-		description,
-		thumbnail_url,
-		video_url,
-		user_id
-	FROM videos
-	WHERE id = ?
+	SELECT` + videoColumns + `
+	WHERE v.id = ?
 	`
 
-	var video Video
-	err := c.db.QueryRow(query, id).Scan(
-		&video.ID,
-		&video.CreatedAt,
-		&video.UpdatedAt,
-		&video.Title,
-		&video.Description,
-		&video.ThumbnailURL,
-		&video.VideoURL,
-		&video.UserID)
+	video, err := scanVideo(c.db.QueryRowContext(ctx, query, id))
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
-			return Video{}, nil
+			return Video{}, ErrNotFound
 		}
 		return Video{}, err
 	}
@@ -121,35 +294,96 @@ func (c Client) GetVideo(id uuid.UUID) (Video, error) {
 	return video, nil
 }
 
-func (c Client) UpdateVideo(video Video) error {
+// UpdateVideo saves the video's metadata. The file location is changed with
+// SetVideoObject instead.
+func (c Client) UpdateVideo(ctx context.Context, video Video) error {
+	var thumbnailVariants *string
+	if len(video.ThumbnailVariants) > 0 {
+		data, err := json.Marshal(video.ThumbnailVariants)
+		if err != nil {
+			return err
+		}
+		thumbnailVariants = new(string)
+		*thumbnailVariants = string(data)
+	}
+
 	query := `
 	UPDATE videos
 	SET
 		title = ?,
 		description = ?,
 		thumbnail_url = ?,
-		video_url = ?,
-		user_id = ?
+		thumbnail_variants = ?,
+		user_id = ?,
+		visibility = ?,
+		url_ttl_seconds = ?,
+		updated_at = CURRENT_TIMESTAMP
 	WHERE id = ?
 	`
 
-	_, err := c.db.Exec(
+	_, err := c.db.ExecContext(ctx,
 		query,
 		video.Title,
 		video.Description,
 		&video.ThumbnailURL,
-		&video.VideoURL,
+		thumbnailVariants,
 		video.UserID,
+		video.Visibility,
+		video.URLTTLSeconds,
 		video.ID,
 	)
 	return err
 }
 
-func (c Client) DeleteVideo(id uuid.UUID) error {
-	query := `
+// DeleteVideo removes the video and its storage_objects row, and gives the
+// space back to the owner's quota. Deleting the file itself is up to the
+// caller.
+func (c Client) DeleteVideo(ctx context.Context, id uuid.UUID) error {
+	tx, err := c.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var userID uuid.UUID
+	var objectID *uuid.UUID
+	var size sql.NullInt64
+	err = tx.QueryRowContext(ctx, `
+	SELECT v.user_id, v.video_object_id, o.size
+	FROM videos v
+	LEFT JOIN storage_objects o ON o.id = v.video_object_id
+	WHERE v.id = ?
+	`, id).Scan(&userID, &objectID, &size)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, `
 	DELETE FROM videos
 	WHERE id = ?
-	`
-	_, err := c.db.Exec(query, id)
-	return err
+	`, id)
+	if err != nil {
+		return err
+	}
+
+	if objectID != nil {
+		_, err = tx.ExecContext(ctx, "DELETE FROM storage_objects WHERE id = ?", *objectID)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = tx.ExecContext(ctx, "DELETE FROM video_share_tokens WHERE video_id = ?", id)
+	if err != nil {
+		return err
+	}
+
+	err = addUsage(ctx, tx, userID, -size.Int64, -1, Quota{})
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
 }
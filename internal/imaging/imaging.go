@@ -0,0 +1,145 @@
+// Package imaging decodes uploaded images and produces the resized JPEG and
+// WebP variants served as thumbnails.
+package imaging
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/jpeg"
+	_ "image/png"
+	"io"
+
+	"github.com/HugoSmits86/nativewebp"
+	"golang.org/x/image/draw"
+	_ "golang.org/x/image/webp"
+)
+
+// MaxPixels caps the decoded size of an upload, so a small file can't expand
+// into gigabytes of pixels.
+const MaxPixels = 50_000_000
+
+const jpegQuality = 82
+
+// Supported input formats, as named by image.Decode.
+var inputFormats = map[string]bool{
+	"jpeg": true,
+	"png":  true,
+	"webp": true,
+}
+
+var (
+	ErrUnsupportedFormat = errors.New("unsupported image format")
+	ErrTooLarge          = errors.New("image dimensions are too large")
+)
+
+// Output formats.
+const (
+	FormatJPEG = "image/jpeg"
+	FormatWebP = "image/webp"
+)
+
+// Decode reads an image and rotates it upright according to its EXIF
+// orientation. Metadata isn't carried over, so re-encoding the result strips
+// EXIF. Errors wrapping ErrUnsupportedFormat or ErrTooLarge mean the upload
+// is unacceptable rather than broken.
+func Decode(r io.Reader) (image.Image, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	config, format, err := image.DecodeConfig(bytes.NewReader(data))
+	if errors.Is(err, image.ErrFormat) || (err == nil && !inputFormats[format]) {
+		return nil, ErrUnsupportedFormat
+	}
+	if err != nil {
+		return nil, fmt.Errorf("couldn't read image header: %w", err)
+	}
+	if config.Width <= 0 || config.Height <= 0 {
+		return nil, fmt.Errorf("image has no pixels")
+	}
+	if config.Width*config.Height > MaxPixels {
+		return nil, ErrTooLarge
+	}
+
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("couldn't decode %s image: %w", format, err)
+	}
+
+	if format == "jpeg" {
+		img = orient(img, jpegOrientation(data))
+	}
+	return img, nil
+}
+
+// Resize scales img down to width, keeping its aspect ratio. Images that are
+// already narrower are returned as they are.
+func Resize(img image.Image, width int) image.Image {
+	bounds := img.Bounds()
+	if bounds.Dx() <= width {
+		return img
+	}
+	height := max(1, bounds.Dy()*width/bounds.Dx())
+	dst := image.NewNRGBA(image.Rect(0, 0, width, height))
+	draw.CatmullRom.Scale(dst, dst.Bounds(), img, bounds, draw.Src, nil)
+	return dst
+}
+
+// Encode writes img in one of the output formats. WebP output is lossless,
+// the only kind the pure Go encoder supports.
+func Encode(w io.Writer, img image.Image, format string) error {
+	switch format {
+	case FormatJPEG:
+		return jpeg.Encode(w, img, &jpeg.Options{Quality: jpegQuality})
+	case FormatWebP:
+		return nativewebp.Encode(w, img, nil)
+	default:
+		return fmt.Errorf("can't encode %q", format)
+	}
+}
+
+// orient applies an EXIF orientation (1-8) to img.
+func orient(img image.Image, orientation int) image.Image {
+	if orientation <= 1 || orientation > 8 {
+		return img
+	}
+
+	bounds := img.Bounds()
+	src := image.NewNRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	draw.Draw(src, src.Bounds(), img, bounds.Min, draw.Src)
+	w, h := bounds.Dx(), bounds.Dy()
+
+	// Orientations 5-8 swap width and height.
+	dstW, dstH := w, h
+	if orientation >= 5 {
+		dstW, dstH = h, w
+	}
+	dst := image.NewNRGBA(image.Rect(0, 0, dstW, dstH))
+
+	for y := 0; y < dstH; y++ {
+		for x := 0; x < dstW; x++ {
+			var sx, sy int
+			switch orientation {
+			case 2: // mirrored
+				sx, sy = w-1-x, y
+			case 3: // rotated 180
+				sx, sy = w-1-x, h-1-y
+			case 4: // mirrored vertically
+				sx, sy = x, h-1-y
+			case 5: // transposed
+				sx, sy = y, x
+			case 6: // needs 90 clockwise
+				sx, sy = y, h-1-x
+			case 7: // transversed
+				sx, sy = w-1-y, h-1-x
+			case 8: // needs 90 counter-clockwise
+				sx, sy = w-1-y, x
+			}
+			dst.SetNRGBA(x, y, src.NRGBAAt(sx, sy))
+		}
+	}
+	return dst
+}
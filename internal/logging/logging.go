@@ -0,0 +1,107 @@
+// Package logging carries per-request attributes (request ID, user ID) in a
+// context and adds them to every slog record logged with that context.
+package logging
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"sync"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+type contextKey struct{}
+
+// requestInfo is shared by everything handling one request, so a handler
+// can add the user ID after authenticating and later logs pick it up.
+type requestInfo struct {
+	mu        sync.Mutex
+	requestID string
+	userID    string
+}
+
+// WithRequestID starts request-scoped logging attributes for ctx.
+func WithRequestID(ctx context.Context, requestID string) context.Context {
+	return context.WithValue(ctx, contextKey{}, &requestInfo{requestID: requestID})
+}
+
+func info(ctx context.Context) *requestInfo {
+	if ctx == nil {
+		return nil
+	}
+	ri, _ := ctx.Value(contextKey{}).(*requestInfo)
+	return ri
+}
+
+// RequestID returns the request ID stored by WithRequestID, or "".
+func RequestID(ctx context.Context) string {
+	ri := info(ctx)
+	if ri == nil {
+		return ""
+	}
+	return ri.requestID
+}
+
+// SetUserID records who made the request. It does nothing on contexts
+// without request info.
+func SetUserID(ctx context.Context, userID string) {
+	ri := info(ctx)
+	if ri == nil {
+		return
+	}
+	ri.mu.Lock()
+	ri.userID = userID
+	ri.mu.Unlock()
+}
+
+// UserID returns the user ID recorded with SetUserID, or "".
+func UserID(ctx context.Context) string {
+	ri := info(ctx)
+	if ri == nil {
+		return ""
+	}
+	ri.mu.Lock()
+	defer ri.mu.Unlock()
+	return ri.userID
+}
+
+// ContextHandler adds request_id, user_id and trace_id from the context to
+// records.
+type ContextHandler struct {
+	slog.Handler
+}
+
+func (h ContextHandler) Handle(ctx context.Context, record slog.Record) error {
+	if requestID := RequestID(ctx); requestID != "" {
+		record.AddAttrs(slog.String("request_id", requestID))
+	}
+	if userID := UserID(ctx); userID != "" {
+		record.AddAttrs(slog.String("user_id", userID))
+	}
+	if span := trace.SpanContextFromContext(ctx); span.IsSampled() {
+		record.AddAttrs(slog.String("trace_id", span.TraceID().String()))
+	}
+	return h.Handler.Handle(ctx, record)
+}
+
+func (h ContextHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return ContextHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h ContextHandler) WithGroup(name string) slog.Handler {
+	return ContextHandler{h.Handler.WithGroup(name)}
+}
+
+// NewLogger builds the application logger: readable text for development,
+// JSON everywhere else.
+func NewLogger(w io.Writer, format string, level slog.Level) *slog.Logger {
+	opts := &slog.HandlerOptions{Level: level}
+	var handler slog.Handler
+	if format == "json" {
+		handler = slog.NewJSONHandler(w, opts)
+	} else {
+		handler = slog.NewTextHandler(w, opts)
+	}
+	return slog.New(ContextHandler{handler})
+}
@@ -0,0 +1,80 @@
+package mailer
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+type Message struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Mailer delivers transactional email such as password reset links.
+type Mailer interface {
+	Send(ctx context.Context, msg Message) error
+}
+
+const (
+	KindLog  = "log"
+	KindFile = "file"
+)
+
+func New(kind, from, dir string) (Mailer, error) {
+	switch kind {
+	case "", KindLog:
+		return LogMailer{From: from}, nil
+	case KindFile:
+		if dir == "" {
+			return nil, fmt.Errorf("mail directory is required for the %q mailer", KindFile)
+		}
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return nil, fmt.Errorf("couldn't create mail directory: %w", err)
+		}
+		return FileMailer{From: from, Dir: dir}, nil
+	default:
+		return nil, fmt.Errorf("unknown mailer %q", kind)
+	}
+}
+
+// LogMailer notes messages in the server log without delivering them. The
+// body is left out, it holds password reset and verification tokens. Only
+// meant for local development.
+type LogMailer struct {
+	From string
+}
+
+func (m LogMailer) Send(ctx context.Context, msg Message) error {
+	slog.InfoContext(ctx, "mail", "from", m.From, "to", msg.To, "subject", msg.Subject)
+	return nil
+}
+
+// FileMailer drops each message into Dir as an .eml file that can be opened
+// with any mail client.
+type FileMailer struct {
+	From string
+	Dir  string
+}
+
+func (m FileMailer) Send(ctx context.Context, msg Message) error {
+	now := time.Now().UTC()
+	name := fmt.Sprintf("%s-%s.eml", now.Format("20060102T150405"), uuid.NewString())
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "From: %s\r\n", m.From)
+	fmt.Fprintf(&b, "To: %s\r\n", msg.To)
+	fmt.Fprintf(&b, "Subject: %s\r\n", msg.Subject)
+	fmt.Fprintf(&b, "Date: %s\r\n", now.Format(time.RFC1123Z))
+	b.WriteString("Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	b.WriteString(msg.Body)
+
+	return os.WriteFile(filepath.Join(m.Dir, name), []byte(b.String()), 0644)
+}
@@ -0,0 +1,105 @@
+// Package media recognises upload formats from their leading bytes instead
+// of the Content-Type the client claims.
+package media
+
+import (
+	"bytes"
+	"io"
+)
+
+// SniffLen is how many leading bytes the Sniff functions look at.
+const SniffLen = 4096
+
+// Container formats accepted for video uploads.
+const (
+	ContainerMP4      = "mp4"
+	ContainerMOV      = "mov"
+	ContainerWebM     = "webm"
+	ContainerMatroska = "mkv"
+)
+
+// Image formats accepted for thumbnails, as MIME types.
+const (
+	ImageJPEG = "image/jpeg"
+	ImagePNG  = "image/png"
+	ImageWebP = "image/webp"
+)
+
+// Head reads up to SniffLen bytes from r and rewinds it.
+func Head(r io.ReadSeeker) ([]byte, error) {
+	head := make([]byte, SniffLen)
+	n, err := io.ReadFull(r, head)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return nil, err
+	}
+	_, err = r.Seek(0, io.SeekStart)
+	if err != nil {
+		return nil, err
+	}
+	return head[:n], nil
+}
+
+// SniffVideo returns the container of a video file, or "" if it isn't one
+// we accept.
+func SniffVideo(head []byte) string {
+	// ISO base media files (MP4, MOV) start with a box: 4 byte size, 4 byte
+	// type. Most begin with "ftyp", whose major brand tells MOV apart.
+	if len(head) >= 12 && string(head[4:8]) == "ftyp" {
+		if string(head[8:12]) == "qt  " {
+			return ContainerMOV
+		}
+		return ContainerMP4
+	}
+	// Old QuickTime files have no ftyp box.
+	if len(head) >= 8 {
+		switch string(head[4:8]) {
+		case "moov", "mdat", "wide", "free", "skip":
+			return ContainerMOV
+		}
+	}
+
+	// Matroska and WebM are EBML documents; the DocType element says which.
+	if bytes.HasPrefix(head, []byte{0x1A, 0x45, 0xDF, 0xA3}) {
+		docType := ebmlDocType(head)
+		switch docType {
+		case "webm":
+			return ContainerWebM
+		case "matroska":
+			return ContainerMatroska
+		}
+	}
+	return ""
+}
+
+// ebmlDocType finds the DocType (ID 0x4282) in the EBML header. A plain
+// search is enough, the header is small and comes first.
+func ebmlDocType(head []byte) string {
+	i := bytes.Index(head, []byte{0x42, 0x82})
+	if i < 0 || i+3 > len(head) {
+		return ""
+	}
+	// The size is a one byte EBML varint for any sensible DocType.
+	sizeByte := head[i+2]
+	if sizeByte&0x80 == 0 {
+		return ""
+	}
+	size := int(sizeByte & 0x7F)
+	if i+3+size > len(head) {
+		return ""
+	}
+	return string(bytes.TrimRight(head[i+3:i+3+size], "\x00"))
+}
+
+// SniffImage returns the MIME type of an image file, or "" if it isn't one
+// we accept.
+func SniffImage(head []byte) string {
+	switch {
+	case bytes.HasPrefix(head, []byte{0xFF, 0xD8, 0xFF}):
+		return ImageJPEG
+	case bytes.HasPrefix(head, []byte("\x89PNG\r\n\x1a\n")):
+		return ImagePNG
+	case len(head) >= 12 && string(head[:4]) == "RIFF" && string(head[8:12]) == "WEBP":
+		return ImageWebP
+	}
+	return ""
+}
@@ -0,0 +1,78 @@
+// Package metrics defines the Prometheus metrics served on /metrics. They're
+// registered with the default registry, which also carries the Go runtime
+// and process collectors.
+package metrics
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const namespace = "tubely"
+
+var (
+	HTTPRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "http_requests_total",
+		Help:      "HTTP requests by method, route pattern and status code.",
+	}, []string{"method", "route", "status"})
+
+	HTTPRequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "http_request_duration_seconds",
+		Help:      "Time spent handling HTTP requests, by method and route pattern.",
+		Buckets:   []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60, 120},
+	}, []string{"method", "route"})
+
+	UploadBytes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "upload_bytes_total",
+		Help:      "Bytes received in uploaded files, by kind (video or thumbnail).",
+	}, []string{"kind"})
+
+	MediaToolDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "media_tool_duration_seconds",
+		Help:      "Time spent running ffprobe and ffmpeg, by tool and step.",
+		Buckets:   []float64{.05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60, 120, 300, 600},
+	}, []string{"tool", "step"})
+
+	MediaToolFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "media_tool_failures_total",
+		Help:      "ffprobe and ffmpeg runs that failed, by tool and step.",
+	}, []string{"tool", "step"})
+
+	S3OperationDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "s3_operation_duration_seconds",
+		Help:      "Latency of S3 operations, by operation and result (ok or error).",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"operation", "result"})
+
+	ProcessingQueueDepth = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "processing_queue_depth",
+		Help:      "Video uploads received and not yet processed and stored.",
+	})
+)
+
+// ObserveMediaTool records one run of ffprobe or ffmpeg that started at
+// start.
+func ObserveMediaTool(tool, step string, start time.Time, err error) {
+	MediaToolDuration.WithLabelValues(tool, step).Observe(time.Since(start).Seconds())
+	if err != nil {
+		MediaToolFailures.WithLabelValues(tool, step).Inc()
+	}
+}
+
+// ObserveS3 records one S3 operation that started at start.
+func ObserveS3(operation string, start time.Time, err error) {
+	result := "ok"
+	if err != nil {
+		result = "error"
+	}
+	S3OperationDuration.WithLabelValues(operation, result).Observe(time.Since(start).Seconds())
+}
@@ -0,0 +1,329 @@
+package oidc
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+type Config struct {
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	RedirectURL  string
+	Scopes       []string
+	HTTPClient   *http.Client
+}
+
+// Metadata is the subset of the provider's discovery document we use.
+type Metadata struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+type TokenResponse struct {
+	AccessToken string `json:"access_token"`
+	TokenType   string `json:"token_type"`
+	IDToken     string `json:"id_token"`
+	ExpiresIn   int    `json:"expires_in"`
+}
+
+type IDTokenClaims struct {
+	jwt.RegisteredClaims
+	Nonce           string   `json:"nonce"`
+	Email           string   `json:"email"`
+	EmailVerified   flexBool `json:"email_verified"`
+	AuthorizedParty string   `json:"azp"`
+}
+
+// Provider talks to a single OpenID Connect identity provider. Discovery runs
+// lazily on first use so the server can start while the provider is down.
+type Provider struct {
+	cfg Config
+
+	mu       sync.Mutex
+	metadata *Metadata
+	keys     map[string]interface{}
+}
+
+func NewProvider(cfg Config) *Provider {
+	if cfg.HTTPClient == nil {
+		cfg.HTTPClient = &http.Client{Timeout: 10 * time.Second}
+	}
+	if len(cfg.Scopes) == 0 {
+		cfg.Scopes = []string{"openid", "email", "profile"}
+	}
+	cfg.Issuer = strings.TrimSuffix(cfg.Issuer, "/")
+	return &Provider{cfg: cfg}
+}
+
+func (p *Provider) Issuer() string {
+	return p.cfg.Issuer
+}
+
+// discover fetches the discovery document once. The lock is only held to
+// read and store it, so a slow provider doesn't hold up other logins; if
+// several fetch it at once, the last one wins.
+func (p *Provider) discover(ctx context.Context) (*Metadata, error) {
+	p.mu.Lock()
+	cached := p.metadata
+	p.mu.Unlock()
+	if cached != nil {
+		return cached, nil
+	}
+
+	var metadata Metadata
+	err := p.getJSON(ctx, p.cfg.Issuer+"/.well-known/openid-configuration", &metadata)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't fetch discovery document: %w", err)
+	}
+	if strings.TrimSuffix(metadata.Issuer, "/") != p.cfg.Issuer {
+		return nil, fmt.Errorf("discovery issuer %q doesn't match configured issuer %q", metadata.Issuer, p.cfg.Issuer)
+	}
+	if metadata.AuthorizationEndpoint == "" || metadata.TokenEndpoint == "" || metadata.JWKSURI == "" {
+		return nil, errors.New("discovery document is missing required endpoints")
+	}
+
+	p.mu.Lock()
+	p.metadata = &metadata
+	p.mu.Unlock()
+	return &metadata, nil
+}
+
+// AuthCodeURL builds the URL to send the browser to. The code challenge is
+// derived from a PKCE verifier made with NewPKCEVerifier.
+func (p *Provider) AuthCodeURL(ctx context.Context, state, nonce, codeChallenge string) (string, error) {
+	metadata, err := p.discover(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	query := url.Values{}
+	query.Set("response_type", "code")
+	query.Set("client_id", p.cfg.ClientID)
+	query.Set("redirect_uri", p.cfg.RedirectURL)
+	query.Set("scope", strings.Join(p.cfg.Scopes, " "))
+	query.Set("state", state)
+	query.Set("nonce", nonce)
+	query.Set("code_challenge", codeChallenge)
+	query.Set("code_challenge_method", "S256")
+
+	separator := "?"
+	if strings.Contains(metadata.AuthorizationEndpoint, "?") {
+		separator = "&"
+	}
+	return metadata.AuthorizationEndpoint + separator + query.Encode(), nil
+}
+
+func (p *Provider) Exchange(ctx context.Context, code, codeVerifier string) (TokenResponse, error) {
+	metadata, err := p.discover(ctx)
+	if err != nil {
+		return TokenResponse{}, err
+	}
+
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", p.cfg.RedirectURL)
+	form.Set("code_verifier", codeVerifier)
+	form.Set("client_id", p.cfg.ClientID)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, metadata.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return TokenResponse{}, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if p.cfg.ClientSecret != "" {
+		req.SetBasicAuth(url.QueryEscape(p.cfg.ClientID), url.QueryEscape(p.cfg.ClientSecret))
+	}
+
+	resp, err := p.cfg.HTTPClient.Do(req)
+	if err != nil {
+		return TokenResponse{}, err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return TokenResponse{}, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return TokenResponse{}, fmt.Errorf("token endpoint returned %s: %s", resp.Status, body)
+	}
+
+	var tokens TokenResponse
+	err = json.Unmarshal(body, &tokens)
+	if err != nil {
+		return TokenResponse{}, err
+	}
+	if tokens.IDToken == "" {
+		return TokenResponse{}, errors.New("token response has no id_token")
+	}
+	return tokens, nil
+}
+
+// VerifyIDToken checks the ID token signature against the provider's keys
+// and validates issuer, audience, expiry and nonce.
+func (p *Provider) VerifyIDToken(ctx context.Context, rawIDToken, nonce string) (IDTokenClaims, error) {
+	metadata, err := p.discover(ctx)
+	if err != nil {
+		return IDTokenClaims{}, err
+	}
+
+	claims := IDTokenClaims{}
+	_, err = jwt.ParseWithClaims(
+		rawIDToken,
+		&claims,
+		func(token *jwt.Token) (interface{}, error) {
+			kid, _ := token.Header["kid"].(string)
+			return p.key(ctx, metadata.JWKSURI, kid)
+		},
+		jwt.WithValidMethods([]string{"RS256", "RS384", "RS512", "ES256", "ES384", "ES512"}),
+		jwt.WithIssuer(metadata.Issuer),
+		jwt.WithAudience(p.cfg.ClientID),
+		jwt.WithLeeway(time.Minute),
+	)
+	if err != nil {
+		return IDTokenClaims{}, err
+	}
+
+	if claims.ExpiresAt == nil {
+		return IDTokenClaims{}, errors.New("id token has no expiry")
+	}
+	if len(claims.Audience) > 1 && claims.AuthorizedParty != p.cfg.ClientID {
+		return IDTokenClaims{}, errors.New("id token azp doesn't match client ID")
+	}
+	if claims.Nonce == "" || claims.Nonce != nonce {
+		return IDTokenClaims{}, errors.New("id token nonce doesn't match")
+	}
+	if claims.Subject == "" {
+		return IDTokenClaims{}, errors.New("id token has no subject")
+	}
+	return claims, nil
+}
+
+func (p *Provider) key(ctx context.Context, jwksURI, kid string) (interface{}, error) {
+	p.mu.Lock()
+	key, ok := p.keys[kid]
+	p.mu.Unlock()
+	if ok {
+		return key, nil
+	}
+
+	// Unknown key ID: the provider may have rotated its keys.
+	keys, err := p.fetchKeys(ctx, jwksURI)
+	if err != nil {
+		return nil, err
+	}
+
+	p.mu.Lock()
+	p.keys = keys
+	p.mu.Unlock()
+
+	key, ok = keys[kid]
+	if !ok && kid == "" && len(keys) == 1 {
+		for _, only := range keys {
+			return only, nil
+		}
+	}
+	if !ok {
+		return nil, fmt.Errorf("no signing key with kid %q", kid)
+	}
+	return key, nil
+}
+
+func (p *Provider) fetchKeys(ctx context.Context, jwksURI string) (map[string]interface{}, error) {
+	var set struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	err := p.getJSON(ctx, jwksURI, &set)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't fetch JWKS: %w", err)
+	}
+
+	keys := map[string]interface{}{}
+	for _, jwk := range set.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		key, err := jwk.publicKey()
+		if err != nil {
+			continue
+		}
+		keys[jwk.Kid] = key
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("JWKS contains no usable signing keys")
+	}
+	return keys, nil
+}
+
+func (p *Provider) getJSON(ctx context.Context, url string, v interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := p.cfg.HTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s returned %s", url, resp.Status)
+	}
+	return json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(v)
+}
+
+// RandomString returns a URL-safe random value for state and nonce parameters.
+func RandomString() (string, error) {
+	b := make([]byte, 32)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// NewPKCEVerifier returns a code verifier as described in RFC 7636.
+func NewPKCEVerifier() (string, error) {
+	return RandomString()
+}
+
+func PKCEChallenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// flexBool accepts both true and "true", since some providers send
+// email_verified as a string.
+type flexBool bool
+
+func (b *flexBool) UnmarshalJSON(data []byte) error {
+	switch strings.Trim(string(data), `"`) {
+	case "true":
+		*b = true
+	case "false", "null", "":
+		*b = false
+	default:
+		return fmt.Errorf("invalid boolean %s", data)
+	}
+	return nil
+}
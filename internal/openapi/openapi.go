@@ -0,0 +1,488 @@
+// Package openapi holds the OpenAPI document describing the HTTP API, a
+// page for browsing it, and a validator that checks requests and responses
+// against it. The document is maintained by hand: when a route or payload
+// changes, openapi.json changes with it.
+package openapi
+
+import (
+	"bytes"
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/santhosh-tekuri/jsonschema/v6"
+)
+
+//go:embed openapi.json
+var Spec []byte
+
+//go:embed docs.html
+var DocsPage []byte
+
+// specURL names the document for the schema compiler, it's never fetched.
+const specURL = "https://tubely.invalid/openapi.json"
+
+var methods = []string{"get", "put", "post", "delete", "options", "head", "patch", "trace"}
+
+// Validator checks traffic against the operations in Spec.
+type Validator struct {
+	operations map[string]*Operation
+}
+
+// Operation is a single method and path of the API.
+type Operation struct {
+	Method string
+	Path   string
+
+	params       []parameter
+	bodyRequired bool
+	bodies       map[string]*jsonschema.Schema
+	responses    map[string]*response
+}
+
+type parameter struct {
+	name     string
+	in       string
+	required bool
+	typ      string
+	schema   *jsonschema.Schema
+}
+
+type response struct {
+	// content maps media types to schemas. A nil map means the response
+	// didn't declare any, so its body isn't checked.
+	content map[string]*jsonschema.Schema
+}
+
+// NewValidator compiles every schema in Spec, so a broken document fails at
+// startup rather than on the first request that needs it.
+func NewValidator() (*Validator, error) {
+	var doc map[string]any
+	if err := json.Unmarshal(Spec, &doc); err != nil {
+		return nil, fmt.Errorf("couldn't parse OpenAPI document: %w", err)
+	}
+	schemaDoc, err := jsonschema.UnmarshalJSON(bytes.NewReader(Spec))
+	if err != nil {
+		return nil, fmt.Errorf("couldn't parse OpenAPI document: %w", err)
+	}
+	c := jsonschema.NewCompiler()
+	c.DefaultDraft(jsonschema.Draft2020)
+	c.AssertFormat()
+	if err := c.AddResource(specURL, schemaDoc); err != nil {
+		return nil, fmt.Errorf("couldn't load OpenAPI document: %w", err)
+	}
+
+	l := loader{doc: doc, compiler: c}
+	v := &Validator{operations: map[string]*Operation{}}
+	paths, _ := doc["paths"].(map[string]any)
+	for path, item := range paths {
+		item, _ := item.(map[string]any)
+		itemPtr := "/paths/" + escape(path)
+		for _, method := range methods {
+			if _, ok := item[method]; !ok {
+				continue
+			}
+			op, err := l.operation(strings.ToUpper(method), path, itemPtr, itemPtr+"/"+method)
+			if err != nil {
+				return nil, fmt.Errorf("%s %s: %w", strings.ToUpper(method), path, err)
+			}
+			v.operations[op.Method+" "+op.Path] = op
+		}
+	}
+	return v, nil
+}
+
+// Operation finds the operation for a request with the given method that
+// the ServeMux routed to pattern. Patterns without a method match any, and a
+// trailing slash matches the rest of the path, which the document spells
+// {path}. HEAD requests use the GET operation unless there's a HEAD one.
+func (v *Validator) Operation(method, pattern string) (*Operation, bool) {
+	patternMethod, path, found := strings.Cut(pattern, " ")
+	if !found {
+		path = patternMethod
+		patternMethod = method
+	}
+	if strings.HasSuffix(path, "/") {
+		path += "{path}"
+	}
+	path = strings.ReplaceAll(path, "...}", "}")
+
+	if op, ok := v.operations[patternMethod+" "+path]; ok {
+		return op, true
+	}
+	if patternMethod == http.MethodHead {
+		op, ok := v.operations[http.MethodGet+" "+path]
+		return op, ok
+	}
+	return nil, false
+}
+
+// ValidateRequest checks r's path and query parameters and, for JSON
+// requests, body. Other bodies are only checked for their content type.
+func (op *Operation) ValidateRequest(r *http.Request, body []byte) error {
+	pathValues := op.pathValues(r.URL)
+	query := r.URL.Query()
+	var problems []string
+	for _, p := range op.params {
+		var value string
+		var present bool
+		switch p.in {
+		case "path":
+			// The mux matched the route, so a path parameter is only missing
+			// when it redirects, e.g. /app to /app/.
+			value, present = pathValues[p.name]
+			if !present {
+				continue
+			}
+		case "query":
+			present = query.Has(p.name)
+			value = query.Get(p.name)
+		case "header":
+			value = r.Header.Get(p.name)
+			present = value != ""
+		default:
+			continue
+		}
+		if !present {
+			if p.required {
+				problems = append(problems, fmt.Sprintf("%s parameter %q is required", p.in, p.name))
+			}
+			continue
+		}
+		if err := p.validate(value); err != nil {
+			problems = append(problems, fmt.Sprintf("%s parameter %q: %v", p.in, p.name, err))
+		}
+	}
+	if len(problems) > 0 {
+		return errors.New(strings.Join(problems, "; "))
+	}
+
+	if op.bodies == nil {
+		return nil
+	}
+	contentType := r.Header.Get("Content-Type")
+	if contentType == "" && r.ContentLength <= 0 && len(body) == 0 {
+		if op.bodyRequired {
+			return errors.New("request body is required")
+		}
+		return nil
+	}
+	mediaType, schema, ok := match(op.bodies, contentType)
+	if !ok {
+		return fmt.Errorf("request content type %q isn't one of %s", contentType, strings.Join(keys(op.bodies), ", "))
+	}
+	if schema == nil || !isJSON(mediaType) {
+		return nil
+	}
+	if err := validateJSON(schema, body); err != nil {
+		return fmt.Errorf("request body: %w", err)
+	}
+	return nil
+}
+
+// ValidateResponse checks a response's status and content type and, for
+// JSON responses, body.
+func (op *Operation) ValidateResponse(status int, contentType string, body []byte) error {
+	resp, ok := op.response(status)
+	if !ok {
+		return fmt.Errorf("status %d isn't documented", status)
+	}
+	if resp.content == nil {
+		return nil
+	}
+	mediaType, schema, ok := match(resp.content, contentType)
+	if !ok {
+		return fmt.Errorf("content type %q of status %d isn't one of %s", contentType, status, strings.Join(keys(resp.content), ", "))
+	}
+	if schema == nil || !isJSON(mediaType) {
+		return nil
+	}
+	if err := validateJSON(schema, body); err != nil {
+		return fmt.Errorf("status %d body: %w", status, err)
+	}
+	return nil
+}
+
+// BuffersResponse reports whether the response with status and contentType
+// has a body that ValidateResponse needs to see. Others can be streamed.
+func (op *Operation) BuffersResponse(status int, contentType string) bool {
+	resp, ok := op.response(status)
+	if !ok || resp.content == nil {
+		return false
+	}
+	mediaType, schema, ok := match(resp.content, contentType)
+	return ok && schema != nil && isJSON(mediaType)
+}
+
+func (op *Operation) response(status int) (*response, bool) {
+	code := strconv.Itoa(status)
+	for _, key := range []string{code, code[:1] + "XX", "default"} {
+		if resp, ok := op.responses[key]; ok {
+			return resp, true
+		}
+	}
+	return nil, false
+}
+
+// pathValues lines the request path up with the operation's path template.
+// A template ending in a parameter takes the rest of the path, like a
+// ServeMux wildcard.
+func (op *Operation) pathValues(u *url.URL) map[string]string {
+	template := strings.Split(strings.TrimPrefix(op.Path, "/"), "/")
+	segments := strings.Split(strings.TrimPrefix(u.EscapedPath(), "/"), "/")
+	values := map[string]string{}
+	for i, t := range template {
+		if i >= len(segments) {
+			break
+		}
+		if !strings.HasPrefix(t, "{") || !strings.HasSuffix(t, "}") {
+			continue
+		}
+		raw := segments[i]
+		if i == len(template)-1 {
+			raw = strings.Join(segments[i:], "/")
+		}
+		value, err := url.PathUnescape(raw)
+		if err != nil {
+			value = raw
+		}
+		values[t[1:len(t)-1]] = value
+	}
+	return values
+}
+
+// validate checks a parameter's string value, converted to the type the
+// schema asks for.
+func (p parameter) validate(value string) error {
+	if p.schema == nil {
+		return nil
+	}
+	var v any = value
+	switch p.typ {
+	case "integer", "number":
+		if _, err := strconv.ParseFloat(value, 64); err != nil {
+			return fmt.Errorf("%q isn't a number", value)
+		}
+		v = json.Number(value)
+	case "boolean":
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("%q isn't a boolean", value)
+		}
+		v = b
+	}
+	return describe(p.schema.Validate(v))
+}
+
+func validateJSON(schema *jsonschema.Schema, body []byte) error {
+	if len(bytes.TrimSpace(body)) == 0 {
+		return errors.New("body is empty")
+	}
+	v, err := jsonschema.UnmarshalJSON(bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("invalid JSON: %w", err)
+	}
+	return describe(schema.Validate(v))
+}
+
+// describe flattens a validation error into one line per failed keyword,
+// each prefixed with where in the value it failed.
+func describe(err error) error {
+	var verr *jsonschema.ValidationError
+	if !errors.As(err, &verr) {
+		return err
+	}
+	var lines []string
+	for _, unit := range verr.BasicOutput().Errors {
+		if unit.Error == nil {
+			continue
+		}
+		location := unit.InstanceLocation
+		if location == "" {
+			location = "/"
+		}
+		lines = append(lines, location+": "+unit.Error.String())
+	}
+	if len(lines) == 0 {
+		return err
+	}
+	return errors.New(strings.Join(lines, "; "))
+}
+
+// match finds the media type in content that covers contentType, ignoring
+// parameters such as charset. Ranges like video/* and */* are allowed on
+// the document's side.
+func match(content map[string]*jsonschema.Schema, contentType string) (string, *jsonschema.Schema, bool) {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		mediaType = strings.ToLower(strings.TrimSpace(contentType))
+	}
+	if schema, ok := content[mediaType]; ok {
+		return mediaType, schema, true
+	}
+	if typ, _, ok := strings.Cut(mediaType, "/"); ok {
+		if schema, ok := content[typ+"/*"]; ok {
+			return mediaType, schema, true
+		}
+	}
+	schema, ok := content["*/*"]
+	return mediaType, schema, ok
+}
+
+func isJSON(mediaType string) bool {
+	return mediaType == "application/json" || strings.HasSuffix(mediaType, "+json")
+}
+
+func keys(content map[string]*jsonschema.Schema) []string {
+	ks := make([]string, 0, len(content))
+	for k := range content {
+		ks = append(ks, k)
+	}
+	sort.Strings(ks)
+	return ks
+}
+
+// loader turns the parts of the document an Operation needs into compiled
+// schemas, following $refs between them.
+type loader struct {
+	doc      map[string]any
+	compiler *jsonschema.Compiler
+}
+
+func (l loader) operation(method, path, itemPtr, opPtr string) (*Operation, error) {
+	op := &Operation{Method: method, Path: path, responses: map[string]*response{}}
+
+	// Operation parameters override path item ones with the same name and
+	// location.
+	seen := map[string]bool{}
+	for _, ptr := range []string{opPtr, itemPtr} {
+		list, _ := l.lookup(ptr + "/parameters").([]any)
+		for i := range list {
+			p, err := l.parameter(fmt.Sprintf("%s/parameters/%d", ptr, i))
+			if err != nil {
+				return nil, err
+			}
+			if seen[p.in+" "+p.name] {
+				continue
+			}
+			seen[p.in+" "+p.name] = true
+			op.params = append(op.params, p)
+		}
+	}
+
+	if _, ok := l.lookup(opPtr + "/requestBody").(map[string]any); ok {
+		bodyPtr, body := l.resolve(opPtr + "/requestBody")
+		op.bodyRequired, _ = body["required"].(bool)
+		content, err := l.content(bodyPtr + "/content")
+		if err != nil {
+			return nil, err
+		}
+		op.bodies = content
+		if op.bodies == nil {
+			op.bodies = map[string]*jsonschema.Schema{}
+		}
+	}
+
+	responses, _ := l.lookup(opPtr + "/responses").(map[string]any)
+	for status := range responses {
+		respPtr, _ := l.resolve(opPtr + "/responses/" + escape(status))
+		content, err := l.content(respPtr + "/content")
+		if err != nil {
+			return nil, err
+		}
+		// Ranges may be written 4xx or 4XX.
+		if status != "default" {
+			status = strings.ToUpper(status)
+		}
+		op.responses[status] = &response{content: content}
+	}
+	return op, nil
+}
+
+func (l loader) parameter(ptr string) (parameter, error) {
+	ptr, raw := l.resolve(ptr)
+	p := parameter{}
+	p.name, _ = raw["name"].(string)
+	p.in, _ = raw["in"].(string)
+	p.required, _ = raw["required"].(bool)
+	if schema, ok := raw["schema"].(map[string]any); ok {
+		p.typ, _ = schema["type"].(string)
+		compiled, err := l.compile(ptr + "/schema")
+		if err != nil {
+			return p, err
+		}
+		p.schema = compiled
+	}
+	return p, nil
+}
+
+func (l loader) content(ptr string) (map[string]*jsonschema.Schema, error) {
+	raw, ok := l.lookup(ptr).(map[string]any)
+	if !ok {
+		return nil, nil
+	}
+	content := map[string]*jsonschema.Schema{}
+	for mediaType, media := range raw {
+		media, _ := media.(map[string]any)
+		var schema *jsonschema.Schema
+		if _, ok := media["schema"]; ok {
+			var err error
+			schema, err = l.compile(ptr + "/" + escape(mediaType) + "/schema")
+			if err != nil {
+				return nil, err
+			}
+		}
+		content[mediaType] = schema
+	}
+	return content, nil
+}
+
+func (l loader) compile(ptr string) (*jsonschema.Schema, error) {
+	return l.compiler.Compile(specURL + "#" + ptr)
+}
+
+// resolve follows a $ref to another part of the document.
+func (l loader) resolve(ptr string) (string, map[string]any) {
+	for range 10 {
+		obj, _ := l.lookup(ptr).(map[string]any)
+		ref, ok := obj["$ref"].(string)
+		if !ok || !strings.HasPrefix(ref, "#") {
+			return ptr, obj
+		}
+		ptr = strings.TrimPrefix(ref, "#")
+	}
+	return ptr, nil
+}
+
+// lookup evaluates a JSON pointer against the document.
+func (l loader) lookup(ptr string) any {
+	var v any = l.doc
+	for _, token := range strings.Split(strings.TrimPrefix(ptr, "/"), "/") {
+		token = strings.NewReplacer("~1", "/", "~0", "~").Replace(token)
+		switch node := v.(type) {
+		case map[string]any:
+			v = node[token]
+		case []any:
+			i, err := strconv.Atoi(token)
+			if err != nil || i < 0 || i >= len(node) {
+				return nil
+			}
+			v = node[i]
+		default:
+			return nil
+		}
+	}
+	return v
+}
+
+// escape makes s a single JSON pointer token.
+func escape(s string) string {
+	return strings.NewReplacer("~", "~0", "/", "~1").Replace(s)
+}
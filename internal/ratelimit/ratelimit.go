@@ -0,0 +1,117 @@
+package ratelimit
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// Bucket is the state of a single token bucket.
+type Bucket struct {
+	Tokens  float64
+	Updated time.Time
+}
+
+// Store keeps token buckets by key. Update must apply fn atomically for a
+// given key so concurrent requests can't spend the same token twice.
+type Store interface {
+	Update(key string, fn func(b Bucket, found bool) Bucket) error
+}
+
+// Limiter is a token bucket rate limiter: every key may spend up to Burst
+// tokens at once, refilled at Rate tokens per second.
+type Limiter struct {
+	Rate  float64
+	Burst int
+	Store Store
+
+	now func() time.Time
+}
+
+func New(rate float64, burst int, store Store) *Limiter {
+	if store == nil {
+		store = NewMemoryStore(10 * time.Minute)
+	}
+	return &Limiter{
+		Rate:  rate,
+		Burst: burst,
+		Store: store,
+		now:   time.Now,
+	}
+}
+
+// PerMinute is a convenience for building limiters from "n requests per minute".
+func PerMinute(n int) float64 {
+	return float64(n) / 60
+}
+
+// Allow spends one token for key. When no token is available it reports how
+// long the caller should wait before the next one.
+func (l *Limiter) Allow(key string) (bool, time.Duration, error) {
+	now := l.now()
+	allowed := false
+	var retryAfter time.Duration
+
+	err := l.Store.Update(key, func(b Bucket, found bool) Bucket {
+		if !found {
+			b = Bucket{Tokens: float64(l.Burst), Updated: now}
+		}
+
+		elapsed := now.Sub(b.Updated).Seconds()
+		if elapsed > 0 {
+			b.Tokens = math.Min(float64(l.Burst), b.Tokens+elapsed*l.Rate)
+		}
+		b.Updated = now
+
+		if b.Tokens >= 1 {
+			b.Tokens--
+			allowed = true
+			return b
+		}
+
+		if l.Rate > 0 {
+			retryAfter = time.Duration((1 - b.Tokens) / l.Rate * float64(time.Second))
+		}
+		return b
+	})
+	if err != nil {
+		return false, 0, err
+	}
+	return allowed, retryAfter, nil
+}
+
+// MemoryStore keeps buckets in process memory. Buckets that haven't been
+// touched for idleTTL are dropped, which is safe as long as idleTTL is longer
+// than the time it takes a bucket to refill.
+type MemoryStore struct {
+	mu        sync.Mutex
+	buckets   map[string]Bucket
+	idleTTL   time.Duration
+	lastSweep time.Time
+}
+
+func NewMemoryStore(idleTTL time.Duration) *MemoryStore {
+	return &MemoryStore{
+		buckets: map[string]Bucket{},
+		idleTTL: idleTTL,
+	}
+}
+
+func (s *MemoryStore) Update(key string, fn func(b Bucket, found bool) Bucket) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	b, found := s.buckets[key]
+	b = fn(b, found)
+	s.buckets[key] = b
+
+	if b.Updated.Sub(s.lastSweep) > s.idleTTL {
+		for k, other := range s.buckets {
+			if b.Updated.Sub(other.Updated) > s.idleTTL {
+				delete(s.buckets, k)
+			}
+		}
+		s.lastSweep = b.Updated
+	}
+	return nil
+}
@@ -0,0 +1,137 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const BackendLocal = "local"
+
+// Local keeps objects as files under a root directory. It's meant for
+// development and single-host deployments, files are served by the API
+// itself rather than a CDN.
+type Local struct {
+	root string
+}
+
+func NewLocal(root string) (*Local, error) {
+	root, err := filepath.Abs(root)
+	if err != nil {
+		return nil, err
+	}
+	err = os.MkdirAll(root, 0o755)
+	if err != nil {
+		return nil, err
+	}
+	return &Local{root: root}, nil
+}
+
+func (b *Local) Name() string {
+	return BackendLocal
+}
+
+// Bucket is the root directory.
+func (b *Local) Bucket() string {
+	return b.root
+}
+
+// Check makes sure the root is still a directory.
+func (b *Local) Check(ctx context.Context) error {
+	info, err := os.Stat(b.root)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("%s isn't a directory", b.root)
+	}
+	return nil
+}
+
+func (b *Local) Put(ctx context.Context, key string, body io.ReadSeeker, opts PutOptions) (Object, error) {
+	path, err := b.path(key)
+	if err != nil {
+		return Object{}, err
+	}
+	size, checksum, err := Describe(body)
+	if err != nil {
+		return Object{}, err
+	}
+
+	err = os.MkdirAll(filepath.Dir(path), 0o755)
+	if err != nil {
+		return Object{}, err
+	}
+
+	// Write next to the destination and rename, so readers never see a
+	// partial file.
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".upload-*")
+	if err != nil {
+		return Object{}, err
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = io.Copy(tmp, body)
+	if err != nil {
+		tmp.Close()
+		return Object{}, err
+	}
+	err = tmp.Close()
+	if err != nil {
+		return Object{}, err
+	}
+	// CreateTemp makes the file private, but thumbnails are served straight
+	// from the directory.
+	err = os.Chmod(tmp.Name(), 0o644)
+	if err != nil {
+		return Object{}, err
+	}
+	err = os.Rename(tmp.Name(), path)
+	if err != nil {
+		return Object{}, err
+	}
+
+	return Object{
+		Key:         key,
+		Size:        size,
+		Checksum:    checksum,
+		ContentType: opts.ContentType,
+	}, nil
+}
+
+func (b *Local) Delete(ctx context.Context, key string) error {
+	path, err := b.path(key)
+	if err != nil {
+		return err
+	}
+	err = os.Remove(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+// Open returns the stored file for reading. It implements Opener.
+func (b *Local) Open(ctx context.Context, key string) (io.ReadSeekCloser, error) {
+	path, err := b.path(key)
+	if err != nil {
+		return nil, err
+	}
+	return os.Open(path)
+}
+
+// path maps a key to a file under root, refusing keys that would escape it.
+func (b *Local) path(key string) (string, error) {
+	if key == "" || strings.HasPrefix(key, "/") || strings.Contains(key, `\`) {
+		return "", fmt.Errorf("invalid object key %q", key)
+	}
+	path := filepath.Join(b.root, filepath.FromSlash(key))
+	if !strings.HasPrefix(path, b.root+string(filepath.Separator)) {
+		return "", fmt.Errorf("invalid object key %q", key)
+	}
+	return path, nil
+}
@@ -0,0 +1,82 @@
+package storage
+
+import (
+	"context"
+	"io"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/metrics"
+)
+
+const BackendS3 = "s3"
+
+type S3 struct {
+	client *s3.Client
+	bucket string
+}
+
+func NewS3(client *s3.Client, bucket string) *S3 {
+	return &S3{client: client, bucket: bucket}
+}
+
+func (b *S3) Name() string {
+	return BackendS3
+}
+
+func (b *S3) Bucket() string {
+	return b.bucket
+}
+
+func (b *S3) Put(ctx context.Context, key string, body io.ReadSeeker, opts PutOptions) (Object, error) {
+	size, checksum, err := Describe(body)
+	if err != nil {
+		return Object{}, err
+	}
+
+	input := &s3.PutObjectInput{
+		Bucket:        aws.String(b.bucket),
+		Key:           aws.String(key),
+		Body:          body,
+		ContentType:   aws.String(opts.ContentType),
+		ContentLength: aws.Int64(size),
+	}
+	if opts.CacheControl != "" {
+		input.CacheControl = aws.String(opts.CacheControl)
+	}
+	start := time.Now()
+	_, err = b.client.PutObject(ctx, input)
+	metrics.ObserveS3("PutObject", start, err)
+	if err != nil {
+		return Object{}, err
+	}
+
+	return Object{
+		Key:         key,
+		Size:        size,
+		Checksum:    checksum,
+		ContentType: opts.ContentType,
+	}, nil
+}
+
+// Check sends a HeadBucket request, which needs the bucket to exist and
+// the credentials to be allowed to list it.
+func (b *S3) Check(ctx context.Context) error {
+	start := time.Now()
+	_, err := b.client.HeadBucket(ctx, &s3.HeadBucketInput{
+		Bucket: aws.String(b.bucket),
+	})
+	metrics.ObserveS3("HeadBucket", start, err)
+	return err
+}
+
+func (b *S3) Delete(ctx context.Context, key string) error {
+	start := time.Now()
+	_, err := b.client.DeleteObject(ctx, &s3.DeleteObjectInput{
+		Bucket: aws.String(b.bucket),
+		Key:    aws.String(key),
+	})
+	metrics.ObserveS3("DeleteObject", start, err)
+	return err
+}
@@ -0,0 +1,57 @@
+package storage
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+)
+
+// Object describes a stored file. Checksum is the hex SHA-256 of the content.
+type Object struct {
+	Key         string
+	Size        int64
+	Checksum    string
+	ContentType string
+}
+
+// Backend stores media files. Keys are slash separated paths like
+// "landscape/abc.mp4".
+type Backend interface {
+	// Name identifies the backend in storage_objects rows, e.g. "s3".
+	Name() string
+	// Bucket is the bucket (or root) objects are written to.
+	Bucket() string
+	Put(ctx context.Context, key string, body io.ReadSeeker, opts PutOptions) (Object, error)
+	Delete(ctx context.Context, key string) error
+	// Check reports whether the bucket can be reached, for readiness checks.
+	Check(ctx context.Context) error
+}
+
+type PutOptions struct {
+	ContentType string
+	// CacheControl is stored with the object where the backend supports it,
+	// so S3 and CDNs send it to browsers.
+	CacheControl string
+}
+
+// Opener is implemented by backends the API can read from directly. Backends
+// without it, like S3, are served through signed URLs instead.
+type Opener interface {
+	Open(ctx context.Context, key string) (io.ReadSeekCloser, error)
+}
+
+// Describe reads body to work out its size and checksum, then rewinds it so
+// it can be uploaded.
+func Describe(body io.ReadSeeker) (size int64, checksum string, err error) {
+	hash := sha256.New()
+	size, err = io.Copy(hash, body)
+	if err != nil {
+		return 0, "", err
+	}
+	_, err = body.Seek(0, io.SeekStart)
+	if err != nil {
+		return 0, "", err
+	}
+	return size, hex.EncodeToString(hash.Sum(nil)), nil
+}
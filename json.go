@@ -2,30 +2,45 @@ package main
 
 import (
 	"encoding/json"
-	"log"
+	"log/slog"
 	"net/http"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/apierror"
 )
 
+// respondWithError answers with a problem+json body. The error code comes
+// from the status, unless err says something more specific, see
+// apierror.From.
 func respondWithError(w http.ResponseWriter, code int, msg string, err error) {
-	if err != nil {
-		log.Println(err)
-	}
-	if code > 499 {
-		log.Printf("Responding with 5XX error: %s", msg)
-	}
-	type errorResponse struct {
-		Error string `json:"error"`
+	respondWithAPIError(w, apierror.From(code, msg, err))
+}
+
+// respondWithErrorCode is respondWithError with a code more specific than
+// the status implies, for failures clients are expected to act on.
+func respondWithErrorCode(w http.ResponseWriter, code int, errCode apierror.Code, msg string, err error) {
+	respondWithAPIError(w, apierror.FromCode(code, errCode, msg, err))
+}
+
+func respondWithAPIError(w http.ResponseWriter, apiErr *apierror.Error) {
+	// Inside the middleware stack the error goes on the request's access log
+	// line, which has the request ID.
+	if rec, ok := w.(errorRecorder); ok {
+		rec.recordError(apiErr)
+	} else if apiErr.Err != nil || apiErr.Status > 499 {
+		slog.Error("Responding with error", "status", apiErr.Status, "error_code", apiErr.Code, "error_message", apiErr.Detail, "error", apiErr.Err)
 	}
-	respondWithJSON(w, code, errorResponse{
-		Error: msg,
-	})
+	writeJSON(w, apiErr.Status, "application/problem+json", apiErr.Problem())
 }
 
 func respondWithJSON(w http.ResponseWriter, code int, payload interface{}) {
-	w.Header().Set("Content-Type", "application/json")
+	writeJSON(w, code, "application/json", payload)
+}
+
+func writeJSON(w http.ResponseWriter, code int, contentType string, payload interface{}) {
+	w.Header().Set("Content-Type", contentType)
 	dat, err := json.Marshal(payload)
 	if err != nil {
-		log.Printf("Error marshalling JSON: %s", err)
+		slog.Error("Error marshalling JSON", "error", err)
 		w.WriteHeader(500)
 		return
 	}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+const (
+	loginFailureWindow = 15 * time.Minute
+
+	// Back off exponentially after a few mistakes, then lock the account
+	// (or address) for a while once it's clearly being guessed at.
+	accountBackoffAfter  = 3
+	accountLockoutAfter  = 10
+	accountLockoutPeriod = 15 * time.Minute
+
+	ipBackoffAfter  = 20
+	ipLockoutAfter  = 100
+	ipLockoutPeriod = 15 * time.Minute
+
+	loginBackoffBase      = time.Second
+	loginBackoffMaxPeriod = 5 * time.Minute
+)
+
+type loginThrottle struct {
+	wait   time.Duration
+	reason string
+}
+
+// checkLoginThrottle looks at recent failed logins for the account and for the
+// client address and reports how long the caller has to wait, if at all.
+func (cfg *apiConfig) checkLoginThrottle(ctx context.Context, email, ip string) (loginThrottle, error) {
+	now := time.Now().UTC()
+	since := now.Add(-loginFailureWindow)
+
+	accountFailures, err := cfg.db.GetLoginFailuresByEmail(ctx, normalizeEmail(email), since)
+	if err != nil {
+		return loginThrottle{}, err
+	}
+	if wait := loginWait(now, accountFailures.Count, accountFailures.Last, accountBackoffAfter, accountLockoutAfter, accountLockoutPeriod); wait > 0 {
+		reason := "Too many failed login attempts, try again later"
+		if accountFailures.Count >= accountLockoutAfter {
+			reason = "Account temporarily locked after too many failed login attempts"
+		}
+		return loginThrottle{wait: wait, reason: reason}, nil
+	}
+
+	ipFailures, err := cfg.db.GetLoginFailuresByIP(ctx, ip, since)
+	if err != nil {
+		return loginThrottle{}, err
+	}
+	if wait := loginWait(now, ipFailures.Count, ipFailures.Last, ipBackoffAfter, ipLockoutAfter, ipLockoutPeriod); wait > 0 {
+		return loginThrottle{wait: wait, reason: "Too many failed login attempts from this address, try again later"}, nil
+	}
+
+	return loginThrottle{}, nil
+}
+
+func loginWait(now time.Time, failures int, last time.Time, backoffAfter, lockoutAfter int, lockoutPeriod time.Duration) time.Duration {
+	if failures < backoffAfter {
+		return 0
+	}
+
+	delay := lockoutPeriod
+	if failures < lockoutAfter {
+		delay = loginBackoffBase << (failures - backoffAfter)
+		if delay > loginBackoffMaxPeriod {
+			delay = loginBackoffMaxPeriod
+		}
+	}
+
+	return last.Add(delay).Sub(now)
+}
+
+// recordLoginAttempt saves an attempt for the throttle. Attempts older than
+// loginFailureWindow no longer count, so every window the old ones are
+// deleted, keeping the table from growing without bound.
+func (cfg *apiConfig) recordLoginAttempt(ctx context.Context, attempt database.CreateLoginAttemptParams) error {
+	err := cfg.db.CreateLoginAttempt(ctx, attempt)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	last := cfg.lastLoginAttemptSweep.Load()
+	if now.Sub(time.Unix(0, last)) < loginFailureWindow || !cfg.lastLoginAttemptSweep.CompareAndSwap(last, now.UnixNano()) {
+		return nil
+	}
+	if err := cfg.db.DeleteLoginAttemptsBefore(ctx, now.Add(-loginFailureWindow)); err != nil {
+		slog.WarnContext(ctx, "Couldn't delete old login attempts", "error", err)
+	}
+	return nil
+}
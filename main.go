@@ -2,18 +2,44 @@ package main
 
 import (
 	"context"
+	"errors"
+	"flag"
 	"log"
+	"log/slog"
+	"net"
 	"net/http"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
 
-	"github.com/aws/aws-sdk-go-v2/config"
+	awsconfig "github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/cloudfront"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/config"
 	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/logging"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/mailer"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/oidc"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/ratelimit"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/storage"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/tracing"
 
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/openapi"
 	"github.com/joho/godotenv"
 	_ "github.com/lib/pq"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.opentelemetry.io/contrib/instrumentation/github.com/aws/aws-sdk-go-v2/otelaws"
 )
 
+// shutdownGracePeriod is how long cancelled requests and background tasks
+// get to return once SHUTDOWN_TIMEOUT has passed.
+const shutdownGracePeriod = 5 * time.Second
+
 type apiConfig struct {
 	db               database.Client
 	jwtSecret        string
@@ -25,6 +51,24 @@ type apiConfig struct {
 	s3CfDistribution string
 	port             string
 	s3Client         *s3.Client
+	mediaStorage     storage.Backend
+	publicAssetsURL  string
+	defaultQuota     database.Quota
+	adminAPIKey      string
+	mailer           mailer.Mailer
+	videoDelivery    string
+	cfSigner         *cloudfront.Signer
+	cfCookieDomain   string
+	urlPolicy        urlSigningPolicy
+	background       *backgroundTasks
+	totpKey          []byte
+
+	// lastLoginAttemptSweep is when old login attempts were last deleted,
+	// in Unix nanoseconds, see recordLoginAttempt.
+	lastLoginAttemptSweep *atomic.Int64
+
+	requireVerifiedEmail bool
+	oidcProvider         *oidc.Provider
 }
 
 type thumbnail struct {
@@ -35,75 +79,112 @@ type thumbnail struct {
 func main() {
 	godotenv.Load(".env")
 
-	pathToDB := os.Getenv("DB_PATH")
-	if pathToDB == "" {
-		log.Fatal("DB_URL must be set")
+	conf, args, err := config.Load(os.Args[1:])
+	if errors.Is(err, flag.ErrHelp) {
+		return
 	}
-
-	db, err := database.NewClient(pathToDB)
 	if err != nil {
-		log.Fatalf("Couldn't connect to database: %v", err)
+		log.Fatalf("Invalid configuration:\n%v", err)
 	}
 
-	jwtSecret := os.Getenv("JWT_SECRET")
-	if jwtSecret == "" {
-		log.Fatal("JWT_SECRET environment variable is not set")
-	}
+	slog.SetDefault(logging.NewLogger(os.Stderr, conf.LogFormat, conf.SlogLevel()))
 
-	platform := os.Getenv("PLATFORM")
-	if platform == "" {
-		log.Fatal("PLATFORM environment variable is not set")
+	shutdownTracing, err := tracing.Setup(context.Background(), conf.OTelTracesExporter, "tubely")
+	if err != nil {
+		log.Fatalf("Couldn't set up tracing: %v", err)
 	}
 
-	filepathRoot := os.Getenv("FILEPATH_ROOT")
-	if filepathRoot == "" {
-		log.Fatal("FILEPATH_ROOT environment variable is not set")
+	db, err := database.NewClient(conf.DBPath)
+	if err != nil {
+		log.Fatalf("Couldn't connect to database: %v", err)
 	}
 
-	assetsRoot := os.Getenv("ASSETS_ROOT")
-	if assetsRoot == "" {
-		log.Fatal("ASSETS_ROOT environment variable is not set")
+	var cfSigner *cloudfront.Signer
+	if conf.VideoDelivery == config.DeliveryCloudFront {
+		cfSigner, err = cloudfront.LoadSigner(conf.S3CfDistro, conf.CFKeyPairID, conf.CFPrivateKeyPath)
+		if err != nil {
+			log.Fatalf("Couldn't set up CloudFront signing: %v", err)
+		}
 	}
 
-	s3Bucket := os.Getenv("S3_BUCKET")
-	if s3Bucket == "" {
-		log.Fatal("S3_BUCKET environment variable is not set")
+	urlPolicy := urlSigningPolicy{
+		defaultTTL:   conf.URLTTL,
+		downloadTTL:  conf.DownloadURLTTL,
+		bindClientIP: conf.URLBindIP,
 	}
 
-	s3Region := os.Getenv("S3_REGION")
-	if s3Region == "" {
-		log.Fatal("S3_REGION environment variable is not set")
+	appMailer, err := mailer.New(conf.Mailer, conf.MailFrom, conf.MailDir)
+	if err != nil {
+		log.Fatalf("Couldn't set up mailer: %v", err)
 	}
 
-	s3CfDistribution := os.Getenv("S3_CF_DISTRO")
-	if s3CfDistribution == "" {
-		log.Fatal("S3_CF_DISTRO environment variable is not set")
+	var oidcProvider *oidc.Provider
+	if conf.OIDCIssuer != "" {
+		oidcProvider = oidc.NewProvider(oidc.Config{
+			Issuer:       conf.OIDCIssuer,
+			ClientID:     conf.OIDCClientID,
+			ClientSecret: conf.OIDCClientSecret,
+			RedirectURL:  conf.OIDCRedirectURL,
+		})
 	}
 
-	port := os.Getenv("PORT")
-	if port == "" {
-		log.Fatal("PORT environment variable is not set")
-	}
+	// With local storage S3 is optional, it's only needed for videos
+	// uploaded to S3 before the switch.
+	var awsS3Client *s3.Client
+	if conf.S3Configured() {
+		awsConfig, err := awsconfig.LoadDefaultConfig(context.TODO(), awsconfig.WithRegion(conf.S3Region))
+		if err != nil {
+			log.Fatal(err)
+		}
+		otelaws.AppendMiddlewares(&awsConfig.APIOptions)
 
-	awsConfig, err := config.LoadDefaultConfig(context.TODO(), config.WithRegion(s3Region))
-	if err != nil {
-		log.Fatal(err)
+		// Create an Amazon S3 service client
+		awsS3Client = s3.NewFromConfig(awsConfig)
 	}
 
-	// Create an Amazon S3 service client
-	awsS3Client := s3.NewFromConfig(awsConfig)
+	// Where uploaded videos and thumbnails go. With local storage the API
+	// serves them itself.
+	var mediaStorage storage.Backend
+	switch conf.StorageBackend {
+	case config.StorageS3:
+		mediaStorage = storage.NewS3(awsS3Client, conf.S3Bucket)
+	case config.StorageLocal:
+		mediaStorage, err = storage.NewLocal(conf.LocalStorageDir)
+		if err != nil {
+			log.Fatalf("Couldn't set up local storage: %v", err)
+		}
+	}
 
 	cfg := apiConfig{
 		db:               db,
-		jwtSecret:        jwtSecret,
-		platform:         platform,
-		filepathRoot:     filepathRoot,
-		assetsRoot:       assetsRoot,
-		s3Bucket:         s3Bucket,
-		s3Region:         s3Region,
-		s3CfDistribution: s3CfDistribution,
-		port:             port,
+		jwtSecret:        conf.JWTSecret,
+		totpKey:          auth.TOTPKey(conf.JWTSecret),
+		platform:         conf.Platform,
+		filepathRoot:     conf.FilepathRoot,
+		assetsRoot:       conf.AssetsRoot,
+		s3Bucket:         conf.S3Bucket,
+		s3Region:         conf.S3Region,
+		s3CfDistribution: conf.S3CfDistro,
+		port:             conf.Port,
 		s3Client:         awsS3Client,
+		mediaStorage:     mediaStorage,
+		publicAssetsURL:  conf.PublicAssetsURL,
+		defaultQuota: database.Quota{
+			MaxBytes:  conf.QuotaMaxBytes,
+			MaxVideos: int(conf.QuotaMaxVideos),
+		},
+		adminAPIKey:    conf.AdminAPIKey,
+		mailer:         appMailer,
+		videoDelivery:  conf.VideoDelivery,
+		cfSigner:       cfSigner,
+		cfCookieDomain: conf.CFCookieDomain,
+		urlPolicy:      urlPolicy,
+		background:     newBackgroundTasks(),
+
+		lastLoginAttemptSweep: new(atomic.Int64),
+
+		requireVerifiedEmail: conf.RequireVerifiedEmail,
+		oidcProvider:         oidcProvider,
 	}
 
 	err = cfg.ensureAssetsDir()
@@ -111,34 +192,212 @@ func main() {
 		log.Fatalf("Couldn't create assets directory: %v", err)
 	}
 
+	if len(args) > 0 {
+		if args[0] != "migrate-assets" {
+			log.Fatalf("Unknown command %q, the only one is migrate-assets", args[0])
+		}
+		err = cfg.runMigrateAssets(args[1:])
+		if err != nil {
+			log.Fatalf("Couldn't migrate assets: %v", err)
+		}
+		return
+	}
+
+	cleanupStaleUploads()
+
 	mux := http.NewServeMux()
-	appHandler := http.StripPrefix("/app", http.FileServer(http.Dir(filepathRoot)))
+	appHandler := http.StripPrefix("/app", http.FileServer(http.Dir(cfg.filepathRoot)))
 	mux.Handle("/app/", appHandler)
 
-	assetsHandler := http.StripPrefix("/assets", http.FileServer(http.Dir(assetsRoot)))
-	mux.Handle("/assets/", noCacheMiddleware(assetsHandler))
+	// Thumbnails uploaded before they moved to the storage backend, until
+	// `tubely migrate-assets` has run.
+	assetsHandler := http.StripPrefix("/assets", cfg.assetCacheMiddleware(cfg.assetsRoot, http.FileServer(http.Dir(cfg.assetsRoot))))
+	mux.Handle("/assets/", assetsHandler)
+
+	if local, ok := mediaStorage.(*storage.Local); ok {
+		// Only thumbnails are public, videos go through the stream endpoint.
+		thumbnailDir := filepath.Join(local.Bucket(), thumbnailKeyPrefix)
+		thumbnailHandler := http.StripPrefix("/media/"+thumbnailKeyPrefix, cfg.assetCacheMiddleware(thumbnailDir, http.FileServer(http.Dir(thumbnailDir))))
+		mux.Handle("/media/"+thumbnailKeyPrefix, thumbnailHandler)
+	}
+
+	loginLimiter := ratelimit.New(ratelimit.PerMinute(10), 10, nil)
+	signupLimiter := ratelimit.New(ratelimit.PerMinute(5), 5, nil)
+	passwordResetLimiter := ratelimit.New(ratelimit.PerMinute(5), 5, nil)
+	uploadLimiter := ratelimit.New(ratelimit.PerMinute(20), 10, nil)
 
-	mux.HandleFunc("POST /api/login", cfg.handlerLogin)
+	mux.Handle("POST /api/login", rateLimitMiddleware(loginLimiter, http.HandlerFunc(cfg.handlerLogin)))
+	mux.Handle("POST /api/login/mfa", rateLimitMiddleware(loginLimiter, http.HandlerFunc(cfg.handlerLoginMFA)))
+	mux.HandleFunc("GET /api/oidc/login", cfg.handlerOIDCLogin)
+	mux.HandleFunc("GET /api/oidc/callback", cfg.handlerOIDCCallback)
+	mux.HandleFunc("POST /api/oidc/exchange", cfg.handlerOIDCExchange)
+	mux.HandleFunc("POST /api/oidc/link", cfg.handlerOIDCLink)
 	mux.HandleFunc("POST /api/refresh", cfg.handlerRefresh)
 	mux.HandleFunc("POST /api/revoke", cfg.handlerRevoke)
 
-	mux.HandleFunc("POST /api/users", cfg.handlerUsersCreate)
+	mux.Handle("POST /api/users", rateLimitMiddleware(signupLimiter, http.HandlerFunc(cfg.handlerUsersCreate)))
+	mux.HandleFunc("POST /api/users/password", cfg.handlerPasswordChange)
+	mux.HandleFunc("POST /api/users/totp", cfg.handlerTOTPEnroll)
+	mux.HandleFunc("POST /api/users/totp/confirm", cfg.handlerTOTPConfirm)
+	mux.HandleFunc("DELETE /api/users/totp", cfg.handlerTOTPDisable)
+	mux.HandleFunc("POST /api/users/verify", cfg.handlerUsersVerifyEmail)
+	mux.HandleFunc("POST /api/users/verify/resend", cfg.handlerUsersResendVerification)
+	mux.Handle("POST /api/password_reset", rateLimitMiddleware(passwordResetLimiter, http.HandlerFunc(cfg.handlerPasswordResetRequest)))
+	mux.HandleFunc("POST /api/password_reset/confirm", cfg.handlerPasswordReset)
 
 	mux.HandleFunc("POST /api/videos", cfg.handlerVideoMetaCreate)
-	mux.HandleFunc("POST /api/thumbnail_upload/{videoID}", cfg.handlerUploadThumbnail)
-	mux.HandleFunc("POST /api/video_upload/{videoID}", cfg.handlerUploadVideo)
+	mux.Handle("POST /api/thumbnail_upload/{videoID}", rateLimitMiddleware(uploadLimiter, http.HandlerFunc(cfg.handlerUploadThumbnail)))
+	mux.Handle("POST /api/video_upload/{videoID}", rateLimitMiddleware(uploadLimiter, http.HandlerFunc(cfg.handlerUploadVideo)))
 	mux.HandleFunc("GET /api/videos", cfg.handlerVideosRetrieve)
 	mux.HandleFunc("GET /api/videos/{videoID}", cfg.handlerVideoGet)
+	mux.HandleFunc("PATCH /api/videos/{videoID}", cfg.handlerVideoUpdate)
+	mux.HandleFunc("POST /api/videos/{videoID}/share_tokens", cfg.handlerShareTokenCreate)
+	mux.HandleFunc("GET /api/videos/{videoID}/share_tokens", cfg.handlerShareTokensList)
+	mux.HandleFunc("DELETE /api/videos/{videoID}/share_tokens/{tokenID}", cfg.handlerShareTokenRevoke)
+	mux.HandleFunc("GET /api/public/videos", cfg.handlerPublicVideos)
+	mux.HandleFunc("POST /api/videos/{videoID}/playback_cookies", cfg.handlerVideoPlaybackCookies)
+	mux.HandleFunc("GET /api/videos/{videoID}/download", cfg.handlerVideoDownload)
+	mux.HandleFunc("GET /api/videos/{videoID}/stream", cfg.handlerVideoStream)
 	// mux.HandleFunc("GET /api/thumbnails/{videoID}", cfg.handlerThumbnailGet)
 	mux.HandleFunc("DELETE /api/videos/{videoID}", cfg.handlerVideoMetaDelete)
 
+	mux.HandleFunc("GET /api/me/usage", cfg.handlerUsage)
+
+	mux.Handle("GET /metrics", promhttp.Handler())
+	mux.HandleFunc("GET /healthz", handlerHealthz)
+	mux.HandleFunc("GET /readyz", cfg.handlerReadyz)
+	mux.HandleFunc("GET /version", handlerVersion)
+
+	mux.HandleFunc("GET /api/openapi.json", handlerOpenAPISpec)
+	mux.HandleFunc("GET /api/docs", handlerAPIDocs)
+
 	mux.HandleFunc("POST /admin/reset", cfg.handlerReset)
+	mux.HandleFunc("PUT /admin/users/{userID}/quota", cfg.handlerAdminSetQuota)
+
+	// Requests run under baseCtx, cancelling it stops uploads and kills
+	// their ffmpeg processes.
+	baseCtx, cancelRequests := context.WithCancel(context.Background())
+	defer cancelRequests()
+
+	// Uploads and streams move whole videos, the server timeouts would cut
+	// them off.
+	transferTimeout := conf.TransferTimeout
+	routeLimits := map[string]routeLimit{
+		"POST /api/video_upload/{videoID}":     {maxBody: maxVideoUploadBytes, timeout: transferTimeout},
+		"POST /api/thumbnail_upload/{videoID}": {maxBody: maxThumbnailUploadBytes, timeout: transferTimeout},
+		"GET /api/videos/{videoID}/stream":     {timeout: transferTimeout},
+	}
+	const maxBodyBytes = 1 << 20
+
+	var requestsInFlight sync.WaitGroup
+	middlewares := []middleware{trackRequestsMiddleware(&requestsInFlight)}
+	if proxies := newTrustedProxies(conf); proxies != nil {
+		middlewares = append(middlewares, realIPMiddleware(proxies))
+	}
+	middlewares = append(middlewares, requestIDMiddleware, tracingMiddleware, metricsMiddleware, cfg.accessLogMiddleware)
+	if policy := newCORSPolicy(conf); policy != nil {
+		middlewares = append(middlewares, corsMiddleware(policy))
+	}
+	middlewares = append(middlewares, routeLimitsMiddleware(mux, routeLimits, maxBodyBytes))
+	// Handlers drifting from the OpenAPI document fail loudly in development.
+	// Buffering every JSON body is too costly for production.
+	if cfg.platform == "dev" {
+		validator, err := openapi.NewValidator()
+		if err != nil {
+			log.Fatalf("Couldn't load OpenAPI document: %v", err)
+		}
+		middlewares = append(middlewares, openAPIValidationMiddleware(mux, validator))
+	}
 
 	srv := &http.Server{
-		Addr:    ":" + port,
-		Handler: mux,
+		Addr:              ":" + conf.Port,
+		Handler:           chain(mux, middlewares...),
+		BaseContext:       func(net.Listener) context.Context { return baseCtx },
+		ReadHeaderTimeout: conf.ReadHeaderTimeout,
+		ReadTimeout:       conf.ReadTimeout,
+		WriteTimeout:      conf.WriteTimeout,
+		IdleTimeout:       conf.IdleTimeout,
+		MaxHeaderBytes:    int(conf.MaxHeaderBytes),
+	}
+
+	// TLS is optional, most deployments terminate it at a load balancer.
+	scheme := "http"
+	if conf.TLSCertFile != "" {
+		certs, err := newCertReloader(conf.TLSCertFile, conf.TLSKeyFile)
+		if err != nil {
+			log.Fatalf("Couldn't set up TLS: %v", err)
+		}
+		srv.TLSConfig = serverTLSConfig(certs)
+		scheme = "https"
 	}
 
-	log.Printf("Serving on: http://localhost:%s/app/\n", port)
-	log.Fatal(srv.ListenAndServe())
+	serveErr := make(chan error, 1)
+	go func() {
+		slog.Info("Serving", "url", scheme+"://localhost:"+conf.Port+"/app/")
+		if srv.TLSConfig != nil {
+			// The certificate comes from TLSConfig.GetCertificate.
+			serveErr <- srv.ListenAndServeTLS("", "")
+		} else {
+			serveErr <- srv.ListenAndServe()
+		}
+	}()
+
+	signals, stopSignals := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stopSignals()
+	select {
+	case err := <-serveErr:
+		log.Fatal(err)
+	case <-signals.Done():
+	}
+	// A second signal kills the process straight away.
+	stopSignals()
+
+	slog.Info("Shutting down, waiting for requests in flight", "timeout", conf.ShutdownTimeout)
+	shutdownCtx, cancelShutdown := context.WithTimeout(context.Background(), conf.ShutdownTimeout)
+	defer cancelShutdown()
+
+	// Past the timeout, whatever is still running is cancelled and gets a
+	// short grace period to return, since it may still be cleaning up and
+	// writing to the database. Handlers go first, they start background
+	// tasks to delete files.
+	stopped := true
+	err = srv.Shutdown(shutdownCtx)
+	if err != nil {
+		slog.Warn("Requests still running at the drain timeout, cancelling them", "error", err)
+		cancelRequests()
+		srv.Close()
+		graceCtx, cancelGrace := context.WithTimeout(context.Background(), shutdownGracePeriod)
+		defer cancelGrace()
+		// Close doesn't wait for handlers to return.
+		if err := waitGroupContext(graceCtx, &requestsInFlight); err != nil {
+			slog.Error("Requests didn't stop after being cancelled", "error", err)
+			stopped = false
+		}
+	}
+	err = cfg.background.Drain(shutdownCtx)
+	if err != nil {
+		slog.Warn("Background tasks still running at the drain timeout, cancelling them", "error", err)
+		graceCtx, cancelGrace := context.WithTimeout(context.Background(), shutdownGracePeriod)
+		defer cancelGrace()
+		if err := cfg.background.Wait(graceCtx); err != nil {
+			slog.Error("Background tasks didn't stop after being cancelled", "error", err)
+			stopped = false
+		}
+	}
+
+	flushCtx, cancelFlush := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFlush()
+	err = shutdownTracing(flushCtx)
+	if err != nil {
+		slog.Warn("Couldn't flush traces", "error", err)
+	}
+	// Closing the database under work that's still running would fail it
+	// halfway, SQLite recovers from the process exiting instead.
+	if stopped {
+		err = db.Close()
+		if err != nil {
+			slog.Warn("Couldn't close database", "error", err)
+		}
+	}
+	slog.Info("Shut down")
 }
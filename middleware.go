@@ -0,0 +1,279 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/apierror"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/logging"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/metrics"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const requestIDHeader = "X-Request-ID"
+
+var tracer = otel.Tracer("github.com/bootdotdev/learn-file-storage-s3-golang-starter")
+
+// endSpan ends span, marking it failed if err isn't nil.
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+type middleware func(http.Handler) http.Handler
+
+// chain wraps h in middlewares, the first one being the outermost.
+func chain(h http.Handler, middlewares ...middleware) http.Handler {
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		h = middlewares[i](h)
+	}
+	return h
+}
+
+// trackRequestsMiddleware counts handlers in wg, so shutdown can wait for
+// them to return after http.Server.Close, which doesn't.
+func trackRequestsMiddleware(wg *sync.WaitGroup) middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			wg.Add(1)
+			defer wg.Done()
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// requestIDMiddleware keeps the caller's X-Request-ID, or makes one up, and
+// puts it in the context for logging and in the response.
+func requestIDMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestID := r.Header.Get(requestIDHeader)
+		if !validRequestID(requestID) {
+			requestID = newRequestID()
+		}
+		w.Header().Set(requestIDHeader, requestID)
+		ctx := logging.WithRequestID(r.Context(), requestID)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// validRequestID accepts IDs from upstream proxies as long as they're short
+// printable ASCII, so they can't mangle log lines.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > 128 {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] < 0x21 || id[i] > 0x7e {
+			return false
+		}
+	}
+	return true
+}
+
+func newRequestID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// probeRoutes are only logged at debug level unless they fail.
+var probeRoutes = map[string]bool{
+	"GET /healthz": true,
+	"GET /readyz":  true,
+}
+
+// accessLogMiddleware writes one log line per request. It must run inside
+// requestIDMiddleware. The route is the ServeMux pattern, which is only
+// known after the mux has handled the request.
+func (cfg *apiConfig) accessLogMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+
+		// Tag the request with the caller, if they sent a valid access
+		// token, so every log line for it carries their ID.
+		if token, err := auth.GetBearerToken(r.Header); err == nil {
+			if userID, err := auth.ValidateJWT(token, cfg.jwtSecret); err == nil {
+				logging.SetUserID(r.Context(), userID.String())
+			}
+		}
+
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, r)
+
+		route := r.Pattern
+		if route == "" {
+			route = "unmatched"
+		}
+		attrs := []slog.Attr{
+			slog.String("method", r.Method),
+			slog.String("route", route),
+			slog.String("path", r.URL.Path),
+			slog.Int("status", rec.status),
+			slog.Int64("bytes", rec.bytes),
+			slog.Duration("duration", time.Since(start)),
+			slog.String("remote_ip", clientIP(r)),
+		}
+		if rec.apiErr != nil {
+			attrs = append(attrs,
+				slog.String("error_code", string(rec.apiErr.Code)),
+				slog.String("error_message", rec.apiErr.Detail),
+			)
+			if rec.apiErr.Err != nil {
+				attrs = append(attrs, slog.String("error", rec.apiErr.Err.Error()))
+			}
+		}
+
+		level := slog.LevelInfo
+		if rec.status >= 500 {
+			level = slog.LevelError
+		} else if probeRoutes[route] {
+			// The orchestrator calls these every few seconds.
+			level = slog.LevelDebug
+		}
+		slog.LogAttrs(r.Context(), level, "request", attrs...)
+	})
+}
+
+// tracingMiddleware starts a server span for each request, continuing the
+// caller's trace if it sent a traceparent header. It must run inside
+// requestIDMiddleware and outside the middlewares that read r.Pattern, since
+// it replaces the request.
+func tracingMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+		ctx, span := tracer.Start(ctx, r.Method, trace.WithSpanKind(trace.SpanKindServer), trace.WithAttributes(
+			attribute.String("http.request.method", r.Method),
+			attribute.String("url.path", r.URL.Path),
+			attribute.String("request_id", logging.RequestID(ctx)),
+		))
+		defer span.End()
+
+		r = r.WithContext(ctx)
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, r)
+
+		if r.Pattern != "" {
+			span.SetName(r.Pattern)
+			span.SetAttributes(attribute.String("http.route", r.Pattern))
+		}
+		span.SetAttributes(attribute.Int("http.response.status_code", rec.status))
+		if rec.status >= 500 {
+			span.SetStatus(codes.Error, http.StatusText(rec.status))
+		}
+	})
+}
+
+// metricsMiddleware counts requests and times them per route. It must run
+// inside requestIDMiddleware, which replaces the request, so that it sees the
+// pattern the mux sets.
+func metricsMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, r)
+
+		// Unmatched paths share a label, so scanners can't blow up the
+		// number of series.
+		route := r.Pattern
+		if route == "" {
+			route = "unmatched"
+		}
+		metrics.HTTPRequests.WithLabelValues(r.Method, route, strconv.Itoa(rec.status)).Inc()
+		metrics.HTTPRequestDuration.WithLabelValues(r.Method, route).Observe(time.Since(start).Seconds())
+	})
+}
+
+// routeLimit overrides the server wide limits for one route.
+type routeLimit struct {
+	// maxBody caps the request body, 0 means the default.
+	maxBody int64
+	// timeout replaces the server's read and write timeouts, for routes
+	// that move whole videos. 0 keeps the server's.
+	timeout time.Duration
+}
+
+// routeLimitsMiddleware caps request bodies, answering 413 to ones that are
+// too large, and lifts the server timeouts on routes that need longer. It
+// looks the route up in mux itself, since r.Pattern isn't set yet.
+func routeLimitsMiddleware(mux *http.ServeMux, limits map[string]routeLimit, defaultMaxBody int64) middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, pattern := mux.Handler(r)
+			limit := limits[pattern]
+			if limit.maxBody == 0 {
+				limit.maxBody = defaultMaxBody
+			}
+
+			if r.ContentLength > limit.maxBody {
+				respondWithError(w, http.StatusRequestEntityTooLarge, "", &http.MaxBytesError{Limit: limit.maxBody})
+				return
+			}
+			r.Body = http.MaxBytesReader(w, r.Body, limit.maxBody)
+
+			if limit.timeout > 0 {
+				deadline := time.Now().Add(limit.timeout)
+				rc := http.NewResponseController(w)
+				err := rc.SetReadDeadline(deadline)
+				if err == nil {
+					err = rc.SetWriteDeadline(deadline)
+				}
+				if err != nil {
+					slog.WarnContext(r.Context(), "Couldn't extend request deadlines", "error", err)
+				}
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// statusRecorder remembers what a handler sent, for the access log.
+type statusRecorder struct {
+	http.ResponseWriter
+	status      int
+	bytes       int64
+	wroteHeader bool
+	apiErr      *apierror.Error
+}
+
+func (rec *statusRecorder) WriteHeader(code int) {
+	if !rec.wroteHeader {
+		rec.status = code
+		rec.wroteHeader = true
+	}
+	rec.ResponseWriter.WriteHeader(code)
+}
+
+func (rec *statusRecorder) Write(b []byte) (int, error) {
+	rec.wroteHeader = true
+	n, err := rec.ResponseWriter.Write(b)
+	rec.bytes += int64(n)
+	return n, err
+}
+
+// Unwrap lets http.ResponseController reach the real writer.
+func (rec *statusRecorder) Unwrap() http.ResponseWriter {
+	return rec.ResponseWriter
+}
+
+func (rec *statusRecorder) recordError(apiErr *apierror.Error) {
+	rec.apiErr = apiErr
+}
+
+// errorRecorder is implemented by response writers that log the error
+// along with the request, see respondWithError.
+type errorRecorder interface {
+	recordError(apiErr *apierror.Error)
+}
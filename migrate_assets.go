@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"image"
+	"log/slog"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/imaging"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/media"
+)
+
+// runMigrateAssets implements `tubely migrate-assets`. It copies thumbnails
+// still referenced from the local assets directory into the storage backend
+// and points their videos at the stored copies. Running it again skips
+// videos that were already moved.
+func (cfg apiConfig) runMigrateAssets(args []string) error {
+	flags := flag.NewFlagSet("migrate-assets", flag.ContinueOnError)
+	deleteOriginals := flags.Bool("delete", false, "remove files from the assets directory once they're stored")
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+	videos, err := cfg.db.ListVideos(ctx)
+	if err != nil {
+		return err
+	}
+
+	migrated := 0
+	for _, video := range videos {
+		var moved []string
+		if len(video.ThumbnailVariants) > 0 {
+			moved, err = cfg.migrateThumbnailVariants(ctx, &video)
+		} else {
+			moved, err = cfg.migrateLegacyThumbnail(ctx, &video)
+		}
+		if err != nil {
+			return fmt.Errorf("video %s: %w", video.ID, err)
+		}
+		if len(moved) == 0 {
+			continue
+		}
+
+		video.ThumbnailURL = cfg.largestThumbnailURL(video.ThumbnailVariants, imaging.FormatJPEG)
+		err = cfg.db.UpdateVideo(ctx, video)
+		if err != nil {
+			return fmt.Errorf("video %s: %w", video.ID, err)
+		}
+		migrated++
+		slog.Info("Moved thumbnails to storage", "video_id", video.ID, "files", len(moved), "backend", cfg.mediaStorage.Name())
+
+		if *deleteOriginals {
+			for _, name := range moved {
+				err := os.Remove(cfg.getAssetDiskPath(name))
+				if err != nil && !os.IsNotExist(err) {
+					slog.Warn("Couldn't delete migrated asset", "file", name, "error", err)
+				}
+			}
+		}
+	}
+
+	slog.Info("Migrated thumbnails", "migrated", migrated, "videos", len(videos))
+	return nil
+}
+
+// migrateThumbnailVariants stores variants that were written to the assets
+// directory. It returns the names of the files it moved.
+func (cfg apiConfig) migrateThumbnailVariants(ctx context.Context, video *database.Video) ([]string, error) {
+	var moved []string
+	for i, variant := range video.ThumbnailVariants {
+		if variant.Key != "" {
+			continue
+		}
+		name, ok := localAssetName(variant.URL)
+		if !ok {
+			continue
+		}
+		data, err := os.ReadFile(cfg.getAssetDiskPath(name))
+		if os.IsNotExist(err) {
+			slog.Warn("Skipping thumbnail variant, its file is missing", "video_id", video.ID, "file", name)
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		key, err := cfg.saveThumbnail(ctx, data, variant.Format)
+		if err != nil {
+			return nil, err
+		}
+		video.ThumbnailVariants[i].Key = key
+		video.ThumbnailVariants[i].URL = ""
+		moved = append(moved, name)
+	}
+	return moved, nil
+}
+
+// migrateLegacyThumbnail stores a thumbnail uploaded before variants
+// existed, turning it into a single variant.
+func (cfg apiConfig) migrateLegacyThumbnail(ctx context.Context, video *database.Video) ([]string, error) {
+	if video.ThumbnailURL == nil {
+		return nil, nil
+	}
+	name, ok := localAssetName(*video.ThumbnailURL)
+	if !ok {
+		return nil, nil
+	}
+	data, err := os.ReadFile(cfg.getAssetDiskPath(name))
+	if os.IsNotExist(err) {
+		slog.Warn("Skipping video, its thumbnail is missing", "video_id", video.ID, "file", name)
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	mediaType := media.SniffImage(data)
+	config, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if mediaType == "" || err != nil {
+		slog.Warn("Skipping video, its thumbnail isn't a supported image", "video_id", video.ID, "file", name)
+		return nil, nil
+	}
+
+	key, err := cfg.saveThumbnail(ctx, data, mediaType)
+	if err != nil {
+		return nil, err
+	}
+	video.ThumbnailVariants = []database.ThumbnailVariant{{
+		Format: mediaType,
+		Width:  config.Width,
+		Height: config.Height,
+		Key:    key,
+	}}
+	return []string{name}, nil
+}
+
+// localAssetName returns the file name behind an /assets/ URL as written by
+// older versions, e.g. "http://localhost:8091/assets/abc.png".
+func localAssetName(rawURL string) (string, bool) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "", false
+	}
+	name, ok := strings.CutPrefix(u.Path, "/assets/")
+	if !ok || name == "" || name != path.Base(name) {
+		return "", false
+	}
+	return name, true
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime"
+	"net/http"
+	"strings"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/apierror"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/openapi"
+)
+
+func handlerOpenAPISpec(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(openapi.Spec)
+}
+
+func handlerAPIDocs(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write(openapi.DocsPage)
+}
+
+// openAPIValidationMiddleware checks every request and response against the
+// OpenAPI document, so a handler drifting from it is noticed in development
+// rather than by a client. Requests that don't match are refused with a 400,
+// responses that don't match are replaced with a 500 saying what's wrong, if
+// they haven't been sent yet, and logged either way. Routes missing from the
+// document always fail.
+func openAPIValidationMiddleware(mux *http.ServeMux, validator *openapi.Validator) middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			// Requests the mux has no route for get its 404 or 405.
+			_, pattern := mux.Handler(r)
+			if pattern == "" {
+				next.ServeHTTP(w, r)
+				return
+			}
+			op, ok := validator.Operation(r.Method, pattern)
+			if !ok {
+				err := fmt.Errorf("route %q is missing from the OpenAPI document", pattern)
+				slog.ErrorContext(r.Context(), "Route isn't in the OpenAPI document", "pattern", pattern)
+				respondWithErrorCode(w, http.StatusInternalServerError, apierror.CodeSpecViolation, err.Error(), nil)
+				return
+			}
+
+			var body []byte
+			if isJSONContentType(r.Header.Get("Content-Type")) {
+				var err error
+				body, err = io.ReadAll(r.Body)
+				if err != nil {
+					respondWithError(w, http.StatusBadRequest, "Couldn't read request body", err)
+					return
+				}
+				r.Body = io.NopCloser(bytes.NewReader(body))
+			}
+			if err := op.ValidateRequest(r, body); err != nil {
+				respondWithErrorCode(w, http.StatusBadRequest, apierror.CodeInvalidRequest, "Request doesn't match the API: "+err.Error(), nil)
+				return
+			}
+
+			vw := &validatingWriter{ResponseWriter: w, op: op, status: http.StatusOK}
+			next.ServeHTTP(vw, r)
+			vw.finish(r)
+		})
+	}
+}
+
+func isJSONContentType(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	return err == nil && (mediaType == "application/json" || strings.HasSuffix(mediaType, "+json"))
+}
+
+// validatingWriter holds a response back until it knows whether the
+// document allows it. The status and content type are checked when the
+// first byte is written, since net/http sniffs a missing content type from
+// it. JSON bodies are then buffered and checked at the end, everything else
+// is streamed.
+type validatingWriter struct {
+	http.ResponseWriter
+	op *openapi.Operation
+
+	status      int
+	wroteHeader bool
+	started     bool
+	buffering   bool
+	buf         bytes.Buffer
+	violation   error
+}
+
+func (vw *validatingWriter) WriteHeader(code int) {
+	if vw.wroteHeader || vw.started {
+		return
+	}
+	vw.status = code
+	vw.wroteHeader = true
+}
+
+func (vw *validatingWriter) Write(b []byte) (int, error) {
+	if !vw.started {
+		vw.start(b)
+	}
+	switch {
+	case vw.violation != nil:
+		// The replacement goes out at the end, the handler's body is dropped.
+		return len(b), nil
+	case vw.buffering:
+		return vw.buf.Write(b)
+	default:
+		return vw.ResponseWriter.Write(b)
+	}
+}
+
+// start decides what to do with the response once the handler begins its
+// body. first is used to sniff the content type if the handler set none.
+func (vw *validatingWriter) start(first []byte) {
+	vw.started = true
+	header := vw.ResponseWriter.Header()
+	contentType := header.Get("Content-Type")
+	if contentType == "" && len(first) > 0 {
+		contentType = http.DetectContentType(first)
+		header.Set("Content-Type", contentType)
+	}
+
+	if vw.op.BuffersResponse(vw.status, contentType) {
+		vw.buffering = true
+		return
+	}
+	if err := vw.op.ValidateResponse(vw.status, contentType, nil); err != nil {
+		vw.violation = err
+		return
+	}
+	vw.ResponseWriter.WriteHeader(vw.status)
+}
+
+func (vw *validatingWriter) finish(r *http.Request) {
+	if !vw.started {
+		vw.start(nil)
+	}
+	if vw.buffering && vw.violation == nil {
+		contentType := vw.ResponseWriter.Header().Get("Content-Type")
+		if err := vw.op.ValidateResponse(vw.status, contentType, vw.buf.Bytes()); err != nil {
+			vw.violation = err
+		} else {
+			vw.ResponseWriter.WriteHeader(vw.status)
+			vw.ResponseWriter.Write(vw.buf.Bytes())
+			return
+		}
+	}
+	if vw.violation == nil {
+		return
+	}
+
+	slog.ErrorContext(r.Context(), "Response doesn't match the OpenAPI document",
+		"operation", vw.op.Method+" "+vw.op.Path, "status", vw.status, "violation", vw.violation)
+	header := vw.ResponseWriter.Header()
+	for _, name := range []string{"Content-Length", "Content-Range", "Content-Encoding", "Location"} {
+		header.Del(name)
+	}
+	respondWithErrorCode(vw.ResponseWriter, http.StatusInternalServerError, apierror.CodeSpecViolation,
+		"Response doesn't match the API: "+vw.violation.Error(), nil)
+}
+
+// Unwrap lets http.ResponseController reach the real writer.
+func (vw *validatingWriter) Unwrap() http.ResponseWriter {
+	return vw.ResponseWriter
+}
+
+func (vw *validatingWriter) recordError(apiErr *apierror.Error) {
+	if rec, ok := vw.ResponseWriter.(errorRecorder); ok {
+		rec.recordError(apiErr)
+	}
+}
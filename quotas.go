@@ -0,0 +1,129 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/apierror"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+type usageResponse struct {
+	database.Usage
+	// Limits are null when unlimited.
+	MaxBytes  *int64 `json:"max_bytes"`
+	MaxVideos *int   `json:"max_videos"`
+}
+
+func newUsageResponse(usage database.Usage, quota database.Quota) usageResponse {
+	response := usageResponse{Usage: usage}
+	if quota.MaxBytes > 0 {
+		response.MaxBytes = &quota.MaxBytes
+	}
+	if quota.MaxVideos > 0 {
+		response.MaxVideos = &quota.MaxVideos
+	}
+	return response
+}
+
+func (cfg *apiConfig) handlerUsage(w http.ResponseWriter, r *http.Request) {
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return
+	}
+	userID, err := auth.ValidateJWT(token, cfg.jwtSecret)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		return
+	}
+
+	usage, err := cfg.db.GetUsage(r.Context(), userID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get usage", err)
+		return
+	}
+	quota, err := cfg.db.GetQuota(r.Context(), userID, cfg.defaultQuota)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get quota", err)
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, newUsageResponse(usage, quota))
+}
+
+// checkAdminKey authenticates admin endpoints with ADMIN_API_KEY, sent as
+// "Authorization: ApiKey <key>". Without a configured key they're disabled.
+func (cfg *apiConfig) checkAdminKey(w http.ResponseWriter, r *http.Request) bool {
+	if cfg.adminAPIKey == "" {
+		respondWithError(w, http.StatusForbidden, "Admin API is disabled, set ADMIN_API_KEY to enable it", nil)
+		return false
+	}
+	key, err := auth.GetAPIKey(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find API key", err)
+		return false
+	}
+	if subtle.ConstantTimeCompare([]byte(key), []byte(cfg.adminAPIKey)) != 1 {
+		respondWithError(w, http.StatusUnauthorized, "Invalid API key", nil)
+		return false
+	}
+	return true
+}
+
+// handlerAdminSetQuota overrides a user's quota. Null or missing fields use
+// the default, 0 means unlimited.
+func (cfg *apiConfig) handlerAdminSetQuota(w http.ResponseWriter, r *http.Request) {
+	if !cfg.checkAdminKey(w, r) {
+		return
+	}
+
+	userID, err := uuid.Parse(r.PathValue("userID"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid ID", err)
+		return
+	}
+	_, err = cfg.db.GetUser(r.Context(), userID)
+	if errors.Is(err, database.ErrNotFound) {
+		respondWithError(w, http.StatusNotFound, "User not found", err)
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get user", err)
+		return
+	}
+
+	params := database.QuotaOverride{}
+	err = json.NewDecoder(r.Body).Decode(&params)
+	if err != nil {
+		respondWithErrorCode(w, http.StatusBadRequest, apierror.CodeInvalidJSON, "Couldn't decode parameters", err)
+		return
+	}
+	if (params.MaxBytes != nil && *params.MaxBytes < 0) || (params.MaxVideos != nil && *params.MaxVideos < 0) {
+		respondWithError(w, http.StatusBadRequest, "Quotas can't be negative", nil)
+		return
+	}
+
+	err = cfg.db.SetQuotaOverride(r.Context(), userID, params)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't set quota", err)
+		return
+	}
+
+	usage, err := cfg.db.GetUsage(r.Context(), userID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get usage", err)
+		return
+	}
+	quota, err := cfg.db.GetQuota(r.Context(), userID, cfg.defaultQuota)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get quota", err)
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, newUsageResponse(usage, quota))
+}
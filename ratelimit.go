@@ -0,0 +1,46 @@
+package main
+
+import (
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/ratelimit"
+)
+
+func rateLimitMiddleware(limiter *ratelimit.Limiter, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		allowed, retryAfter, err := limiter.Allow(clientIP(r))
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Couldn't check rate limit", err)
+			return
+		}
+		if !allowed {
+			setRetryAfter(w, retryAfter)
+			respondWithError(w, http.StatusTooManyRequests, "Too many requests, slow down", nil)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// clientIP returns the address of the connecting client. Forwarding headers
+// are ignored here, since anyone can set them: realIPMiddleware has already
+// swapped in the forwarded address for requests from TRUSTED_PROXIES.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+func setRetryAfter(w http.ResponseWriter, d time.Duration) {
+	seconds := int(math.Ceil(d.Seconds()))
+	if seconds < 1 {
+		seconds = 1
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/config"
+)
+
+// trustedProxies are the load balancers and proxies whose X-Forwarded-For
+// header is believed.
+type trustedProxies []netip.Prefix
+
+// newTrustedProxies parses TRUSTED_PROXIES, or returns nil if no proxy is
+// trusted. Config.Validate has checked the entries.
+func newTrustedProxies(conf config.Config) trustedProxies {
+	var proxies trustedProxies
+	for _, entry := range config.SplitList(conf.TrustedProxies) {
+		if prefix, err := netip.ParsePrefix(entry); err == nil {
+			proxies = append(proxies, prefix.Masked())
+			continue
+		}
+		if addr, err := netip.ParseAddr(entry); err == nil {
+			addr = addr.Unmap()
+			proxies = append(proxies, netip.PrefixFrom(addr, addr.BitLen()))
+		}
+	}
+	return proxies
+}
+
+func (p trustedProxies) contains(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	for _, prefix := range p {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// forwardedClient walks X-Forwarded-For from the right, skipping trusted
+// proxies, and returns the first hop that isn't one. Entries to the left of
+// it were written by the client and can't be believed.
+func (p trustedProxies) forwardedClient(r *http.Request) (netip.Addr, bool) {
+	var hops []string
+	for _, value := range r.Header.Values("X-Forwarded-For") {
+		hops = append(hops, strings.Split(value, ",")...)
+	}
+	var client netip.Addr
+	for i := len(hops) - 1; i >= 0; i-- {
+		addr, err := netip.ParseAddr(strings.TrimSpace(hops[i]))
+		if err != nil {
+			break
+		}
+		client = addr.Unmap()
+		if !p.contains(client) {
+			break
+		}
+	}
+	return client, client.IsValid()
+}
+
+// realIPMiddleware replaces RemoteAddr with the forwarded client address on
+// requests that come from a trusted proxy, so rate limits, access logs and
+// URL_BIND_IP see the client rather than the load balancer. It has to sit
+// outside everything that calls clientIP.
+func realIPMiddleware(proxies trustedProxies) middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			peer, err := netip.ParseAddr(clientIP(r))
+			if err != nil || !proxies.contains(peer) {
+				next.ServeHTTP(w, r)
+				return
+			}
+			if client, ok := proxies.forwardedClient(r); ok {
+				r = r.WithContext(r.Context())
+				r.RemoteAddr = net.JoinHostPort(client.String(), "0")
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
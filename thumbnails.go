@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"image"
+	"strings"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/imaging"
+)
+
+// Widths thumbnails are resized to. Images are never scaled up, a narrower
+// upload gets a single variant at its own width.
+var thumbnailWidths = []int{320, 640, 1280}
+
+var thumbnailFormats = []string{imaging.FormatJPEG, imaging.FormatWebP}
+
+// saveThumbnailVariants resizes img to each thumbnail width and stores it in
+// every output format.
+func (cfg apiConfig) saveThumbnailVariants(ctx context.Context, img image.Image) ([]database.ThumbnailVariant, error) {
+	sourceWidth := img.Bounds().Dx()
+	var widths []int
+	for _, width := range thumbnailWidths {
+		if width >= sourceWidth {
+			widths = append(widths, sourceWidth)
+			break
+		}
+		widths = append(widths, width)
+	}
+
+	var variants []database.ThumbnailVariant
+	for _, width := range widths {
+		resized := imaging.Resize(img, width)
+		for _, format := range thumbnailFormats {
+			var buf bytes.Buffer
+			err := imaging.Encode(&buf, resized, format)
+			if err != nil {
+				return nil, fmt.Errorf("couldn't encode %dw %s thumbnail: %w", width, format, err)
+			}
+			key, err := cfg.saveThumbnail(ctx, buf.Bytes(), format)
+			if err != nil {
+				return nil, err
+			}
+			variants = append(variants, database.ThumbnailVariant{
+				Format: format,
+				Width:  resized.Bounds().Dx(),
+				Height: resized.Bounds().Dy(),
+				Key:    key,
+			})
+		}
+	}
+	return variants, nil
+}
+
+// thumbnailVariantURL resolves a variant to a URL. Variants saved before
+// thumbnails moved to the storage backend only have a URL.
+func (cfg apiConfig) thumbnailVariantURL(variant database.ThumbnailVariant) string {
+	if variant.Key == "" {
+		return variant.URL
+	}
+	return cfg.assetURL(variant.Key)
+}
+
+// largestThumbnailURL picks the widest variant in format, or in any format
+// if there's none in that one.
+func (cfg apiConfig) largestThumbnailURL(variants []database.ThumbnailVariant, format string) *string {
+	var largest *database.ThumbnailVariant
+	for i, variant := range variants {
+		if format != "" && variant.Format != format {
+			continue
+		}
+		if largest == nil || variant.Width > largest.Width {
+			largest = &variants[i]
+		}
+	}
+	if largest == nil && format != "" {
+		return cfg.largestThumbnailURL(variants, "")
+	}
+	if largest == nil {
+		return nil
+	}
+	url := cfg.thumbnailVariantURL(*largest)
+	return &url
+}
+
+// thumbnailSrcset builds srcset values per image type, ready for
+// <source type="..." srcset="...">.
+func (cfg apiConfig) thumbnailSrcset(variants []database.ThumbnailVariant) map[string]string {
+	if len(variants) == 0 {
+		return nil
+	}
+	candidates := map[string][]string{}
+	for _, variant := range variants {
+		candidates[variant.Format] = append(candidates[variant.Format], fmt.Sprintf("%s %dw", cfg.thumbnailVariantURL(variant), variant.Width))
+	}
+	srcset := make(map[string]string, len(candidates))
+	for format, list := range candidates {
+		srcset[format] = strings.Join(list, ", ")
+	}
+	return srcset
+}
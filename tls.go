@@ -0,0 +1,101 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+)
+
+// certCheckInterval is how often certReloader looks for a renewed
+// certificate.
+const certCheckInterval = 30 * time.Second
+
+// certReloader serves a certificate from files on disk and picks up
+// renewals (e.g. by certbot or cert-manager) without a restart.
+type certReloader struct {
+	certFile string
+	keyFile  string
+
+	mu        sync.Mutex
+	cert      *tls.Certificate
+	modTime   time.Time
+	checkedAt time.Time
+}
+
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	c := &certReloader{certFile: certFile, keyFile: keyFile}
+	modTime, err := c.latestModTime()
+	if err != nil {
+		return nil, err
+	}
+	err = c.load(modTime)
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *certReloader) latestModTime() (time.Time, error) {
+	var latest time.Time
+	for _, name := range []string{c.certFile, c.keyFile} {
+		info, err := os.Stat(name)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+func (c *certReloader) load(modTime time.Time) error {
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return fmt.Errorf("couldn't load TLS certificate: %w", err)
+	}
+	c.cert = &cert
+	c.modTime = modTime
+	return nil
+}
+
+// GetCertificate is used as tls.Config.GetCertificate. A renewal that
+// can't be loaded, say because only the certificate has been written so
+// far, is logged and the old certificate kept until the next check.
+func (c *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if time.Since(c.checkedAt) < certCheckInterval {
+		return c.cert, nil
+	}
+	c.checkedAt = time.Now()
+
+	modTime, err := c.latestModTime()
+	if err != nil {
+		slog.Warn("Couldn't check TLS certificate files", "error", err)
+		return c.cert, nil
+	}
+	if modTime.Equal(c.modTime) {
+		return c.cert, nil
+	}
+	err = c.load(modTime)
+	if err != nil {
+		slog.Warn("Keeping the old TLS certificate", "error", err)
+		return c.cert, nil
+	}
+	slog.Info("Reloaded TLS certificate", "cert_file", c.certFile)
+	return c.cert, nil
+}
+
+// serverTLSConfig is the TLS setup for the API, using certificates from
+// reloader.
+func serverTLSConfig(reloader *certReloader) *tls.Config {
+	return &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: reloader.GetCertificate,
+	}
+}